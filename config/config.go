@@ -15,12 +15,28 @@ func InitDB() error {
 	if err != nil {
 		return err
 	}
+	return Migrate(DB)
+}
 
-	err = DB.AutoMigrate(
+// Migrate creates or updates the tables of every model.
+func Migrate(db *gorm.DB) error {
+	err := db.AutoMigrate(
 		&models.User{},
 		&models.Channel{},
 		&models.Message{},
 		&models.UserChannel{},
+		&models.Session{},
+		&models.RefreshToken{},
+		&models.SigningKey{},
+		&models.RecoveryCode{},
+		&models.UserToken{},
+		&models.PersonalAccessToken{},
+		&models.ExternalIdentity{},
+		&models.Invite{},
+		&models.Avatar{},
+		&models.Block{},
+		&models.DataExport{},
+		&models.AuditEntry{},
 	)
 	if err != nil {
 		return err
@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+const accessTokenTouchInterval = time.Minute
+
+var ErrAccessTokenNotFound = errors.New("access token not found")
+
+// --- Personal Access Tokens ---
+
+func accessTokenTouchKey(id uint64) string {
+	return fmt.Sprintf("pat:%d:touched", id)
+}
+
+func CreatePersonalAccessToken(db *gorm.DB, token *models.PersonalAccessToken) error {
+	if err := db.Create(token).Error; err != nil {
+		log.Printf("[ERROR] Failed to store access token for user ID=%d: %v", token.UserID, err)
+		return err
+	}
+	log.Printf("[INFO] Created access token ID=%d '%s' for user ID=%d (scopes=%s)", token.ID, token.Name, token.UserID, token.Scopes)
+	return nil
+}
+
+func CountPersonalAccessTokens(db *gorm.DB, userID uint64) (int64, error) {
+	var count int64
+	err := db.Model(&models.PersonalAccessToken{}).Where("user_id = ?", userID).Count(&count).Error
+	if err != nil {
+		log.Printf("[ERROR] Failed to count access tokens for user ID=%d: %v", userID, err)
+	}
+	return count, err
+}
+
+func GetUserPersonalAccessTokens(db *gorm.DB, userID uint64) ([]models.PersonalAccessToken, error) {
+	var tokens []models.PersonalAccessToken
+	err := db.Where("user_id = ?", userID).Order("created_at DESC").Find(&tokens).Error
+	if err != nil {
+		log.Printf("[ERROR] Failed to list access tokens for user ID=%d: %v", userID, err)
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// GetPersonalAccessTokenByHash is on the path of every request made with a
+// token, so it goes to the cache first.
+func GetPersonalAccessTokenByHash(db *gorm.DB, tokenHash string) (*models.PersonalAccessToken, error) {
+	if token, err := GetCacheAccessToken(tokenHash); err == nil {
+		return token, nil
+	}
+
+	var token models.PersonalAccessToken
+	if err := db.Where("token_hash = ?", tokenHash).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrAccessTokenNotFound
+		}
+		log.Printf("[ERROR] Failed to look up access token: %v", err)
+		return nil, err
+	}
+	if err := SetCacheAccessToken(token); err != nil {
+		log.Printf("[WARN] Failed to cache access token ID=%d: %v", token.ID, err)
+	}
+	return &token, nil
+}
+
+// TouchPersonalAccessToken records when and from where the token was last
+// used. The database is written at most once a minute per token.
+func TouchPersonalAccessToken(db *gorm.DB, token *models.PersonalAccessToken, ip string) {
+	ok, err := Rdb.SetNX(ctx, accessTokenTouchKey(token.ID), 1, accessTokenTouchInterval).Result()
+	if err != nil || !ok {
+		return
+	}
+	err = db.Model(&models.PersonalAccessToken{}).
+		Where("id = ?", token.ID).
+		Updates(map[string]any{"last_used_at": time.Now(), "last_used_ip": ip}).Error
+	if err != nil {
+		log.Printf("[WARN] Failed to record use of access token ID=%d: %v", token.ID, err)
+	}
+}
+
+// DeletePersonalAccessToken revokes one of the user's tokens.
+func DeletePersonalAccessToken(db *gorm.DB, userID uint64, id uint64) error {
+	var token models.PersonalAccessToken
+	if err := db.Where("id = ? AND user_id = ?", id, userID).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrAccessTokenNotFound
+		}
+		log.Printf("[ERROR] Failed to find access token ID=%d: %v", id, err)
+		return err
+	}
+	if err := db.Delete(&token).Error; err != nil {
+		log.Printf("[ERROR] Failed to delete access token ID=%d: %v", id, err)
+		return err
+	}
+	if err := DeleteCacheAccessToken(token.TokenHash); err != nil {
+		log.Printf("[WARN] Failed to drop cached access token ID=%d: %v", id, err)
+	}
+	log.Printf("[INFO] Revoked access token ID=%d of user ID=%d", id, userID)
+	return nil
+}
+
+func DeleteUserPersonalAccessTokens(db *gorm.DB, userID uint64) error {
+	tokens, err := GetUserPersonalAccessTokens(db, userID)
+	if err != nil {
+		return err
+	}
+	if err := db.Where("user_id = ?", userID).Delete(&models.PersonalAccessToken{}).Error; err != nil {
+		log.Printf("[ERROR] Failed to delete access tokens of user ID=%d: %v", userID, err)
+		return err
+	}
+	for _, token := range tokens {
+		DeleteCacheAccessToken(token.TokenHash)
+	}
+	log.Printf("[INFO] Revoked %d access tokens of user ID=%d", len(tokens), userID)
+	return nil
+}
@@ -0,0 +1,192 @@
+package controller
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrUserTokenInvalid = errors.New("invalid or expired token")
+	ErrEmailTaken       = errors.New("email address is already in use")
+)
+
+// IsDuplicateKey reports whether err is a unique constraint violation, in
+// whatever form the database behind db reports it.
+func IsDuplicateKey(db *gorm.DB, err error) bool {
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return true
+	}
+	translator, ok := db.Dialector.(gorm.ErrorTranslator)
+	return ok && errors.Is(translator.Translate(err), gorm.ErrDuplicatedKey)
+}
+
+// --- Email ---
+
+func mailCooldownKey(subject string) string {
+	return "mail:cooldown:" + subject
+}
+
+func GetUserByEmail(db *gorm.DB, email string) (*models.User, error) {
+	var user models.User
+	if err := db.Where("email = ?", email).First(&user).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("[ERROR] Failed to look up user by email: %v", err)
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// EmailInUse reports whether another user already has the address.
+func EmailInUse(db *gorm.DB, email string, exceptUserID uint64) (bool, error) {
+	var count int64
+	err := db.Model(&models.User{}).
+		Where("email = ? AND id <> ?", email, exceptUserID).
+		Count(&count).Error
+	if err != nil {
+		log.Printf("[ERROR] Failed to check whether an email is in use: %v", err)
+	}
+	return count > 0, err
+}
+
+// SetUserEmail replaces the user's address and marks it unverified. Tokens
+// sent to the old address stop working.
+func SetUserEmail(db *gorm.DB, userID uint64, email string) error {
+	taken, err := EmailInUse(db, email, userID)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return ErrEmailTaken
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.User{}).
+			Where("id = ?", userID).
+			Updates(map[string]any{"email": email, "email_verified_at": nil}).Error
+		if err != nil {
+			return err
+		}
+		return deleteUserTokens(tx, userID, models.TokenEmailVerification)
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to set email for user ID=%d: %v", userID, err)
+		return err
+	}
+	log.Printf("[INFO] User ID=%d changed their email address", userID)
+	return nil
+}
+
+// MarkEmailVerified only succeeds while the user still has the address the
+// token was sent to.
+func MarkEmailVerified(db *gorm.DB, userID uint64, email string) error {
+	res := db.Model(&models.User{}).
+		Where("id = ? AND email = ?", userID, email).
+		Update("email_verified_at", time.Now())
+	if res.Error != nil {
+		log.Printf("[ERROR] Failed to mark email verified for user ID=%d: %v", userID, res.Error)
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrUserTokenInvalid
+	}
+	log.Printf("[INFO] User ID=%d verified their email address", userID)
+	return nil
+}
+
+// LockMail allows one mail per subject (an address, a user) per ttl, so the
+// public endpoints can't be used to flood someone's inbox.
+func LockMail(subject string, ttl time.Duration) bool {
+	ok, err := Rdb.SetNX(ctx, mailCooldownKey(subject), 1, ttl).Result()
+	if err != nil {
+		log.Printf("[WARN] Failed to take mail cooldown for %s: %v", subject, err)
+		return false
+	}
+	return ok
+}
+
+// --- Passwords ---
+
+// SetPasswordHash stores a new password and throws away any reset tokens
+// that are still out there.
+func SetPasswordHash(db *gorm.DB, userID uint64, hash string) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.User{}).Where("id = ?", userID).Update("password_hash", hash).Error
+		if err != nil {
+			return err
+		}
+		return deleteUserTokens(tx, userID, models.TokenPasswordReset)
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to set password for user ID=%d: %v", userID, err)
+		return err
+	}
+	log.Printf("[INFO] Password changed for user ID=%d", userID)
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err == nil {
+		if err := SetCacheUser(user); err != nil {
+			log.Printf("[WARN] Failed to cache user ID=%d: %v", userID, err)
+		}
+	}
+	return nil
+}
+
+// --- User Tokens ---
+
+func CreateUserToken(db *gorm.DB, token *models.UserToken) error {
+	if err := db.Create(token).Error; err != nil {
+		log.Printf("[ERROR] Failed to store %s token for user ID=%d: %v", token.Purpose, token.UserID, err)
+		return err
+	}
+	log.Printf("[INFO] Issued %s token ID=%d for user ID=%d", token.Purpose, token.ID, token.UserID)
+	return nil
+}
+
+// ConsumeUserToken spends the unexpired token with the given hash and
+// purpose. Two requests racing with the same token can't both succeed.
+func ConsumeUserToken(db *gorm.DB, purpose string, tokenHash string) (*models.UserToken, error) {
+	var token models.UserToken
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("token_hash = ? AND purpose = ?", tokenHash, purpose).First(&token).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUserTokenInvalid
+		}
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if token.UsedAt != nil || now.After(token.ExpiresAt) {
+			return ErrUserTokenInvalid
+		}
+		res := tx.Model(&models.UserToken{}).
+			Where("id = ? AND used_at IS NULL", token.ID).
+			Update("used_at", now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrUserTokenInvalid
+		}
+		token.UsedAt = &now
+		return nil
+	})
+	if err != nil {
+		if !errors.Is(err, ErrUserTokenInvalid) {
+			log.Printf("[ERROR] Failed to use %s token: %v", purpose, err)
+		}
+		return nil, err
+	}
+	log.Printf("[INFO] User ID=%d used %s token ID=%d", token.UserID, purpose, token.ID)
+	return &token, nil
+}
+
+func deleteUserTokens(tx *gorm.DB, userID uint64, purpose string) error {
+	return tx.Where("user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose).
+		Delete(&models.UserToken{}).Error
+}
@@ -0,0 +1,166 @@
+package controller
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrChannelNotFound = errors.New("channel not found")
+	ErrMessageNotFound = errors.New("message not found")
+)
+
+const (
+	UserStatusActive   = "active"
+	UserStatusDisabled = "disabled"
+	UserStatusAdmin    = "admin"
+)
+
+type InstanceStats struct {
+	Users struct {
+		Total    int64 `json:"total"`
+		Active   int64 `json:"active"`
+		Disabled int64 `json:"disabled"`
+		Admins   int64 `json:"admins"`
+		NewToday int64 `json:"new_today"`
+	} `json:"users"`
+	Channels int64 `json:"channels"`
+	Messages struct {
+		Total int64 `json:"total"`
+		Today int64 `json:"today"`
+	} `json:"messages"`
+	Sessions int64 `json:"sessions"`
+	// only the node answering; every node keeps its own connections
+	Node struct {
+		Viewers  int `json:"viewers"`
+		Channels int `json:"channels"`
+	} `json:"node"`
+}
+
+// --- Users ---
+
+// ListUsers pages through every account, including disabled ones and the
+// deleted-user placeholder. pattern is a LIKE pattern (with \ as escape)
+// matched against the username, display name and email address; an empty
+// one matches everybody.
+func ListUsers(db *gorm.DB, pattern string, status string, limit int, offset int) ([]models.User, int64, error) {
+	query := db.Model(&models.User{})
+	if pattern != "" {
+		query = query.Where(`LOWER(username) LIKE ? ESCAPE '\' OR LOWER(display_name) LIKE ? ESCAPE '\' OR LOWER(email) LIKE ? ESCAPE '\'`,
+			pattern, pattern, pattern)
+	}
+	switch status {
+	case UserStatusActive:
+		query = query.Where("disabled_at IS NULL")
+	case UserStatusDisabled:
+		query = query.Where("disabled_at IS NOT NULL")
+	case UserStatusAdmin:
+		query = query.Where("admin = ?", true)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		log.Printf("[ERROR] Failed to count users: %v", err)
+		return nil, 0, err
+	}
+	var users []models.User
+	if err := query.Order("id").Limit(limit).Offset(offset).Find(&users).Error; err != nil {
+		log.Printf("[ERROR] Failed to list users: %v", err)
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+func SetUserAdmin(db *gorm.DB, id uint64, admin bool) (*models.User, error) {
+	res := db.Model(&models.User{}).Where("id = ?", id).Update("admin", admin)
+	if res.Error != nil {
+		log.Printf("[ERROR] Failed to update admin flag of user ID=%d: %v", id, res.Error)
+		return nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return nil, ErrUserNotFound
+	}
+	user, err := GetUserProfile(db, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := SetCacheUser(*user); err != nil {
+		log.Printf("[WARN] Failed to cache user ID=%d: %v", id, err)
+	}
+	log.Printf("[INFO] User ID=%d admin=%t", id, admin)
+	return user, nil
+}
+
+// --- Messages ---
+
+func DeleteMessage(db *gorm.DB, id uint64) (*models.Message, error) {
+	var msg models.Message
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&msg, id).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrMessageNotFound
+			}
+			return err
+		}
+		return tx.Delete(&msg).Error
+	})
+	if err != nil {
+		if !errors.Is(err, ErrMessageNotFound) {
+			log.Printf("[ERROR] Failed to delete message ID=%d: %v", id, err)
+		}
+		return nil, err
+	}
+	log.Printf("[INFO] Deleted message ID=%d in channel ID=%d", id, msg.ChannelID)
+
+	DeleteCacheMessages([]models.Message{msg})
+	// the message mustn't come back through Last-Event-ID replay either
+	err = RewriteEvents(msg.ChannelID, func(event *models.Event) *models.Event {
+		if data, ok := event.Data.(map[string]any); ok && event.Type == models.EventMessageCreated && data["id"] == int64(msg.ID) {
+			return nil
+		}
+		return event
+	})
+	if err != nil {
+		log.Printf("[WARN] Failed to remove message ID=%d from the events of channel %d: %v", id, msg.ChannelID, err)
+	}
+	if err := PublishEvent(models.NewMessageDeletedEvent(&msg)); err != nil {
+		log.Printf("[WARN] Failed to publish message.deleted event for ID=%d: %v", id, err)
+	}
+	return &msg, nil
+}
+
+// --- Statistics ---
+
+func GetInstanceStats(db *gorm.DB) (*InstanceStats, error) {
+	var stats InstanceStats
+	now := time.Now()
+	dayAgo := now.Add(-24 * time.Hour)
+
+	counts := []struct {
+		count *int64
+		query *gorm.DB
+	}{
+		{&stats.Users.Total, db.Model(&models.User{})},
+		{&stats.Users.Active, db.Model(&models.User{}).Where("disabled_at IS NULL")},
+		{&stats.Users.Disabled, db.Model(&models.User{}).Where("disabled_at IS NOT NULL")},
+		{&stats.Users.Admins, db.Model(&models.User{}).Where("admin = ?", true)},
+		{&stats.Users.NewToday, db.Model(&models.User{}).Where("created_at > ?", dayAgo)},
+		{&stats.Channels, db.Model(&models.Channel{})},
+		{&stats.Messages.Total, db.Model(&models.Message{})},
+		{&stats.Messages.Today, db.Model(&models.Message{}).Where("created_at > ?", dayAgo)},
+		{&stats.Sessions, db.Model(&models.Session{}).Where("revoked_at IS NULL AND expires_at > ?", now)},
+	}
+	for _, c := range counts {
+		if err := c.query.Count(c.count).Error; err != nil {
+			log.Printf("[ERROR] Failed to gather instance statistics: %v", err)
+			return nil, err
+		}
+	}
+
+	stats.Node.Viewers, stats.Node.Channels = Viewers()
+	return &stats, nil
+}
@@ -0,0 +1,19 @@
+package controller
+
+import (
+	"log"
+
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+// --- Audit Log ---
+
+func CreateAuditEntry(db *gorm.DB, entry *models.AuditEntry) error {
+	if err := db.Create(entry).Error; err != nil {
+		log.Printf("[ERROR] Failed to write audit entry %s for '%s': %v", entry.Action, entry.Subject, err)
+		return err
+	}
+	log.Printf("[INFO] Audit: %s subject='%s' ip=%s %s", entry.Action, entry.Subject, entry.IP, entry.Details)
+	return nil
+}
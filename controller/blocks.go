@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"errors"
+	"log"
+
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrBlockNotFound = errors.New("user is not blocked")
+
+// --- Blocks ---
+
+// BlockUser returns false when the user was already blocked.
+func BlockUser(db *gorm.DB, blockerID uint64, blockedID uint64) (bool, error) {
+	res := db.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&models.Block{BlockerID: blockerID, BlockedID: blockedID})
+	if res.Error != nil {
+		log.Printf("[ERROR] Failed to block user ID=%d for user ID=%d: %v", blockedID, blockerID, res.Error)
+		return false, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return false, nil
+	}
+	log.Printf("[INFO] User ID=%d blocked user ID=%d", blockerID, blockedID)
+	publishBlockList(db, blockerID)
+	return true, nil
+}
+
+func UnblockUser(db *gorm.DB, blockerID uint64, blockedID uint64) error {
+	res := db.Where("blocker_id = ? AND blocked_id = ?", blockerID, blockedID).Delete(&models.Block{})
+	if res.Error != nil {
+		log.Printf("[ERROR] Failed to unblock user ID=%d for user ID=%d: %v", blockedID, blockerID, res.Error)
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrBlockNotFound
+	}
+	log.Printf("[INFO] User ID=%d unblocked user ID=%d", blockerID, blockedID)
+	publishBlockList(db, blockerID)
+	return nil
+}
+
+func GetBlocks(db *gorm.DB, blockerID uint64) ([]models.Block, error) {
+	var blocks []models.Block
+	err := db.Preload("Blocked").Where("blocker_id = ?", blockerID).Order("created_at DESC").Find(&blocks).Error
+	if err != nil {
+		log.Printf("[ERROR] Failed to list blocks of user ID=%d: %v", blockerID, err)
+		return nil, err
+	}
+	return blocks, nil
+}
+
+func CountBlocks(db *gorm.DB, blockerID uint64) (int64, error) {
+	var count int64
+	err := db.Model(&models.Block{}).Where("blocker_id = ?", blockerID).Count(&count).Error
+	return count, err
+}
+
+// GetBlockedUserIDs lists who the user has blocked.
+func GetBlockedUserIDs(db *gorm.DB, blockerID uint64) ([]uint64, error) {
+	var ids []uint64
+	err := db.Model(&models.Block{}).Where("blocker_id = ?", blockerID).Pluck("blocked_id", &ids).Error
+	if err != nil {
+		log.Printf("[ERROR] Failed to load blocks of user ID=%d: %v", blockerID, err)
+		return nil, err
+	}
+	return ids, nil
+}
+
+// EitherBlocked is true if one of the two users has blocked the other.
+func EitherBlocked(db *gorm.DB, a uint64, b uint64) (bool, error) {
+	var count int64
+	err := db.Model(&models.Block{}).
+		Where("(blocker_id = ? AND blocked_id = ?) OR (blocker_id = ? AND blocked_id = ?)", a, b, b, a).
+		Count(&count).Error
+	if err != nil {
+		log.Printf("[ERROR] Failed to check blocks between user ID=%d and ID=%d: %v", a, b, err)
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// publishBlockList tells every node's live connections of the user about
+// their new block list.
+func publishBlockList(db *gorm.DB, userID uint64) {
+	blocked, err := GetBlockedUserIDs(db, userID)
+	if err == nil {
+		err = PublishBlockList(userID, blocked)
+	}
+	if err != nil {
+		log.Printf("[WARN] Live connections of user ID=%d keep their old block list: %v", userID, err)
+	}
+}
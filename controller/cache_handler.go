@@ -2,10 +2,12 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -69,10 +71,16 @@ func getCacheFields(keys []string) (map[string]string, error) {
 
 func SetCacheUser(user models.User) error {
 	prefix := fmt.Sprintf("user:%d", user.ID)
+	disabledAt := ""
+	if user.DisabledAt != nil {
+		disabledAt = user.DisabledAt.Format(time.RFC3339)
+	}
 	err := setCacheFields(map[string]string{
 		prefix + ":username":      user.Username,
 		prefix + ":password_hash": user.PasswordHash,
 		prefix + ":display_name":  user.DisplayName,
+		prefix + ":disabled_at":   disabledAt,
+		prefix + ":admin":         strconv.FormatBool(user.Admin),
 	}, 10*time.Minute)
 	if err != nil {
 		log.Printf("[ERROR] Failed to cache user ID=%d: %v", user.ID, err)
@@ -84,7 +92,7 @@ func SetCacheUser(user models.User) error {
 
 func GetCacheUser(id uint64) (*models.User, error) {
 	prefix := fmt.Sprintf("user:%d", id)
-	keys := []string{prefix + ":username", prefix + ":password_hash", prefix + ":display_name"}
+	keys := []string{prefix + ":username", prefix + ":password_hash", prefix + ":display_name", prefix + ":disabled_at", prefix + ":admin"}
 
 	data, err := getCacheFields(keys)
 	if err != nil {
@@ -92,13 +100,162 @@ func GetCacheUser(id uint64) (*models.User, error) {
 		return nil, err
 	}
 
-	log.Printf("[INFO] Cache hit for user ID=%d", id)
-	return &models.User{
+	user := &models.User{
 		ID:           id,
 		Username:     data[keys[0]],
 		PasswordHash: data[keys[1]],
 		DisplayName:  data[keys[2]],
-	}, nil
+		Admin:        data[keys[4]] == "true",
+	}
+	if data[keys[3]] != "" {
+		disabledAt, err := time.Parse(time.RFC3339, data[keys[3]])
+		if err != nil {
+			log.Printf("[WARN] Invalid cached disabled_at for user ID=%d: %v", id, err)
+			return nil, err
+		}
+		user.DisabledAt = &disabledAt
+	}
+
+	log.Printf("[INFO] Cache hit for user ID=%d", id)
+	return user, nil
+}
+
+func DeleteCacheUser(id uint64) error {
+	prefix := fmt.Sprintf("user:%d", id)
+	err := Rdb.Del(ctx, prefix+":username", prefix+":password_hash", prefix+":display_name", prefix+":disabled_at", prefix+":admin").Err()
+	if err != nil {
+		log.Printf("[ERROR] Failed to delete user cache for ID=%d: %v", id, err)
+		return err
+	}
+	log.Printf("[INFO] Deleted cache for user ID=%d", id)
+	return nil
+}
+
+// --- Session Cache ---
+
+// Only what the auth middleware needs on every request is cached; the rest
+// of the session is read from the database when sessions are listed.
+func SetCacheSession(session models.Session) error {
+	prefix := "session:" + session.ID
+	revokedAt := ""
+	if session.RevokedAt != nil {
+		revokedAt = session.RevokedAt.Format(time.RFC3339)
+	}
+	err := setCacheFields(map[string]string{
+		prefix + ":user_id":    strconv.FormatUint(session.UserID, 10),
+		prefix + ":expires_at": session.ExpiresAt.Format(time.RFC3339),
+		prefix + ":revoked_at": revokedAt,
+	}, 10*time.Minute)
+	if err != nil {
+		log.Printf("[ERROR] Failed to cache session %s: %v", session.ID, err)
+		return err
+	}
+	log.Printf("[INFO] Session cached: ID=%s", session.ID)
+	return nil
+}
+
+func GetCacheSession(id string) (*models.Session, error) {
+	prefix := "session:" + id
+	keys := []string{prefix + ":user_id", prefix + ":expires_at", prefix + ":revoked_at"}
+
+	data, err := getCacheFields(keys)
+	if err != nil {
+		log.Printf("[WARN] Cache miss for session %s: %v", id, err)
+		return nil, err
+	}
+
+	session := &models.Session{ID: id}
+	session.UserID, err = strconv.ParseUint(data[keys[0]], 10, 64)
+	if err != nil {
+		log.Printf("[WARN] Invalid cached user_id for session %s: %v", id, err)
+		return nil, err
+	}
+	session.ExpiresAt, err = time.Parse(time.RFC3339, data[keys[1]])
+	if err != nil {
+		log.Printf("[WARN] Invalid cached expires_at for session %s: %v", id, err)
+		return nil, err
+	}
+	if data[keys[2]] != "" {
+		revokedAt, err := time.Parse(time.RFC3339, data[keys[2]])
+		if err != nil {
+			log.Printf("[WARN] Invalid cached revoked_at for session %s: %v", id, err)
+			return nil, err
+		}
+		session.RevokedAt = &revokedAt
+	}
+
+	log.Printf("[INFO] Cache hit for session %s", id)
+	return session, nil
+}
+
+func DeleteCacheSession(id string) error {
+	prefix := "session:" + id
+	if err := Rdb.Del(ctx, prefix+":user_id", prefix+":expires_at", prefix+":revoked_at").Err(); err != nil {
+		log.Printf("[ERROR] Failed to delete session cache for %s: %v", id, err)
+		return err
+	}
+	log.Printf("[INFO] Deleted cache for session %s", id)
+	return nil
+}
+
+func sessionLastSeenKey(id string) string {
+	return "session:" + id + ":last_seen"
+}
+
+// --- Access Token Cache ---
+
+func accessTokenCacheKeys(tokenHash string) []string {
+	prefix := "pat:" + tokenHash
+	return []string{prefix + ":id", prefix + ":user_id", prefix + ":scopes", prefix + ":expires_at"}
+}
+
+func SetCacheAccessToken(token models.PersonalAccessToken) error {
+	keys := accessTokenCacheKeys(token.TokenHash)
+	expiresAt := ""
+	if token.ExpiresAt != nil {
+		expiresAt = token.ExpiresAt.Format(time.RFC3339)
+	}
+	err := setCacheFields(map[string]string{
+		keys[0]: strconv.FormatUint(token.ID, 10),
+		keys[1]: strconv.FormatUint(token.UserID, 10),
+		keys[2]: token.Scopes,
+		keys[3]: expiresAt,
+	}, 10*time.Minute)
+	if err != nil {
+		log.Printf("[ERROR] Failed to cache access token ID=%d: %v", token.ID, err)
+		return err
+	}
+	return nil
+}
+
+func GetCacheAccessToken(tokenHash string) (*models.PersonalAccessToken, error) {
+	keys := accessTokenCacheKeys(tokenHash)
+	data, err := getCacheFields(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &models.PersonalAccessToken{TokenHash: tokenHash}
+	token.SetScopes(strings.Fields(data[keys[2]]))
+	if token.ID, err = strconv.ParseUint(data[keys[0]], 10, 64); err != nil {
+		return nil, err
+	}
+	if token.UserID, err = strconv.ParseUint(data[keys[1]], 10, 64); err != nil {
+		return nil, err
+	}
+	if data[keys[3]] != "" {
+		expiresAt, err := time.Parse(time.RFC3339, data[keys[3]])
+		if err != nil {
+			log.Printf("[WARN] Invalid cached expires_at for access token ID=%d: %v", token.ID, err)
+			return nil, err
+		}
+		token.ExpiresAt = &expiresAt
+	}
+	return token, nil
+}
+
+func DeleteCacheAccessToken(tokenHash string) error {
+	return Rdb.Del(ctx, accessTokenCacheKeys(tokenHash)...).Err()
 }
 
 // --- Channel Cache ---
@@ -161,19 +318,6 @@ func SetCacheMessage(message models.Message) error {
 		return err
 	}
 
-	if err := PushMessageToChannel(message.ChannelID, &message); err != nil {
-		log.Printf("[ERROR] Failed to push message to queue: %v", err)
-		return err
-	}
-	if err := PublishMessage(message.ChannelID, &message); err != nil {
-		log.Printf("[ERROR] Failed to publish message: %v", err)
-		return err
-	}
-	if err := Rdb.LTrim(ctx, fmt.Sprintf("channel:%d:messages", message.ChannelID), -128, -1).Err(); err != nil {
-		log.Printf("[ERROR] Failed to trim message list for channel %d: %v", message.ChannelID, err)
-		return fmt.Errorf("failed to trim channel messages cache: %w", err)
-	}
-
 	log.Printf("[INFO] Message cached: ID=%d, ChannelID=%d", message.ID, message.ChannelID)
 	return nil
 }
@@ -200,10 +344,64 @@ func GetCacheMessage(id uint64) (*models.Message, error) {
 	}, nil
 }
 
+// DeleteCacheMessages forgets the messages and drops them from their
+// channels' recent message lists.
+func DeleteCacheMessages(messages []models.Message) error {
+	pipe := Rdb.Pipeline()
+	for _, message := range messages {
+		prefix := fmt.Sprintf("message:%d", message.ID)
+		pipe.Del(ctx, prefix, prefix+":user_id", prefix+":channel_id")
+		pipe.LRem(ctx, channelMessagesKey(message.ChannelID), 0, message.ID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("[ERROR] Failed to delete %d cached messages: %v", len(messages), err)
+		return err
+	}
+	return nil
+}
+
+// ReassignCacheMessages points cached messages at another author. Messages
+// that aren't cached stay that way.
+func ReassignCacheMessages(messages []models.Message, userID uint64) error {
+	pipe := Rdb.Pipeline()
+	for _, message := range messages {
+		key := fmt.Sprintf("message:%d:user_id", message.ID)
+		pipe.SetArgs(ctx, key, strconv.FormatUint(userID, 10), redis.SetArgs{Mode: "XX", KeepTTL: true})
+	}
+	// XX answers nil for keys that have expired, which isn't a failure
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		log.Printf("[ERROR] Failed to reassign %d cached messages: %v", len(messages), err)
+		return err
+	}
+	return nil
+}
+
 // --- Channel Message Queue & Pub/Sub ---
 
+// The message list and the pub/sub topic used to share the same name; they
+// are kept apart so the list can be inspected without catching live events.
+func channelMessagesKey(channelID uint64) string {
+	return fmt.Sprintf("channel:%d:messages", channelID)
+}
+
+func channelEventsTopic(channelID uint64) string {
+	return fmt.Sprintf("channel:%d:events", channelID)
+}
+
+func channelEventStreamKey(channelID uint64) string {
+	return fmt.Sprintf("channel:%d:stream", channelID)
+}
+
+func channelBacklogKey(channelID uint64) string {
+	return fmt.Sprintf("channel:%d:backlog", channelID)
+}
+
+func channelSeqKey(channelID uint64) string {
+	return fmt.Sprintf("channel:%d:seq", channelID)
+}
+
 func PushMessageToChannel(channelID uint64, message *models.Message) error {
-	key := fmt.Sprintf("channel:%d:messages", channelID)
+	key := channelMessagesKey(channelID)
 	if err := Rdb.RPush(ctx, key, message.ID).Err(); err != nil {
 		log.Printf("[ERROR] Failed to RPush message ID=%d: %v", message.ID, err)
 		return fmt.Errorf("failed to push message to channel: %w", err)
@@ -212,17 +410,8 @@ func PushMessageToChannel(channelID uint64, message *models.Message) error {
 	return Rdb.LTrim(ctx, key, -128, -1).Err()
 }
 
-func PublishMessage(channelID uint64, message *models.Message) error {
-	key := fmt.Sprintf("channel:%d:messages", channelID)
-	err := Rdb.Publish(ctx, key, message.ID).Err()
-	if err != nil {
-		log.Printf("[ERROR] Failed to publish message ID=%d to pubsub: %v", message.ID, err)
-	}
-	return err
-}
-
 func GetMessagesFromChannel(channelID uint64) ([]models.Message, error) {
-	key := fmt.Sprintf("channel:%d:messages", channelID)
+	key := channelMessagesKey(channelID)
 	ids, err := Rdb.LRange(ctx, key, 0, -1).Result()
 	if err != nil {
 		log.Printf("[ERROR] Failed to read message queue for channel ID=%d: %v", channelID, err)
@@ -0,0 +1,399 @@
+package controller
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+const (
+	callRingTimeout   = 45 * time.Second
+	callSweepInterval = 5 * time.Second
+	callTTL           = 24 * time.Hour
+	endedCallTTL      = 10 * time.Minute
+
+	// ringingCallsKey scores each ringing call by when it rings out
+	ringingCallsKey = "calls:ringing"
+)
+
+var (
+	ErrCallNotFound  = errors.New("call not found")
+	ErrCallEnded     = errors.New("call has ended")
+	ErrCallForbidden = errors.New("not allowed in this call")
+	ErrInvalidCall   = errors.New("invalid call request")
+)
+
+// --- Call Signaling ---
+
+func callKey(callID string) string {
+	return "call:" + callID
+}
+
+func callParticipantsKey(callID string) string {
+	return "call:" + callID + ":participants"
+}
+
+func StartCall(db *gorm.DB, channelID uint64, initiator *models.User, calleeID uint64, media string) (*models.Call, error) {
+	if media != "audio" && media != "video" {
+		return nil, fmt.Errorf("%w: media must be 'audio' or 'video'", ErrInvalidCall)
+	}
+	if calleeID == initiator.ID {
+		return nil, fmt.Errorf("%w: cannot call yourself", ErrInvalidCall)
+	}
+	if calleeID != 0 {
+		member, err := IsUserInChannel(db, calleeID, channelID)
+		if err != nil {
+			return nil, err
+		}
+		if !member {
+			return nil, fmt.Errorf("%w: callee is not a member of this channel", ErrCallForbidden)
+		}
+		blocked, err := EitherBlocked(db, initiator.ID, calleeID)
+		if err != nil {
+			return nil, err
+		}
+		if blocked {
+			return nil, fmt.Errorf("%w: you can't call this user", ErrCallForbidden)
+		}
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	ringsUntil := now.Add(callRingTimeout)
+	call := &models.Call{
+		ID:           hex.EncodeToString(id),
+		ChannelID:    channelID,
+		InitiatorID:  initiator.ID,
+		CalleeID:     calleeID,
+		Media:        media,
+		State:        models.CallRinging,
+		Participants: []uint64{initiator.ID},
+		StartedAt:    now,
+		RingsUntil:   &ringsUntil,
+	}
+
+	_, err := Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, callKey(call.ID), map[string]any{
+			"channel_id":   call.ChannelID,
+			"initiator_id": call.InitiatorID,
+			"callee_id":    call.CalleeID,
+			"media":        call.Media,
+			"state":        call.State,
+			"started_at":   call.StartedAt.Format(time.RFC3339),
+			"rings_until":  ringsUntil.Format(time.RFC3339),
+		})
+		pipe.ZAdd(ctx, ringingCallsKey, redis.Z{Score: float64(ringsUntil.Unix()), Member: call.ID})
+		pipe.SAdd(ctx, callParticipantsKey(call.ID), initiator.ID)
+		pipe.Expire(ctx, callKey(call.ID), callTTL)
+		pipe.Expire(ctx, callParticipantsKey(call.ID), callTTL)
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to store call %s: %v", call.ID, err)
+		return nil, err
+	}
+	log.Printf("[INFO] User %d started %s call %s in channel %d (callee=%d)", initiator.ID, media, call.ID, channelID, calleeID)
+
+	postCallMessage(db, call, initiator.ID, fmt.Sprintf("%s started a %s call", initiator.DisplayName, media))
+	if err := PublishEvent(models.NewCallEvent(models.EventCallStarted, call)); err != nil {
+		log.Printf("[WARN] Failed to publish call.started for call %s: %v", call.ID, err)
+	}
+
+	return call, nil
+}
+
+// InitCallSweeper ends calls that rang out. Every node sweeps, so a call
+// still rings out when the node it was started on goes away.
+func InitCallSweeper(db *gorm.DB) {
+	go func() {
+		ticker := time.NewTicker(callSweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			sweepUnansweredCalls(db)
+		}
+	}()
+}
+
+func sweepUnansweredCalls(db *gorm.DB) {
+	due, err := Rdb.ZRangeByScore(ctx, ringingCallsKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().Unix(), 10),
+	}).Result()
+	if err != nil {
+		log.Printf("[WARN] Failed to look for unanswered calls: %v", err)
+		return
+	}
+	for _, callID := range due {
+		// the node that takes the call off the set ends it
+		removed, err := Rdb.ZRem(ctx, ringingCallsKey, callID).Result()
+		if err != nil || removed == 0 {
+			continue
+		}
+		if err := endIfUnanswered(db, callID); err != nil {
+			log.Printf("[WARN] Failed to end unanswered call %s: %v", callID, err)
+		}
+	}
+}
+
+// endIfUnanswered ends the call as missed if it has rung out. Nodes racing
+// to do so are sorted out by EndCall.
+func endIfUnanswered(db *gorm.DB, callID string) error {
+	call, err := GetCall(callID)
+	if errors.Is(err, ErrCallNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !call.Unanswered(time.Now()) {
+		return nil
+	}
+	return EndCall(db, callID, "missed")
+}
+
+func GetCall(callID string) (*models.Call, error) {
+	fields, err := Rdb.HGetAll(ctx, callKey(callID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, ErrCallNotFound
+	}
+
+	members, err := Rdb.SMembers(ctx, callParticipantsKey(callID)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	call := &models.Call{
+		ID:           callID,
+		Media:        fields["media"],
+		State:        fields["state"],
+		EndReason:    fields["end_reason"],
+		Participants: make([]uint64, 0, len(members)),
+	}
+	call.ChannelID, _ = strconv.ParseUint(fields["channel_id"], 10, 64)
+	call.InitiatorID, _ = strconv.ParseUint(fields["initiator_id"], 10, 64)
+	call.CalleeID, _ = strconv.ParseUint(fields["callee_id"], 10, 64)
+	call.StartedAt, _ = time.Parse(time.RFC3339, fields["started_at"])
+	if t, err := time.Parse(time.RFC3339, fields["rings_until"]); err == nil {
+		call.RingsUntil = &t
+	}
+	if t, err := time.Parse(time.RFC3339, fields["answered_at"]); err == nil {
+		call.AnsweredAt = &t
+	}
+	if t, err := time.Parse(time.RFC3339, fields["ended_at"]); err == nil {
+		call.EndedAt = &t
+	}
+	for _, member := range members {
+		if id, err := strconv.ParseUint(member, 10, 64); err == nil {
+			call.Participants = append(call.Participants, id)
+		}
+	}
+	return call, nil
+}
+
+// getChannelCall returns a call of the channel that hasn't ended. One that
+// rang out is ended here if the sweeper hasn't got to it yet.
+func getChannelCall(db *gorm.DB, callID string, channelID uint64) (*models.Call, error) {
+	call, err := GetCall(callID)
+	if err != nil {
+		return nil, err
+	}
+	if call.ChannelID != channelID {
+		return nil, ErrCallNotFound
+	}
+	if call.Unanswered(time.Now()) {
+		if err := EndCall(db, callID, "missed"); err != nil {
+			return nil, err
+		}
+		return nil, ErrCallEnded
+	}
+	if call.State == models.CallEnded {
+		return nil, ErrCallEnded
+	}
+	return call, nil
+}
+
+func AcceptCall(db *gorm.DB, callID string, channelID uint64, user *models.User) (*models.Call, error) {
+	call, err := getChannelCall(db, callID, channelID)
+	if err != nil {
+		return nil, err
+	}
+	if call.IsDirect() && user.ID != call.CalleeID {
+		return nil, ErrCallForbidden
+	}
+	if call.HasParticipant(user.ID) {
+		return call, nil
+	}
+
+	if err := Rdb.SAdd(ctx, callParticipantsKey(callID), user.ID).Err(); err != nil {
+		return nil, err
+	}
+	if call.State == models.CallRinging {
+		_, err := Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, callKey(callID), "state", models.CallActive, "answered_at", time.Now().UTC().Format(time.RFC3339))
+			pipe.HDel(ctx, callKey(callID), "rings_until")
+			pipe.ZRem(ctx, ringingCallsKey, callID)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("[INFO] User %d joined call %s", user.ID, callID)
+
+	return publishCallUpdate(callID)
+}
+
+func RejectCall(db *gorm.DB, callID string, channelID uint64, user *models.User) error {
+	call, err := getChannelCall(db, callID, channelID)
+	if err != nil {
+		return err
+	}
+	if !call.IsDirect() || user.ID != call.CalleeID || call.State != models.CallRinging {
+		return ErrCallForbidden
+	}
+	return EndCall(db, callID, "declined")
+}
+
+// LeaveCall removes a participant. Direct calls end as soon as either side
+// hangs up; channel calls end when the last participant leaves.
+func LeaveCall(db *gorm.DB, callID string, userID uint64) error {
+	call, err := GetCall(callID)
+	if err != nil {
+		return err
+	}
+	if call.State == models.CallEnded || !call.HasParticipant(userID) {
+		return nil
+	}
+
+	if err := Rdb.SRem(ctx, callParticipantsKey(callID), userID).Err(); err != nil {
+		return err
+	}
+	log.Printf("[INFO] User %d left call %s", userID, callID)
+
+	remaining, err := Rdb.SCard(ctx, callParticipantsKey(callID)).Result()
+	if err != nil {
+		return err
+	}
+	if call.IsDirect() || remaining == 0 {
+		return EndCall(db, callID, "hangup")
+	}
+
+	_, err = publishCallUpdate(callID)
+	return err
+}
+
+func EndCall(db *gorm.DB, callID string, reason string) error {
+	now := time.Now().UTC()
+
+	// whoever sets ended_at first announces the end; everybody else racing
+	// to end the same call (on any node) backs off
+	first, err := Rdb.HSetNX(ctx, callKey(callID), "ended_at", now.Format(time.RFC3339)).Result()
+	if err != nil {
+		return err
+	}
+	if !first {
+		return nil
+	}
+
+	_, err = Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, callKey(callID), "state", models.CallEnded, "end_reason", reason)
+		pipe.HDel(ctx, callKey(callID), "rings_until")
+		pipe.ZRem(ctx, ringingCallsKey, callID)
+		pipe.Expire(ctx, callKey(callID), endedCallTTL)
+		pipe.Del(ctx, callParticipantsKey(callID))
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to end call %s: %v", callID, err)
+		return err
+	}
+
+	call, err := GetCall(callID)
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] Call %s ended (%s)", callID, reason)
+
+	content := "Call ended"
+	switch {
+	case reason == "missed":
+		content = "Missed call"
+	case reason == "declined":
+		content = "Call declined"
+	case call.AnsweredAt != nil:
+		content = fmt.Sprintf("Call ended after %s", now.Sub(*call.AnsweredAt).Round(time.Second))
+	}
+	postCallMessage(db, call, call.InitiatorID, content)
+
+	if err := PublishEvent(models.NewCallEvent(models.EventCallEnded, call)); err != nil {
+		log.Printf("[WARN] Failed to publish call.ended for call %s: %v", callID, err)
+	}
+	return nil
+}
+
+// RelaySignal forwards an SDP offer/answer or ICE candidate to a single
+// participant. Only participants may signal, and only to channel members
+// that are (or are being invited into) the call.
+func RelaySignal(db *gorm.DB, callID string, channelID uint64, from *models.User, toUserID uint64, signal string, payload any) error {
+	call, err := getChannelCall(db, callID, channelID)
+	if err != nil {
+		return err
+	}
+	if !call.HasParticipant(from.ID) {
+		return ErrCallForbidden
+	}
+	if toUserID == 0 || toUserID == from.ID {
+		return fmt.Errorf("%w: a recipient is required", ErrInvalidCall)
+	}
+	if call.IsDirect() && toUserID != call.CalleeID && toUserID != call.InitiatorID {
+		return ErrCallForbidden
+	}
+
+	member, err := IsUserInChannel(db, toUserID, channelID)
+	if err != nil {
+		return err
+	}
+	if !member {
+		return ErrCallForbidden
+	}
+
+	return PublishEvent(models.NewCallSignalEvent(call, from.ID, toUserID, signal, payload))
+}
+
+func publishCallUpdate(callID string) (*models.Call, error) {
+	call, err := GetCall(callID)
+	if err != nil {
+		return nil, err
+	}
+	if err := PublishEvent(models.NewCallEvent(models.EventCallUpdated, call)); err != nil {
+		log.Printf("[WARN] Failed to publish call.updated for call %s: %v", callID, err)
+	}
+	return call, nil
+}
+
+func postCallMessage(db *gorm.DB, call *models.Call, userID uint64, content string) {
+	msg := &models.Message{
+		ChannelID: call.ChannelID,
+		UserID:    userID,
+		Content:   content,
+		System:    true,
+	}
+	if err := CreateMessage(db, msg); err != nil {
+		log.Printf("[WARN] Failed to post system message for call %s: %v", call.ID, err)
+	}
+}
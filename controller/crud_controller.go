@@ -1,8 +1,10 @@
 package controller
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/rtk-rnjn/ping/models"
 	"gorm.io/gorm"
@@ -42,6 +44,66 @@ func GetUserByID(db *gorm.DB, id uint64) (*models.User, error) {
 	return &user, nil
 }
 
+func SetUserDisabled(db *gorm.DB, id uint64, disabled bool) (*models.User, error) {
+	var user models.User
+	if err := db.First(&user, id).Error; err != nil {
+		log.Printf("[ERROR] Failed to find user ID=%d: %v", id, err)
+		return nil, err
+	}
+
+	var disabledAt *time.Time
+	if disabled {
+		now := time.Now()
+		disabledAt = &now
+	}
+	if err := db.Model(&user).Update("disabled_at", disabledAt).Error; err != nil {
+		log.Printf("[ERROR] Failed to update disabled state for user ID=%d: %v", id, err)
+		return nil, err
+	}
+	user.DisabledAt = disabledAt
+	log.Printf("[INFO] User ID=%d disabled=%t", id, disabled)
+
+	// a stale cached copy would keep a disabled user working, so drop it;
+	// either way the revocations below must still happen
+	if err := SetCacheUser(user); err != nil {
+		log.Printf("[WARN] Failed to cache user ID=%d, dropping the cached copy: %v", id, err)
+		DeleteCacheUser(id)
+	}
+	if disabled {
+		if err := RevokeUserSessions(db, id, ""); err != nil {
+			log.Printf("[WARN] Failed to revoke sessions for user ID=%d: %v", id, err)
+		}
+		if err := RevokeUserAccess(id, RevokedAccount); err != nil {
+			log.Printf("[WARN] Failed to revoke live access for user ID=%d: %v", id, err)
+		}
+	}
+	return &user, nil
+}
+
+// UpdatePasswordHash swaps in a new hash for the same password. It only
+// applies if the stored hash is still the one the caller checked, so it can't
+// undo a password change made in the meantime.
+func UpdatePasswordHash(db *gorm.DB, user *models.User, hash string) error {
+	res := db.Model(&models.User{}).
+		Where("id = ? AND password_hash = ?", user.ID, user.PasswordHash).
+		Update("password_hash", hash)
+	if res.Error != nil {
+		log.Printf("[ERROR] Failed to update password hash for user ID=%d: %v", user.ID, res.Error)
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		log.Printf("[WARN] Password hash for user ID=%d changed underneath, not updating", user.ID)
+		return nil
+	}
+	user.PasswordHash = hash
+	log.Printf("[INFO] Upgraded password hash for user ID=%d", user.ID)
+
+	if err := SetCacheUser(*user); err != nil {
+		log.Printf("[WARN] Failed to cache user ID=%d: %v", user.ID, err)
+	}
+	return nil
+}
+
 func CreateChannel(db *gorm.DB, ch *models.Channel) error {
 	if err := db.Create(ch).Error; err != nil {
 		log.Printf("[ERROR] Failed to create channel: %v", err)
@@ -76,9 +138,31 @@ func GetChannelByID(db *gorm.DB, id uint64) (*models.Channel, error) {
 	return &ch, nil
 }
 
+// DeleteChannel deletes the channel's messages and memberships along with it,
+// since SQLite only enforces the cascades when asked to. Members still
+// connected are cut off.
 func DeleteChannel(db *gorm.DB, id uint64) error {
-	if err := db.Delete(&models.Channel{}, id).Error; err != nil {
-		log.Printf("[ERROR] Failed to delete channel ID=%d: %v", id, err)
+	var members []uint64
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.UserChannel{}).Where("channel_id = ?", id).Pluck("user_id", &members).Error; err != nil {
+			return err
+		}
+		res := tx.Delete(&models.Channel{}, id)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrChannelNotFound
+		}
+		if err := tx.Where("channel_id = ?", id).Delete(&models.Message{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("channel_id = ?", id).Delete(&models.UserChannel{}).Error
+	})
+	if err != nil {
+		if !errors.Is(err, ErrChannelNotFound) {
+			log.Printf("[ERROR] Failed to delete channel ID=%d: %v", id, err)
+		}
 		return err
 	}
 	log.Printf("[INFO] Deleted channel from DB: ID=%d", id)
@@ -87,10 +171,46 @@ func DeleteChannel(db *gorm.DB, id uint64) error {
 		log.Printf("[WARN] Failed to delete channel cache ID=%d: %v", id, err)
 		return err
 	}
+	Rdb.Del(ctx, channelMessagesKey(id))
 	log.Printf("[INFO] Deleted channel cache: ID=%d", id)
+
+	if err := PublishEvent(models.NewChannelDeletedEvent(id)); err != nil {
+		log.Printf("[WARN] Failed to publish channel.deleted event for ID=%d: %v", id, err)
+	}
+	for _, userID := range members {
+		if err := RevokeChannelAccess(userID, id); err != nil {
+			log.Printf("[WARN] Failed to revoke live access for user %d in deleted channel %d: %v", userID, id, err)
+		}
+	}
 	return nil
 }
 
+func UpdateChannel(db *gorm.DB, id uint64, updates map[string]any) (*models.Channel, error) {
+	var ch models.Channel
+	if err := db.First(&ch, id).Error; err != nil {
+		log.Printf("[ERROR] Failed to get channel ID=%d: %v", id, err)
+		return nil, err
+	}
+
+	if err := db.Model(&ch).Updates(updates).Error; err != nil {
+		log.Printf("[ERROR] Failed to update channel ID=%d: %v", id, err)
+		return nil, err
+	}
+	if err := db.First(&ch, id).Error; err != nil {
+		log.Printf("[ERROR] Failed to reload channel ID=%d: %v", id, err)
+		return nil, err
+	}
+	log.Printf("[INFO] Updated channel in DB: ID=%d", id)
+
+	if err := SetCacheChannel(ch); err != nil {
+		log.Printf("[WARN] Failed to cache channel ID=%d: %v", id, err)
+	}
+	if err := PublishEvent(models.NewChannelUpdatedEvent(&ch)); err != nil {
+		log.Printf("[WARN] Failed to publish channel.updated event for ID=%d: %v", id, err)
+	}
+	return &ch, nil
+}
+
 func CreateMessage(db *gorm.DB, msg *models.Message) error {
 	if err := db.Create(msg).Error; err != nil {
 		log.Printf("[ERROR] Failed to create message: %v", err)
@@ -102,6 +222,22 @@ func CreateMessage(db *gorm.DB, msg *models.Message) error {
 		log.Printf("[WARN] Failed to cache message ID=%d: %v", msg.ID, err)
 		return err
 	}
+	if err := PushMessageToChannel(msg.ChannelID, msg); err != nil {
+		log.Printf("[ERROR] Failed to push message to queue: %v", err)
+		return err
+	}
+
+	// the event is self-contained so subscribers never have to look the
+	// message (or its author) up again
+	if author, err := GetUserByID(db, msg.UserID); err == nil {
+		msg.User = *author
+	} else {
+		log.Printf("[WARN] Publishing message ID=%d without author info: %v", msg.ID, err)
+	}
+	if err := PublishEvent(models.NewMessageEvent(msg)); err != nil {
+		log.Printf("[ERROR] Failed to publish message: %v", err)
+		return err
+	}
 	return nil
 }
 
@@ -139,18 +275,41 @@ func AddUserToChannel(db *gorm.DB, uc *models.UserChannel) error {
 		return err
 	}
 	log.Printf("[INFO] User %d joined channel %d", uc.UserID, uc.ChannelID)
+
+	publishMemberEvent(db, models.EventMemberJoined, uc.UserID, uc.ChannelID)
 	return nil
 }
 
 func RemoveUserFromChannel(db *gorm.DB, userID uint64, channelID uint64) error {
-	if err := db.Delete(&models.UserChannel{}, "user_id = ? AND channel_id = ?", userID, channelID).Error; err != nil {
-		log.Printf("[ERROR] Failed to remove user %d from channel %d: %v", userID, channelID, err)
-		return err
+	result := db.Delete(&models.UserChannel{}, "user_id = ? AND channel_id = ?", userID, channelID)
+	if result.Error != nil {
+		log.Printf("[ERROR] Failed to remove user %d from channel %d: %v", userID, channelID, result.Error)
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		log.Printf("[INFO] User %d was not a member of channel %d", userID, channelID)
+		return nil
 	}
 	log.Printf("[INFO] User %d left channel %d", userID, channelID)
+
+	if err := RevokeChannelAccess(userID, channelID); err != nil {
+		log.Printf("[WARN] Failed to revoke live access for user %d in channel %d: %v", userID, channelID, err)
+	}
+	publishMemberEvent(db, models.EventMemberLeft, userID, channelID)
 	return nil
 }
 
+func publishMemberEvent(db *gorm.DB, eventType string, userID uint64, channelID uint64) {
+	user, err := GetUserByID(db, userID)
+	if err != nil {
+		log.Printf("[WARN] Skipping %s event for user %d in channel %d: %v", eventType, userID, channelID, err)
+		return
+	}
+	if err := PublishEvent(models.NewMemberEvent(eventType, channelID, user)); err != nil {
+		log.Printf("[WARN] Failed to publish %s event for user %d in channel %d: %v", eventType, userID, channelID, err)
+	}
+}
+
 func GetUserChannels(db *gorm.DB, userID uint64) ([]models.UserChannel, error) {
 	var list []models.UserChannel
 	err := db.Where("user_id = ?", userID).Preload("Channel").Find(&list).Error
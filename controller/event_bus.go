@@ -0,0 +1,306 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rtk-rnjn/ping/models"
+)
+
+// --- Event Bus ---
+
+// EventBus carries channel events between nodes. Pub/Sub is fire-and-forget
+// and fine for small deployments; Redis Streams keeps a capped, replayable
+// log per channel so subscribers survive brief outages without losing events.
+type EventBus interface {
+	Publish(event *models.Event) error
+	Open(channelID uint64) (Feed, error)
+	Replay(channelID uint64, afterSeq uint64, limit int) ([]*models.Event, error)
+	Rewrite(channelID uint64, fn func(*models.Event) *models.Event) error
+}
+
+// Feed is a node-local stream of decoded events for a single channel. Events
+// is never closed; the hub stops reading from it once the feed is closed.
+type Feed interface {
+	Events() <-chan *models.Event
+	Close() error
+}
+
+var bus EventBus = &pubSubBus{}
+
+func InitEventBus() {
+	switch kind := strings.ToLower(os.Getenv("EVENT_BUS")); kind {
+	case "", "pubsub":
+		bus = &pubSubBus{}
+		log.Println("[INFO] Using Redis Pub/Sub event bus")
+	case "streams":
+		bus = newStreamBus()
+		log.Println("[INFO] Using Redis Streams event bus")
+	default:
+		log.Fatalf("[FATAL] Unknown EVENT_BUS %q (expected 'pubsub' or 'streams')", kind)
+	}
+
+	go hub.listenControl()
+}
+
+// PublishEvent assigns the event its seq and publishes it. Both buses do
+// that in one Redis script, so events are stored and delivered in seq order
+// even when several nodes publish to the same channel at once; otherwise a
+// viewer could see N+1 before N and skip N for good when resuming.
+func PublishEvent(event *models.Event) error {
+	return bus.Publish(event)
+}
+
+func ReplayEvents(channelID uint64, afterSeq uint64, limit int) ([]*models.Event, error) {
+	return bus.Replay(channelID, afterSeq, limit)
+}
+
+// seqPlaceholder stands in for the seq in an encoded event until a publish
+// script has allocated the real one.
+const seqPlaceholder = math.MaxUint64
+
+// splitPayload encodes the event and cuts the JSON where the seq goes, so
+// the publish script can put the seq it allocates in between.
+func splitPayload(event *models.Event) (string, string, error) {
+	event.Seq = seqPlaceholder
+	payload, err := json.Marshal(event)
+	event.Seq = 0
+	if err != nil {
+		log.Printf("[ERROR] Failed to encode %s event for channel %d: %v", event.Type, event.ChannelID, err)
+		return "", "", err
+	}
+	head, tail, _ := strings.Cut(string(payload), `"seq":`+strconv.FormatUint(seqPlaceholder, 10))
+	return head + `"seq":`, tail, nil
+}
+
+// RewriteEvents passes every event kept for replay in the channel through
+// fn, which returns the event as it should be kept from now on, or nil to
+// remove it. That's how personal data is scrubbed from the replay log.
+func RewriteEvents(channelID uint64, fn func(*models.Event) *models.Event) error {
+	return bus.Rewrite(channelID, fn)
+}
+
+// rewritePayload applies fn to a stored event. It returns the payload to
+// store instead, "" to remove the event, and false when nothing changed.
+func rewritePayload(payload string, channelID uint64, fn func(*models.Event) *models.Event) (string, bool) {
+	event, err := decodeEvent(payload, channelID)
+	if err != nil {
+		return "", false
+	}
+	event = fn(event)
+	if event == nil {
+		return "", true
+	}
+	rewritten, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[ERROR] Failed to encode rewritten %s event for channel %d: %v", event.Type, channelID, err)
+		return "", false
+	}
+	return string(rewritten), string(rewritten) != payload
+}
+
+func decodeEvent(payload string, channelID uint64) (*models.Event, error) {
+	var event models.Event
+	decoder := json.NewDecoder(strings.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&event); err != nil {
+		log.Printf("[ERROR] Invalid event format received on channel %d: %v", channelID, err)
+		return nil, err
+	}
+	event.Data = normalizeNumbers(event.Data)
+
+	if event.Version != models.EventVersion {
+		log.Printf("[WARN] Ignoring event with unsupported version %d on channel %d", event.Version, channelID)
+		return nil, fmt.Errorf("unsupported event version %d", event.Version)
+	}
+	if event.ChannelID != channelID {
+		log.Printf("[WARN] Event seq=%d does not belong to channel %d", event.Seq, channelID)
+		return nil, fmt.Errorf("event seq=%d does not belong to channel %d", event.Seq, channelID)
+	}
+	return &event, nil
+}
+
+// Decoded JSON numbers are float64 by default, which binary encodings on the
+// wire would faithfully reproduce; IDs and counts are turned back into integers.
+func normalizeNumbers(v any) any {
+	switch value := v.(type) {
+	case map[string]any:
+		for k, item := range value {
+			value[k] = normalizeNumbers(item)
+		}
+	case []any:
+		for i, item := range value {
+			value[i] = normalizeNumbers(item)
+		}
+	case json.Number:
+		if n, err := value.Int64(); err == nil {
+			return n
+		}
+		if f, err := value.Float64(); err == nil {
+			return f
+		}
+	}
+	return v
+}
+
+// --- Pub/Sub Bus ---
+
+const eventBacklogSize = 256
+
+// Pub/Sub keeps no history, so the most recent events of every channel are
+// also kept in a capped list that viewers replay from when they resume.
+type pubSubBus struct{}
+
+// KEYS: seq counter, backlog. ARGV: payload head and tail, backlog size, topic.
+var pubSubPublishScript = redis.NewScript(`
+local seq = redis.call('INCR', KEYS[1])
+local payload = ARGV[1] .. string.format('%d', seq) .. ARGV[2]
+redis.call('RPUSH', KEYS[2], payload)
+redis.call('LTRIM', KEYS[2], -tonumber(ARGV[3]), -1)
+redis.call('PUBLISH', ARGV[4], payload)
+return seq
+`)
+
+type pubSubFeed struct {
+	pubSub *redis.PubSub
+	events chan *models.Event
+	done   chan struct{}
+}
+
+func (b *pubSubBus) Publish(event *models.Event) error {
+	if event.IsEphemeral() {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("[ERROR] Failed to encode %s event for channel %d: %v", event.Type, event.ChannelID, err)
+			return err
+		}
+		if err := Rdb.Publish(ctx, channelEventsTopic(event.ChannelID), payload).Err(); err != nil {
+			log.Printf("[ERROR] Failed to publish %s event to pubsub: %v", event.Type, err)
+			return err
+		}
+		return nil
+	}
+
+	head, tail, err := splitPayload(event)
+	if err != nil {
+		return err
+	}
+	keys := []string{channelSeqKey(event.ChannelID), channelBacklogKey(event.ChannelID)}
+	seq, err := pubSubPublishScript.Run(ctx, Rdb, keys, head, tail, eventBacklogSize, channelEventsTopic(event.ChannelID)).Int64()
+	if err != nil {
+		log.Printf("[ERROR] Failed to publish %s event on channel %d to pubsub: %v", event.Type, event.ChannelID, err)
+		return err
+	}
+	event.Seq = uint64(seq)
+	return nil
+}
+
+// KEYS: backlog. ARGV: pairs of a stored payload and its replacement, where
+// an empty one removes it. Matching by payload rather than by index keeps
+// this right while new events push old ones out.
+var pubSubRewriteScript = redis.NewScript(`
+local changes = {}
+for i = 1, #ARGV, 2 do changes[ARGV[i]] = ARGV[i + 1] end
+for i, item in ipairs(redis.call('LRANGE', KEYS[1], 0, -1)) do
+  local replacement = changes[item]
+  if replacement then redis.call('LSET', KEYS[1], i - 1, replacement) end
+end
+return redis.call('LREM', KEYS[1], 0, '')
+`)
+
+func (b *pubSubBus) Rewrite(channelID uint64, fn func(*models.Event) *models.Event) error {
+	key := channelBacklogKey(channelID)
+	payloads, err := Rdb.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		log.Printf("[ERROR] Failed to read backlog %s for rewriting: %v", key, err)
+		return err
+	}
+
+	var changes []any
+	for _, payload := range payloads {
+		if rewritten, changed := rewritePayload(payload, channelID, fn); changed {
+			changes = append(changes, payload, rewritten)
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	if err := pubSubRewriteScript.Run(ctx, Rdb, []string{key}, changes...).Err(); err != nil {
+		log.Printf("[ERROR] Failed to rewrite backlog %s: %v", key, err)
+		return err
+	}
+	log.Printf("[INFO] Rewrote %d events in %s", len(changes)/2, key)
+	return nil
+}
+
+func (b *pubSubBus) Open(channelID uint64) (Feed, error) {
+	pubSub := Rdb.Subscribe(ctx, channelEventsTopic(channelID))
+
+	// wait for the subscription to be confirmed so nothing published after
+	// this point (e.g. while a viewer replays missed events) can be lost
+	if _, err := pubSub.Receive(ctx); err != nil {
+		pubSub.Close()
+		return nil, err
+	}
+
+	feed := &pubSubFeed{
+		pubSub: pubSub,
+		events: make(chan *models.Event, subscriberBufferSize),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		for msg := range pubSub.Channel() {
+			event, err := decodeEvent(msg.Payload, channelID)
+			if err != nil {
+				continue
+			}
+			select {
+			case feed.events <- event:
+			case <-feed.done:
+				return
+			}
+		}
+	}()
+	return feed, nil
+}
+
+func (b *pubSubBus) Replay(channelID uint64, afterSeq uint64, limit int) ([]*models.Event, error) {
+	key := channelBacklogKey(channelID)
+	payloads, err := Rdb.LRange(ctx, key, 0, -1).Result()
+	if err != nil {
+		log.Printf("[ERROR] Failed to read backlog %s for replay: %v", key, err)
+		return nil, err
+	}
+
+	events := []*models.Event{}
+	for _, payload := range payloads {
+		event, err := decodeEvent(payload, channelID)
+		if err != nil {
+			continue
+		}
+		if event.Seq > afterSeq {
+			events = append(events, event)
+		}
+	}
+
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	log.Printf("[INFO] Replaying %d events after seq=%d from %s", len(events), afterSeq, key)
+	return events, nil
+}
+
+func (f *pubSubFeed) Events() <-chan *models.Event {
+	return f.events
+}
+
+func (f *pubSubFeed) Close() error {
+	close(f.done)
+	return f.pubSub.Close()
+}
@@ -0,0 +1,362 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rtk-rnjn/ping/models"
+)
+
+const (
+	defaultStreamMaxLen = 1000
+	streamReadCount     = 128
+	streamBlock         = 5 * time.Second
+	streamRetryDelay    = time.Second
+)
+
+// --- Redis Streams Bus ---
+
+// streamBus appends every event to a capped stream per channel. Each node
+// reads the streams of its active channels through its own consumer group,
+// so Redis remembers how far the node got and a dropped connection resumes
+// exactly where it left off instead of losing whatever was published meanwhile.
+//
+// All active channels are read by a single XREADGROUP call; whenever the set
+// of channels changes the blocking read is interrupted and reissued.
+type streamBus struct {
+	group    string
+	consumer string
+	maxLen   int64
+
+	mu      sync.Mutex
+	feeds   map[uint64]*streamFeed
+	cancel  context.CancelFunc
+	wake    chan struct{}
+	running bool
+}
+
+type streamFeed struct {
+	bus       *streamBus
+	channelID uint64
+	events    chan *models.Event
+	done      chan struct{}
+	once      sync.Once
+}
+
+// KEYS: seq counter, stream. ARGV: payload head and tail, max length.
+var streamPublishScript = redis.NewScript(`
+local seq = redis.call('INCR', KEYS[1])
+redis.call('XADD', KEYS[2], 'MAXLEN', '~', ARGV[3], '*', 'event', ARGV[1] .. string.format('%d', seq) .. ARGV[2])
+return seq
+`)
+
+// Stream entries can't be changed in place, so the stream is copied with the
+// changes made, keeping every entry ID and each group's position, and put in
+// place of the original. Removed events leave an entry without a payload
+// behind, so the last ID doesn't go back.
+//
+// KEYS: stream, scratch key. ARGV: pairs of an entry ID and its new payload.
+var streamRewriteScript = redis.NewScript(`
+local changes = {}
+for i = 1, #ARGV, 2 do changes[ARGV[i]] = ARGV[i + 1] end
+local entries = redis.call('XRANGE', KEYS[1], '-', '+')
+if #entries == 0 then return 0 end
+redis.call('DEL', KEYS[2])
+for _, entry in ipairs(entries) do
+  local replacement = changes[entry[1]]
+  if replacement == nil then
+    redis.call('XADD', KEYS[2], entry[1], unpack(entry[2]))
+  else
+    redis.call('XADD', KEYS[2], entry[1], 'event', replacement)
+  end
+end
+for _, group in ipairs(redis.call('XINFO', 'GROUPS', KEYS[1])) do
+  local info = {}
+  for i = 1, #group, 2 do info[group[i]] = group[i + 1] end
+  redis.call('XGROUP', 'CREATE', KEYS[2], info['name'], info['last-delivered-id'])
+end
+redis.call('RENAME', KEYS[2], KEYS[1])
+return #entries
+`)
+
+func newStreamBus() *streamBus {
+	maxLen := int64(defaultStreamMaxLen)
+	if value := os.Getenv("EVENT_STREAM_MAXLEN"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			log.Fatalf("[FATAL] Invalid EVENT_STREAM_MAXLEN %q", value)
+		}
+		maxLen = n
+	}
+
+	node := os.Getenv("NODE_ID")
+	if node == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatalf("[FATAL] NODE_ID is not set and hostname is unavailable: %v", err)
+		}
+		node = hostname
+	}
+	log.Printf("[INFO] Streams: consuming as node '%s' (maxlen=%d)", node, maxLen)
+
+	return &streamBus{
+		group:    "ping:" + node,
+		consumer: node,
+		maxLen:   maxLen,
+		feeds:    make(map[uint64]*streamFeed),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+func (b *streamBus) Publish(event *models.Event) error {
+	if event.IsEphemeral() {
+		payload, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("[ERROR] Failed to encode %s event for channel %d: %v", event.Type, event.ChannelID, err)
+			return err
+		}
+		err = Rdb.XAdd(ctx, &redis.XAddArgs{
+			Stream: channelEventStreamKey(event.ChannelID),
+			MaxLen: b.maxLen,
+			Approx: true,
+			Values: map[string]any{"event": payload},
+		}).Err()
+		if err != nil {
+			log.Printf("[ERROR] Failed to append %s event to stream: %v", event.Type, err)
+			return err
+		}
+		return nil
+	}
+
+	head, tail, err := splitPayload(event)
+	if err != nil {
+		return err
+	}
+	keys := []string{channelSeqKey(event.ChannelID), channelEventStreamKey(event.ChannelID)}
+	seq, err := streamPublishScript.Run(ctx, Rdb, keys, head, tail, b.maxLen).Int64()
+	if err != nil {
+		log.Printf("[ERROR] Failed to append %s event on channel %d to stream: %v", event.Type, event.ChannelID, err)
+		return err
+	}
+	event.Seq = uint64(seq)
+	return nil
+}
+
+func (b *streamBus) Open(channelID uint64) (Feed, error) {
+	// a node that starts watching a channel again begins at the tail of the
+	// stream; anything older is served to viewers through Replay
+	key := channelEventStreamKey(channelID)
+	if err := b.ensureGroup(key, true); err != nil {
+		log.Printf("[ERROR] Streams: failed to prepare group for %s: %v", key, err)
+		return nil, err
+	}
+
+	feed := &streamFeed{
+		bus:       b,
+		channelID: channelID,
+		events:    make(chan *models.Event, subscriberBufferSize),
+		done:      make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	b.feeds[channelID] = feed
+	if !b.running {
+		b.running = true
+		go b.run()
+	}
+	b.mu.Unlock()
+
+	b.interrupt()
+	return feed, nil
+}
+
+func (b *streamBus) Replay(channelID uint64, afterSeq uint64, limit int) ([]*models.Event, error) {
+	key := channelEventStreamKey(channelID)
+	entries, err := Rdb.XRevRangeN(ctx, key, "+", "-", b.maxLen).Result()
+	if err != nil {
+		log.Printf("[ERROR] Failed to read stream %s for replay: %v", key, err)
+		return nil, err
+	}
+
+	events := []*models.Event{}
+	for _, entry := range entries {
+		payload, _ := entry.Values["event"].(string)
+		if payload == "" {
+			continue
+		}
+		event, err := decodeEvent(payload, channelID)
+		if err != nil {
+			continue
+		}
+		if !event.IsEphemeral() && event.Seq > afterSeq {
+			events = append(events, event)
+		}
+	}
+	slices.Reverse(events)
+
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	log.Printf("[INFO] Replaying %d events after seq=%d from %s", len(events), afterSeq, key)
+	return events, nil
+}
+
+func (b *streamBus) Rewrite(channelID uint64, fn func(*models.Event) *models.Event) error {
+	key := channelEventStreamKey(channelID)
+	entries, err := Rdb.XRange(ctx, key, "-", "+").Result()
+	if err != nil {
+		log.Printf("[ERROR] Failed to read stream %s for rewriting: %v", key, err)
+		return err
+	}
+
+	var changes []any
+	for _, entry := range entries {
+		payload, _ := entry.Values["event"].(string)
+		if payload == "" {
+			continue
+		}
+		if rewritten, changed := rewritePayload(payload, channelID, fn); changed {
+			changes = append(changes, entry.ID, rewritten)
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	if err := streamRewriteScript.Run(ctx, Rdb, []string{key, key + ":rewrite"}, changes...).Err(); err != nil {
+		log.Printf("[ERROR] Failed to rewrite stream %s: %v", key, err)
+		return err
+	}
+	log.Printf("[INFO] Rewrote %d events in %s", len(changes)/2, key)
+	return nil
+}
+
+func (b *streamBus) ensureGroup(key string, reset bool) error {
+	err := Rdb.XGroupCreateMkStream(ctx, key, b.group, "$").Err()
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		if !reset {
+			return nil
+		}
+		err = Rdb.XGroupSetID(ctx, key, b.group, "$").Err()
+	}
+	return err
+}
+
+func (b *streamBus) interrupt() {
+	b.mu.Lock()
+	if b.cancel != nil {
+		b.cancel()
+	}
+	b.mu.Unlock()
+
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (b *streamBus) run() {
+	for {
+		b.mu.Lock()
+		feeds := make(map[string]*streamFeed, len(b.feeds))
+		streams := make([]string, 0, 2*len(b.feeds))
+		for channelID, feed := range b.feeds {
+			key := channelEventStreamKey(channelID)
+			feeds[key] = feed
+			streams = append(streams, key)
+		}
+		readCtx, cancel := context.WithCancel(ctx)
+		b.cancel = cancel
+		b.mu.Unlock()
+
+		if len(feeds) == 0 {
+			cancel()
+			<-b.wake
+			continue
+		}
+
+		for range feeds {
+			streams = append(streams, ">")
+		}
+
+		res, err := Rdb.XReadGroup(readCtx, &redis.XReadGroupArgs{
+			Group:    b.group,
+			Consumer: b.consumer,
+			Streams:  streams,
+			Count:    streamReadCount,
+			Block:    streamBlock,
+		}).Result()
+		interrupted := readCtx.Err() != nil
+		cancel()
+
+		switch {
+		case err == nil:
+		case errors.Is(err, redis.Nil), interrupted:
+			continue
+		case strings.HasPrefix(err.Error(), "NOGROUP"):
+			log.Printf("[WARN] Streams: consumer group missing, recreating: %v", err)
+			for key := range feeds {
+				if err := b.ensureGroup(key, false); err != nil {
+					log.Printf("[ERROR] Streams: failed to recreate group for %s: %v", key, err)
+				}
+			}
+			continue
+		default:
+			log.Printf("[ERROR] Streams: read failed, retrying in %s: %v", streamRetryDelay, err)
+			time.Sleep(streamRetryDelay)
+			continue
+		}
+
+		for _, stream := range res {
+			feed := feeds[stream.Stream]
+			ids := make([]string, 0, len(stream.Messages))
+			for _, entry := range stream.Messages {
+				ids = append(ids, entry.ID)
+
+				payload, _ := entry.Values["event"].(string)
+				if payload == "" {
+					continue
+				}
+				event, err := decodeEvent(payload, feed.channelID)
+				if err != nil {
+					continue
+				}
+				select {
+				case feed.events <- event:
+				case <-feed.done:
+				}
+			}
+
+			if err := Rdb.XAck(ctx, stream.Stream, b.group, ids...).Err(); err != nil {
+				log.Printf("[WARN] Streams: failed to ack %d entries on %s: %v", len(ids), stream.Stream, err)
+			}
+		}
+	}
+}
+
+func (f *streamFeed) Events() <-chan *models.Event {
+	return f.events
+}
+
+func (f *streamFeed) Close() error {
+	f.once.Do(func() {
+		close(f.done)
+
+		f.bus.mu.Lock()
+		if f.bus.feeds[f.channelID] == f {
+			delete(f.bus.feeds, f.channelID)
+		}
+		f.bus.mu.Unlock()
+
+		f.bus.interrupt()
+	})
+	return nil
+}
@@ -0,0 +1,367 @@
+package controller
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/rtk-rnjn/ping/models"
+)
+
+const subscriberBufferSize = 64
+
+// --- Channel Fan-out Hub ---
+
+// Hub keeps a single event bus feed per channel that has at least one local
+// viewer and fans every event it receives out to those viewers.
+//
+// Feeds are opened and closed without holding mu: that takes a round trip
+// to Redis, and fan-out on every other channel would wait for it.
+type Hub struct {
+	mu       sync.Mutex
+	channels map[uint64]*channelHub
+}
+
+type channelHub struct {
+	feed        Feed
+	ready       chan struct{} // closed once feed is open
+	done        chan struct{}
+	subscribers map[*Subscription]struct{}
+}
+
+type Subscription struct {
+	ChannelID uint64
+	UserID    uint64
+
+	hub     *Hub
+	blocked map[uint64]struct{}
+	events  chan *models.Event
+	reason  string
+	once    sync.Once
+}
+
+var hub = &Hub{channels: make(map[uint64]*channelHub)}
+
+// SubscribeChannel starts a live feed of the channel for the user; blocked
+// lists the users whose messages they don't want to see.
+func SubscribeChannel(channelID uint64, userID uint64, blocked []uint64) (*Subscription, error) {
+	return hub.Subscribe(channelID, userID, blocked)
+}
+
+func (h *Hub) Subscribe(channelID uint64, userID uint64, blocked []uint64) (*Subscription, error) {
+	sub := &Subscription{
+		ChannelID: channelID,
+		UserID:    userID,
+		hub:       h,
+		blocked:   blockSet(blocked),
+		events:    make(chan *models.Event, subscriberBufferSize),
+	}
+
+	h.mu.Lock()
+	for {
+		ch, ok := h.channels[channelID]
+		if !ok {
+			break
+		}
+		select {
+		case <-ch.ready:
+			ch.subscribers[sub] = struct{}{}
+			log.Printf("[DEBUG] Hub: viewer joined channelID=%d (viewers=%d)", channelID, len(ch.subscribers))
+			h.mu.Unlock()
+			return sub, nil
+		default:
+		}
+		// another viewer is opening the feed; if that fails the entry is
+		// gone when we look again and this viewer tries itself
+		h.mu.Unlock()
+		<-ch.ready
+		h.mu.Lock()
+	}
+
+	ch := &channelHub{
+		ready:       make(chan struct{}),
+		done:        make(chan struct{}),
+		subscribers: make(map[*Subscription]struct{}),
+	}
+	h.channels[channelID] = ch
+	h.mu.Unlock()
+
+	feed, err := bus.Open(channelID)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	defer close(ch.ready)
+
+	if err != nil {
+		delete(h.channels, channelID)
+		log.Printf("[ERROR] Hub: failed to subscribe to channelID=%d: %v", channelID, err)
+		return nil, err
+	}
+	ch.feed = feed
+	ch.subscribers[sub] = struct{}{}
+	go h.run(channelID, ch)
+
+	log.Printf("[INFO] Hub: subscribed to channelID=%d", channelID)
+	return sub, nil
+}
+
+// Viewers counts this node's live subscriptions and the channels they watch.
+func Viewers() (int, int) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	viewers := 0
+	for _, ch := range hub.channels {
+		viewers += len(ch.subscribers)
+	}
+	return viewers, len(hub.channels)
+}
+
+func (h *Hub) run(channelID uint64, ch *channelHub) {
+	for {
+		select {
+		case <-ch.done:
+			log.Printf("[DEBUG] Hub: stopped listening on channelID=%d", channelID)
+			return
+		case event := <-ch.feed.Events():
+			h.broadcast(ch, event)
+		}
+	}
+}
+
+func (h *Hub) broadcast(ch *channelHub, event *models.Event) {
+	var released []Feed
+	defer func() { closeFeeds(released) }()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range ch.subscribers {
+		visible := sub.visible(event)
+		if visible == nil {
+			continue
+		}
+		select {
+		case sub.events <- visible:
+		default:
+			// a viewer that cannot keep up is dropped rather than
+			// stalling everybody else on the channel
+			log.Printf("[WARN] Hub: dropping slow viewer on channelID=%d", event.ChannelID)
+			released = h.remove(sub, released)
+		}
+	}
+}
+
+// remove drops the viewer. When it was the channel's last one the channel's
+// feed is appended to released, for the caller to close once mu is unlocked.
+func (h *Hub) remove(sub *Subscription, released []Feed) []Feed {
+	ch, ok := h.channels[sub.ChannelID]
+	if !ok {
+		return released
+	}
+	if _, ok := ch.subscribers[sub]; !ok {
+		return released
+	}
+
+	delete(ch.subscribers, sub)
+	close(sub.events)
+
+	if len(ch.subscribers) > 0 {
+		log.Printf("[DEBUG] Hub: viewer left channelID=%d (viewers=%d)", sub.ChannelID, len(ch.subscribers))
+		return released
+	}
+
+	delete(h.channels, sub.ChannelID)
+	close(ch.done)
+	log.Printf("[INFO] Hub: released subscription for channelID=%d", sub.ChannelID)
+	return append(released, ch.feed)
+}
+
+func closeFeeds(feeds []Feed) {
+	for _, feed := range feeds {
+		if err := feed.Close(); err != nil {
+			log.Printf("[WARN] Hub: failed to close subscription: %v", err)
+		}
+	}
+}
+
+// --- Access Revocation ---
+
+const controlTopic = "ping:control"
+
+const (
+	RevokedMembership = "membership_revoked"
+	RevokedAccount    = "account_disabled"
+	RevokedSignedOut  = "signed_out"
+)
+
+// AccessRevocation is broadcast to every node so that viewers who lost
+// access are disconnected immediately rather than at their next handshake.
+// A zero ChannelID revokes the user's access to every channel.
+type AccessRevocation struct {
+	UserID    uint64 `json:"user_id"`
+	ChannelID uint64 `json:"channel_id,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+func RevokeChannelAccess(userID uint64, channelID uint64) error {
+	return publishRevocation(AccessRevocation{UserID: userID, ChannelID: channelID, Reason: RevokedMembership})
+}
+
+func RevokeUserAccess(userID uint64, reason string) error {
+	return publishRevocation(AccessRevocation{UserID: userID, Reason: reason})
+}
+
+func publishRevocation(revocation AccessRevocation) error {
+	payload, err := json.Marshal(revocation)
+	if err != nil {
+		return err
+	}
+	if err := Rdb.Publish(ctx, controlTopic, payload).Err(); err != nil {
+		log.Printf("[ERROR] Failed to publish revocation for user %d: %v", revocation.UserID, err)
+		return err
+	}
+	log.Printf("[INFO] Published %s revocation for user %d (channelID=%d)", revocation.Reason, revocation.UserID, revocation.ChannelID)
+	return nil
+}
+
+func (h *Hub) listenControl() {
+	pubSub := Rdb.Subscribe(ctx, controlTopic, blocksTopic)
+	for range 2 {
+		if _, err := pubSub.Receive(ctx); err != nil {
+			log.Fatalf("[FATAL] Failed to subscribe to control topic: %v", err)
+		}
+	}
+
+	for msg := range pubSub.Channel() {
+		if msg.Channel == blocksTopic {
+			var update BlockListUpdate
+			if err := json.Unmarshal([]byte(msg.Payload), &update); err != nil {
+				log.Printf("[ERROR] Invalid block list update: %v", err)
+				continue
+			}
+			h.setBlocked(update)
+			continue
+		}
+
+		var revocation AccessRevocation
+		if err := json.Unmarshal([]byte(msg.Payload), &revocation); err != nil {
+			log.Printf("[ERROR] Invalid control event: %v", err)
+			continue
+		}
+		h.revoke(revocation)
+	}
+}
+
+func (h *Hub) revoke(revocation AccessRevocation) {
+	var released []Feed
+	defer func() { closeFeeds(released) }()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for channelID, ch := range h.channels {
+		if revocation.ChannelID != 0 && channelID != revocation.ChannelID {
+			continue
+		}
+		for sub := range ch.subscribers {
+			if sub.UserID != revocation.UserID {
+				continue
+			}
+			log.Printf("[INFO] Hub: disconnecting user %d from channelID=%d (%s)", sub.UserID, channelID, revocation.Reason)
+			sub.reason = revocation.Reason
+			released = h.remove(sub, released)
+		}
+	}
+}
+
+// --- Block Lists ---
+
+const blocksTopic = "ping:blocks"
+
+// BlockListUpdate carries a user's whole block list, so applying it twice or
+// out of order with an older one can only be briefly wrong.
+type BlockListUpdate struct {
+	UserID  uint64   `json:"user_id"`
+	Blocked []uint64 `json:"blocked"`
+}
+
+func PublishBlockList(userID uint64, blocked []uint64) error {
+	payload, err := json.Marshal(BlockListUpdate{UserID: userID, Blocked: blocked})
+	if err != nil {
+		return err
+	}
+	if err := Rdb.Publish(ctx, blocksTopic, payload).Err(); err != nil {
+		log.Printf("[ERROR] Failed to publish block list of user %d: %v", userID, err)
+		return err
+	}
+	return nil
+}
+
+func blockSet(ids []uint64) map[uint64]struct{} {
+	set := make(map[uint64]struct{}, len(ids))
+	for _, id := range ids {
+		set[id] = struct{}{}
+	}
+	return set
+}
+
+func (h *Hub) setBlocked(update BlockListUpdate) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	blocked := blockSet(update.Blocked)
+	for _, ch := range h.channels {
+		for sub := range ch.subscribers {
+			if sub.UserID == update.UserID {
+				sub.blocked = blocked
+			}
+		}
+	}
+}
+
+// --- Subscription ---
+
+// visible returns the event as the viewer gets to see it, or nil when it
+// isn't for them. Messages from blocked users arrive collapsed; anything
+// else they send, like call signals, doesn't arrive at all.
+func (s *Subscription) visible(event *models.Event) *models.Event {
+	if event.ToUserID != 0 && event.ToUserID != s.UserID {
+		return nil
+	}
+	if _, blocked := s.blocked[event.FromUserID]; !blocked || event.FromUserID == 0 {
+		return event
+	}
+	if event.Type == models.EventMessageCreated {
+		return event.Collapsed()
+	}
+	return nil
+}
+
+// Visible applies the viewer's blocks to an event that didn't come through
+// the hub, such as a replayed one.
+func (s *Subscription) Visible(event *models.Event) *models.Event {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.visible(event)
+}
+
+// Events is closed once the subscription is closed or dropped by the hub.
+func (s *Subscription) Events() <-chan *models.Event {
+	return s.events
+}
+
+// Revoked returns why the viewer lost access once Events has been closed by
+// a revocation, and an empty string otherwise.
+func (s *Subscription) Revoked() string {
+	return s.reason
+}
+
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.hub.mu.Lock()
+		released := s.hub.remove(s, nil)
+		s.hub.mu.Unlock()
+		closeFeeds(released)
+	})
+}
@@ -0,0 +1,166 @@
+package controller
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrIdentityNotFound = errors.New("identity not found")
+	ErrIdentityLinked   = errors.New("this account is already linked to a user")
+	ErrStateNotFound    = errors.New("login state not found or expired")
+)
+
+// --- External Identities ---
+
+func GetExternalIdentity(db *gorm.DB, provider string, subject string) (*models.ExternalIdentity, error) {
+	var identity models.ExternalIdentity
+	err := db.Where("provider = ? AND subject = ?", provider, subject).First(&identity).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrIdentityNotFound
+		}
+		log.Printf("[ERROR] Failed to look up identity at %s: %v", provider, err)
+		return nil, err
+	}
+	return &identity, nil
+}
+
+func GetUserIdentities(db *gorm.DB, userID uint64) ([]models.ExternalIdentity, error) {
+	var identities []models.ExternalIdentity
+	if err := db.Where("user_id = ?", userID).Order("created_at").Find(&identities).Error; err != nil {
+		log.Printf("[ERROR] Failed to list identities of user ID=%d: %v", userID, err)
+		return nil, err
+	}
+	return identities, nil
+}
+
+func LinkExternalIdentity(db *gorm.DB, identity *models.ExternalIdentity) error {
+	if _, err := GetExternalIdentity(db, identity.Provider, identity.Subject); err == nil {
+		return ErrIdentityLinked
+	} else if !errors.Is(err, ErrIdentityNotFound) {
+		return err
+	}
+	if err := db.Create(identity).Error; err != nil {
+		log.Printf("[ERROR] Failed to link identity at %s to user ID=%d: %v", identity.Provider, identity.UserID, err)
+		return err
+	}
+	log.Printf("[INFO] Linked identity ID=%d at %s to user ID=%d", identity.ID, identity.Provider, identity.UserID)
+	return nil
+}
+
+// CreateUserWithIdentity provisions a user for someone who signed in through
+// an identity provider for the first time.
+func CreateUserWithIdentity(db *gorm.DB, user *models.User, identity *models.ExternalIdentity) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		identity.UserID = user.ID
+		return tx.Create(identity).Error
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to provision user '%s' from %s: %v", user.Username, identity.Provider, err)
+		return err
+	}
+	log.Printf("[INFO] Provisioned user ID=%d '%s' from %s", user.ID, user.Username, identity.Provider)
+
+	if err := SetCacheUser(*user); err != nil {
+		log.Printf("[WARN] Cache set failed for user ID=%d: %v", user.ID, err)
+	}
+	return nil
+}
+
+func TouchExternalIdentity(db *gorm.DB, identity *models.ExternalIdentity, email string) {
+	err := db.Model(identity).Updates(map[string]any{"last_login_at": time.Now(), "email": email}).Error
+	if err != nil {
+		log.Printf("[WARN] Failed to record login through identity ID=%d: %v", identity.ID, err)
+	}
+}
+
+func CountUserIdentities(db *gorm.DB, userID uint64) (int64, error) {
+	var count int64
+	err := db.Model(&models.ExternalIdentity{}).Where("user_id = ?", userID).Count(&count).Error
+	if err != nil {
+		log.Printf("[ERROR] Failed to count identities of user ID=%d: %v", userID, err)
+	}
+	return count, err
+}
+
+func DeleteExternalIdentity(db *gorm.DB, userID uint64, id uint64) error {
+	res := db.Where("id = ? AND user_id = ?", id, userID).Delete(&models.ExternalIdentity{})
+	if res.Error != nil {
+		log.Printf("[ERROR] Failed to unlink identity ID=%d: %v", id, res.Error)
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrIdentityNotFound
+	}
+	log.Printf("[INFO] User ID=%d unlinked identity ID=%d", userID, id)
+	return nil
+}
+
+// UsernameTaken ignores case, so nobody can register "Alice" next to "alice".
+func UsernameTaken(db *gorm.DB, username string) (bool, error) {
+	var count int64
+	err := db.Model(&models.User{}).Where("LOWER(username) = LOWER(?)", username).Count(&count).Error
+	if err != nil {
+		log.Printf("[ERROR] Failed to check whether username '%s' is taken: %v", username, err)
+	}
+	return count > 0, err
+}
+
+func SetUserDisplayName(db *gorm.DB, userID uint64, displayName string) error {
+	err := db.Model(&models.User{}).Where("id = ?", userID).Update("display_name", displayName).Error
+	if err != nil {
+		log.Printf("[ERROR] Failed to update display name of user ID=%d: %v", userID, err)
+		return err
+	}
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err == nil {
+		if err := SetCacheUser(user); err != nil {
+			log.Printf("[WARN] Failed to cache user ID=%d: %v", userID, err)
+		}
+	}
+	return nil
+}
+
+// --- One-Time Login State ---
+
+// StoreLoginState keeps what a redirect-based login needs to remember
+// between its steps. It can be taken exactly once.
+func StoreLoginState(key string, fields map[string]any, ttl time.Duration) error {
+	_, err := Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, fields)
+		pipe.Expire(ctx, key, ttl)
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to store login state: %v", err)
+	}
+	return err
+}
+
+func TakeLoginState(key string) (map[string]string, error) {
+	var get *redis.MapStringStringCmd
+	_, err := Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.HGetAll(ctx, key)
+		pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to read login state: %v", err)
+		return nil, err
+	}
+	fields := get.Val()
+	if len(fields) == 0 {
+		return nil, ErrStateNotFound
+	}
+	return fields, nil
+}
@@ -0,0 +1,91 @@
+package controller
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInviteInvalid  = errors.New("invalid or expired invite code")
+	ErrInviteNotFound = errors.New("invite not found")
+)
+
+// --- Invites ---
+
+func CreateInvite(db *gorm.DB, invite *models.Invite) error {
+	if err := db.Create(invite).Error; err != nil {
+		log.Printf("[ERROR] Failed to create invite: %v", err)
+		return err
+	}
+	log.Printf("[INFO] Created invite ID=%d for %d uses", invite.ID, invite.MaxUses)
+	return nil
+}
+
+func GetInvites(db *gorm.DB) ([]models.Invite, error) {
+	var invites []models.Invite
+	if err := db.Order("created_at DESC").Find(&invites).Error; err != nil {
+		log.Printf("[ERROR] Failed to list invites: %v", err)
+		return nil, err
+	}
+	return invites, nil
+}
+
+func DeleteInvite(db *gorm.DB, id uint64) error {
+	res := db.Delete(&models.Invite{}, id)
+	if res.Error != nil {
+		log.Printf("[ERROR] Failed to delete invite ID=%d: %v", id, res.Error)
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrInviteNotFound
+	}
+	log.Printf("[INFO] Deleted invite ID=%d", id)
+	return nil
+}
+
+// CreateUserWithInvite spends one use of the invite and creates the user in
+// the same transaction, so a failed registration doesn't use up the code and
+// two people can't share its last use.
+func CreateUserWithInvite(db *gorm.DB, user *models.User, codeHash string) (*models.Invite, error) {
+	var invite models.Invite
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("code_hash = ?", codeHash).First(&invite).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInviteInvalid
+		}
+		if err != nil {
+			return err
+		}
+		if !invite.Usable(time.Now()) {
+			return ErrInviteInvalid
+		}
+
+		res := tx.Model(&models.Invite{}).
+			Where("id = ? AND uses < max_uses", invite.ID).
+			Update("uses", gorm.Expr("uses + 1"))
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrInviteInvalid
+		}
+		invite.Uses++
+		return tx.Create(user).Error
+	})
+	if err != nil {
+		if !errors.Is(err, ErrInviteInvalid) {
+			log.Printf("[ERROR] Failed to create user '%s' with invite: %v", user.Username, err)
+		}
+		return nil, err
+	}
+	log.Printf("[INFO] Created user ID=%d with invite ID=%d", user.ID, invite.ID)
+
+	if err := SetCacheUser(*user); err != nil {
+		log.Printf("[WARN] Cache set failed for user ID=%d: %v", user.ID, err)
+	}
+	return &invite, nil
+}
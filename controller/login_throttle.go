@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// --- Login Throttling ---
+
+// Failed logins are counted per subject (a username or an IP address) in a
+// sliding window; a block key stops further attempts until it expires.
+
+func loginFailuresKey(kind string, subject string) string {
+	return "login:failures:" + kind + ":" + subject
+}
+
+func loginBlockKey(kind string, subject string) string {
+	return "login:blocked:" + kind + ":" + subject
+}
+
+// RecordLoginFailure counts a failure and returns the number of failures in
+// the current window.
+func RecordLoginFailure(kind string, subject string, window time.Duration) (int64, error) {
+	key := loginFailuresKey(kind, subject)
+	var incr *redis.IntCmd
+	_, err := Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, window)
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to record login failure for %s '%s': %v", kind, subject, err)
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+func ClearLoginFailures(kind string, subject string) error {
+	if err := Rdb.Del(ctx, loginFailuresKey(kind, subject), loginBlockKey(kind, subject)).Err(); err != nil {
+		log.Printf("[WARN] Failed to clear login failures for %s '%s': %v", kind, subject, err)
+		return err
+	}
+	return nil
+}
+
+func BlockLogin(kind string, subject string, reason string, ttl time.Duration) error {
+	if err := Rdb.Set(ctx, loginBlockKey(kind, subject), reason, ttl).Err(); err != nil {
+		log.Printf("[ERROR] Failed to block logins for %s '%s': %v", kind, subject, err)
+		return err
+	}
+	log.Printf("[WARN] Blocking logins for %s '%s' for %s (%s)", kind, subject, ttl, reason)
+	return nil
+}
+
+// LoginBlockedFor returns how long logins for the subject remain blocked,
+// or zero.
+func LoginBlockedFor(kind string, subject string) (time.Duration, error) {
+	ttl, err := Rdb.PTTL(ctx, loginBlockKey(kind, subject)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		log.Printf("[ERROR] Failed to check login block for %s '%s': %v", kind, subject, err)
+		return 0, err
+	}
+	if ttl < 0 {
+		return 0, nil
+	}
+	return ttl, nil
+}
@@ -0,0 +1,264 @@
+package controller
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+var ErrExportNotFound = errors.New("no data export")
+
+// --- Data Export ---
+
+// CreateDataExport starts a new export for the user, replacing any earlier
+// one.
+func CreateDataExport(db *gorm.DB, userID uint64) (*models.DataExport, error) {
+	export := models.DataExport{UserID: userID, State: models.ExportPending}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.DataExport{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&export).Error
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to create data export for user ID=%d: %v", userID, err)
+		return nil, err
+	}
+	log.Printf("[INFO] Started data export ID=%d for user ID=%d", export.ID, userID)
+	return &export, nil
+}
+
+// GetDataExport returns the user's export without the archive itself.
+func GetDataExport(db *gorm.DB, userID uint64) (*models.DataExport, error) {
+	var export models.DataExport
+	err := db.Omit("data").Where("user_id = ?", userID).Order("id DESC").First(&export).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrExportNotFound
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to load data export of user ID=%d: %v", userID, err)
+		return nil, err
+	}
+	return &export, nil
+}
+
+func GetDataExportArchive(db *gorm.DB, userID uint64, id uint64) (*models.DataExport, error) {
+	var export models.DataExport
+	err := db.Where("id = ? AND user_id = ?", id, userID).First(&export).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrExportNotFound
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to load data export ID=%d: %v", id, err)
+		return nil, err
+	}
+	return &export, nil
+}
+
+// FinishDataExport stores the archive, or marks the export failed when data
+// is nil. It does nothing if the export was replaced in the meantime.
+func FinishDataExport(db *gorm.DB, id uint64, data []byte, expiresAt time.Time) error {
+	updates := map[string]any{"state": models.ExportFailed, "completed_at": time.Now()}
+	if data != nil {
+		updates = map[string]any{
+			"state":        models.ExportReady,
+			"data":         data,
+			"size":         len(data),
+			"completed_at": time.Now(),
+			"expires_at":   expiresAt,
+		}
+	}
+	err := db.Model(&models.DataExport{}).Where("id = ? AND state = ?", id, models.ExportPending).Updates(updates).Error
+	if err != nil {
+		log.Printf("[ERROR] Failed to store data export ID=%d: %v", id, err)
+		return err
+	}
+	log.Printf("[INFO] Data export ID=%d is %s (%d bytes)", id, updates["state"], len(data))
+	return nil
+}
+
+func DeleteDataExport(db *gorm.DB, id uint64) error {
+	if err := db.Delete(&models.DataExport{}, id).Error; err != nil {
+		log.Printf("[ERROR] Failed to delete data export ID=%d: %v", id, err)
+		return err
+	}
+	return nil
+}
+
+// EachUserMessage hands the user's messages, oldest first and with their
+// channel, to fn a batch at a time.
+func EachUserMessage(db *gorm.DB, userID uint64, fn func([]models.Message) error) error {
+	var batch []models.Message
+	err := db.Preload("Channel").Where("user_id = ?", userID).Order("id").
+		FindInBatches(&batch, 500, func(tx *gorm.DB, _ int) error {
+			return fn(batch)
+		}).Error
+	if err != nil {
+		log.Printf("[ERROR] Failed to read messages of user ID=%d: %v", userID, err)
+	}
+	return err
+}
+
+func GetUserAuditEntries(db *gorm.DB, userID uint64) ([]models.AuditEntry, error) {
+	var entries []models.AuditEntry
+	err := db.Where("user_id = ?", userID).Order("id").Find(&entries).Error
+	if err != nil {
+		log.Printf("[ERROR] Failed to read audit entries of user ID=%d: %v", userID, err)
+	}
+	return entries, err
+}
+
+// --- Account Deletion ---
+
+// scrubEvents rewrites what the replay logs of all channels still say about
+// a deleted user, so it can't be had again through Last-Event-ID. Their
+// messages are moved to placeholder, or removed when it is nil; in member
+// events they are only named as gone.
+func scrubEvents(db *gorm.DB, userID uint64, gone *models.User, placeholder *models.User) {
+	var channelIDs []uint64
+	if err := db.Model(&models.Channel{}).Pluck("id", &channelIDs).Error; err != nil {
+		log.Printf("[ERROR] Failed to list channels to scrub events of user ID=%d: %v", userID, err)
+		return
+	}
+
+	scrub := func(event *models.Event) *models.Event {
+		data, ok := event.Data.(map[string]any)
+		if !ok {
+			return event
+		}
+		switch event.Type {
+		case models.EventMessageCreated:
+			if event.FromUserID != userID {
+				return event
+			}
+			if placeholder == nil {
+				return nil
+			}
+			event.FromUserID = placeholder.ID
+			data["user_id"] = placeholder.ID
+			data["author"] = placeholder.Summary()
+		case models.EventMemberJoined, models.EventMemberLeft:
+			if data["user_id"] == int64(userID) {
+				data["user"] = gone.Summary()
+			}
+		}
+		return event
+	}
+	for _, channelID := range channelIDs {
+		if err := RewriteEvents(channelID, scrub); err != nil {
+			log.Printf("[WARN] Failed to scrub events of user ID=%d in channel %d: %v", userID, channelID, err)
+		}
+	}
+}
+
+// deletedUser returns the placeholder that kept messages are moved to,
+// creating it the first time.
+func deletedUser(tx *gorm.DB) (*models.User, error) {
+	now := time.Now()
+	user := models.User{
+		Username:    models.DeletedUsername,
+		DisplayName: models.DeletedDisplayName,
+		DisabledAt:  &now,
+	}
+	err := tx.Where("username = ?", models.DeletedUsername).FirstOrCreate(&user).Error
+	return &user, err
+}
+
+// DeleteUser removes the account and everything attached to it. Its messages
+// are moved to the placeholder user when keepMessages is set, so the
+// conversations they were part of stay readable, and deleted otherwise. The
+// rows are deleted one table at a time rather than by relying on foreign key
+// cascades, which SQLite only enforces when asked to.
+func DeleteUser(db *gorm.DB, userID uint64, keepMessages bool) error {
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUserNotFound
+		}
+		log.Printf("[ERROR] Failed to find user ID=%d: %v", userID, err)
+		return err
+	}
+
+	// cached sessions and tokens would keep working until they expire
+	if err := RevokeUserSessions(db, userID, ""); err != nil {
+		return err
+	}
+	if err := DeleteUserPersonalAccessTokens(db, userID); err != nil {
+		return err
+	}
+
+	var channelIDs []uint64
+	var messages []models.Message
+	var placeholder *models.User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.UserChannel{}).Where("user_id = ?", userID).Pluck("channel_id", &channelIDs).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&models.Message{}).Select("id", "channel_id").Where("user_id = ?", userID).Find(&messages).Error
+		if err != nil {
+			return err
+		}
+
+		if keepMessages {
+			if placeholder, err = deletedUser(tx); err != nil {
+				return err
+			}
+			err = tx.Model(&models.Message{}).Where("user_id = ?", userID).Update("user_id", placeholder.ID).Error
+		} else {
+			err = tx.Where("user_id = ?", userID).Delete(&models.Message{}).Error
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, model := range []any{
+			&models.UserChannel{}, &models.Session{}, &models.RefreshToken{}, &models.RecoveryCode{},
+			&models.UserToken{}, &models.ExternalIdentity{}, &models.Avatar{}, &models.DataExport{},
+		} {
+			if err := tx.Where("user_id = ?", userID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("blocker_id = ? OR blocked_id = ?", userID, userID).Delete(&models.Block{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&models.Invite{}).Where("created_by_id = ?", userID).Update("created_by_id", nil).Error; err != nil {
+			return err
+		}
+		// the log outlives the account, but no longer points at it
+		err = tx.Model(&models.AuditEntry{}).Where("user_id = ?", userID).
+			Updates(map[string]any{"user_id": nil, "subject": "user:" + models.DeletedUsername}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(&models.User{}, userID).Error
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to delete user ID=%d: %v", userID, err)
+		return err
+	}
+	log.Printf("[INFO] Deleted user ID=%d, %d messages kept=%t", userID, len(messages), keepMessages)
+
+	DeleteCacheUser(userID)
+	if keepMessages {
+		ReassignCacheMessages(messages, placeholder.ID)
+	} else {
+		DeleteCacheMessages(messages)
+	}
+	if err := RevokeUserAccess(userID, RevokedAccount); err != nil {
+		log.Printf("[WARN] Failed to revoke live access for user ID=%d: %v", userID, err)
+	}
+	// members see the departure, but not who it was any more
+	gone := &models.User{ID: userID, Username: models.DeletedUsername, DisplayName: models.DeletedDisplayName}
+	scrubEvents(db, userID, gone, placeholder)
+	for _, channelID := range channelIDs {
+		if err := PublishEvent(models.NewMemberEvent(models.EventMemberLeft, channelID, gone)); err != nil {
+			log.Printf("[WARN] Failed to publish member.left for deleted user ID=%d in channel %d: %v", userID, channelID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package controller
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrUserNotFound   = errors.New("user not found")
+	ErrAvatarNotFound = errors.New("avatar not found")
+)
+
+// --- Profiles ---
+
+// GetUserProfile reads the whole user from the database; the cache only
+// holds what authentication needs.
+func GetUserProfile(db *gorm.DB, id uint64) (*models.User, error) {
+	var user models.User
+	err := db.First(&user, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to load profile of user ID=%d: %v", id, err)
+		return nil, err
+	}
+	return &user, nil
+}
+
+func UpdateUserProfile(db *gorm.DB, id uint64, updates map[string]any) (*models.User, error) {
+	if err := db.Model(&models.User{}).Where("id = ?", id).Updates(updates).Error; err != nil {
+		log.Printf("[ERROR] Failed to update profile of user ID=%d: %v", id, err)
+		return nil, err
+	}
+	user, err := GetUserProfile(db, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := SetCacheUser(*user); err != nil {
+		log.Printf("[WARN] Failed to cache user ID=%d: %v", id, err)
+	}
+	log.Printf("[INFO] Updated profile of user ID=%d", id)
+	return user, nil
+}
+
+// --- Avatars ---
+
+// SaveAvatar replaces every size of the user's avatar at once.
+func SaveAvatar(db *gorm.DB, userID uint64, images map[int][]byte) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.Avatar{}).Error; err != nil {
+			return err
+		}
+		for size, data := range images {
+			if err := tx.Create(&models.Avatar{UserID: userID, Size: size, Data: data}).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(&models.User{}).Where("id = ?", userID).Update("avatar_updated_at", time.Now()).Error
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to save avatar of user ID=%d: %v", userID, err)
+		return err
+	}
+	log.Printf("[INFO] Saved avatar of user ID=%d in %d sizes", userID, len(images))
+	return nil
+}
+
+func GetAvatar(db *gorm.DB, userID uint64, size int) (*models.Avatar, error) {
+	var avatar models.Avatar
+	err := db.Where("user_id = ? AND size = ?", userID, size).First(&avatar).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrAvatarNotFound
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to load avatar of user ID=%d: %v", userID, err)
+		return nil, err
+	}
+	return &avatar, nil
+}
+
+func DeleteAvatar(db *gorm.DB, userID uint64) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Where("user_id = ?", userID).Delete(&models.Avatar{})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrAvatarNotFound
+		}
+		return tx.Model(&models.User{}).Where("id = ?", userID).Update("avatar_updated_at", nil).Error
+	})
+	if err != nil && !errors.Is(err, ErrAvatarNotFound) {
+		log.Printf("[ERROR] Failed to delete avatar of user ID=%d: %v", userID, err)
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// --- Proof of Work ---
+
+const proofOfWorkSecretKey = "pow:secret"
+
+func proofOfWorkUsedKey(challengeHash string) string {
+	return "pow:used:" + challengeHash
+}
+
+func proofOfWorkRateKey(purpose string, minute int64) string {
+	return fmt.Sprintf("pow:rate:%s:%d", purpose, minute)
+}
+
+// SharedProofOfWorkSecret returns the secret challenges are signed with,
+// creating it on first use so every node ends up with the same one.
+func SharedProofOfWorkSecret() ([]byte, error) {
+	fresh := make([]byte, 32)
+	if _, err := rand.Read(fresh); err != nil {
+		return nil, err
+	}
+	if err := Rdb.SetNX(ctx, proofOfWorkSecretKey, hex.EncodeToString(fresh), 0).Err(); err != nil {
+		log.Printf("[ERROR] Failed to store proof-of-work secret: %v", err)
+		return nil, err
+	}
+	stored, err := Rdb.Get(ctx, proofOfWorkSecretKey).Result()
+	if err != nil {
+		log.Printf("[ERROR] Failed to load proof-of-work secret: %v", err)
+		return nil, err
+	}
+	return hex.DecodeString(stored)
+}
+
+// ClaimProofOfWork marks a solved challenge as spent. It returns false if
+// the challenge was already used.
+func ClaimProofOfWork(challengeHash string, ttl time.Duration) (bool, error) {
+	ok, err := Rdb.SetNX(ctx, proofOfWorkUsedKey(challengeHash), 1, ttl).Result()
+	if err != nil {
+		log.Printf("[ERROR] Failed to claim proof of work: %v", err)
+		return false, err
+	}
+	return ok, nil
+}
+
+// RecordProofOfWork counts a solved challenge towards the current minute.
+func RecordProofOfWork(purpose string) {
+	key := proofOfWorkRateKey(purpose, time.Now().Unix()/60)
+	_, err := Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Incr(ctx, key)
+		pipe.Expire(ctx, key, 2*time.Minute)
+		return nil
+	})
+	if err != nil {
+		log.Printf("[WARN] Failed to count proof of work for %s: %v", purpose, err)
+	}
+}
+
+// ProofOfWorkRate is how many challenges for the purpose were solved in the
+// current and the previous minute.
+func ProofOfWorkRate(purpose string) (int64, error) {
+	minute := time.Now().Unix() / 60
+	values, err := Rdb.MGet(ctx, proofOfWorkRateKey(purpose, minute), proofOfWorkRateKey(purpose, minute-1)).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		log.Printf("[WARN] Failed to read proof-of-work rate for %s: %v", purpose, err)
+		return 0, err
+	}
+	var total int64
+	for _, value := range values {
+		if s, ok := value.(string); ok {
+			var n int64
+			fmt.Sscan(s, &n)
+			total += n
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,185 @@
+package controller
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// --- Sessions ---
+
+func CreateSession(db *gorm.DB, session *models.Session) error {
+	if err := db.Create(session).Error; err != nil {
+		log.Printf("[ERROR] Failed to create session for user ID=%d: %v", session.UserID, err)
+		return err
+	}
+	log.Printf("[INFO] Created session %s for user ID=%d (%s, %s)", session.ID, session.UserID, session.Device, session.IP)
+
+	if err := SetCacheSession(*session); err != nil {
+		log.Printf("[WARN] Cache set failed for session %s: %v", session.ID, err)
+	}
+	return nil
+}
+
+func GetSessionByID(db *gorm.DB, id string) (*models.Session, error) {
+	if session, err := GetCacheSession(id); err == nil {
+		return session, nil
+	}
+
+	var session models.Session
+	if err := db.First(&session, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSessionNotFound
+		}
+		log.Printf("[ERROR] Failed to find session %s: %v", id, err)
+		return nil, err
+	}
+
+	if err := SetCacheSession(session); err != nil {
+		log.Printf("[WARN] Failed to cache session %s: %v", id, err)
+	}
+	return &session, nil
+}
+
+// GetSessionLoginTime returns when the session was logged in, which
+// refreshing it doesn't change. The cached copy doesn't carry it.
+func GetSessionLoginTime(db *gorm.DB, id string) (time.Time, error) {
+	var session models.Session
+	if err := db.Select("created_at").First(&session, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return time.Time{}, ErrSessionNotFound
+		}
+		log.Printf("[ERROR] Failed to find session %s: %v", id, err)
+		return time.Time{}, err
+	}
+	return session.CreatedAt, nil
+}
+
+// TouchSession records activity on the session. It only goes to Redis; the
+// database copy of last_seen_at is brought up to date on refresh.
+func TouchSession(session *models.Session) {
+	ttl := time.Until(session.ExpiresAt)
+	if ttl <= 0 {
+		return
+	}
+	if err := Rdb.Set(ctx, sessionLastSeenKey(session.ID), time.Now().Unix(), ttl).Err(); err != nil {
+		log.Printf("[WARN] Failed to record activity for session %s: %v", session.ID, err)
+	}
+}
+
+func RefreshSession(db *gorm.DB, id string, ip string, userAgent string, expiresAt time.Time) error {
+	var session models.Session
+	if err := db.First(&session, "id = ?", id).Error; err != nil {
+		log.Printf("[ERROR] Failed to find session %s: %v", id, err)
+		return err
+	}
+
+	err := db.Model(&session).Updates(map[string]any{
+		"ip":           ip,
+		"user_agent":   userAgent,
+		"last_seen_at": time.Now(),
+		"expires_at":   expiresAt,
+	}).Error
+	if err != nil {
+		log.Printf("[ERROR] Failed to update session %s: %v", id, err)
+		return err
+	}
+
+	if err := SetCacheSession(session); err != nil {
+		log.Printf("[WARN] Failed to cache session %s: %v", id, err)
+	}
+	return nil
+}
+
+// GetUserSessions lists the sessions that can still be used, most recently
+// active first.
+func GetUserSessions(db *gorm.DB, userID uint64) ([]models.Session, error) {
+	var sessions []models.Session
+	err := db.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at DESC").
+		Find(&sessions).Error
+	if err != nil {
+		log.Printf("[ERROR] Failed to list sessions of user ID=%d: %v", userID, err)
+		return nil, err
+	}
+
+	for i := range sessions {
+		seen, err := Rdb.Get(ctx, sessionLastSeenKey(sessions[i].ID)).Result()
+		if err != nil {
+			if !errors.Is(err, redis.Nil) {
+				log.Printf("[WARN] Failed to read activity of session %s: %v", sessions[i].ID, err)
+			}
+			continue
+		}
+		if unix, err := strconv.ParseInt(seen, 10, 64); err == nil && unix > sessions[i].LastSeenAt.Unix() {
+			sessions[i].LastSeenAt = time.Unix(unix, 0).UTC()
+		}
+	}
+	return sessions, nil
+}
+
+// RevokeSession ends the session: its refresh tokens stop working at once
+// and its access tokens are rejected by the auth middleware.
+func RevokeSession(db *gorm.DB, id string) error {
+	var session models.Session
+	if err := db.First(&session, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSessionNotFound
+		}
+		log.Printf("[ERROR] Failed to find session %s: %v", id, err)
+		return err
+	}
+	if session.RevokedAt != nil {
+		return nil
+	}
+
+	now := time.Now()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := RevokeRefreshTokenFamily(tx, id); err != nil {
+			return err
+		}
+		return tx.Model(&session).Update("revoked_at", now).Error
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to revoke session %s: %v", id, err)
+		return err
+	}
+	session.RevokedAt = &now
+	log.Printf("[INFO] Revoked session %s of user ID=%d", id, session.UserID)
+
+	// the session is revoked in the database either way; a stale cache entry
+	// would let its access tokens through, so it goes if it can't be updated
+	if err := SetCacheSession(session); err != nil {
+		log.Printf("[WARN] Failed to cache revoked session %s: %v", id, err)
+		DeleteCacheSession(id)
+	}
+	return nil
+}
+
+// RevokeUserSessions logs the user out everywhere except keepID, which may
+// be empty.
+func RevokeUserSessions(db *gorm.DB, userID uint64, keepID string) error {
+	var ids []string
+	err := db.Model(&models.Session{}).
+		Where("user_id = ? AND revoked_at IS NULL AND id <> ?", userID, keepID).
+		Pluck("id", &ids).Error
+	if err != nil {
+		log.Printf("[ERROR] Failed to list sessions of user ID=%d: %v", userID, err)
+		return err
+	}
+
+	for _, id := range ids {
+		if err := RevokeSession(db, id); err != nil {
+			return err
+		}
+	}
+	log.Printf("[INFO] Revoked %d sessions of user ID=%d", len(ids), userID)
+	return nil
+}
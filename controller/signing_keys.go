@@ -0,0 +1,69 @@
+package controller
+
+import (
+	"log"
+	"time"
+
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+const signingKeyRotationLock = "jwt:rotation:lock"
+
+// --- Signing Keys ---
+
+// GetSigningKeys returns the keys that are active or still within their
+// grace period, newest first.
+func GetSigningKeys(db *gorm.DB, retiredAfter time.Time) ([]models.SigningKey, error) {
+	var keys []models.SigningKey
+	err := db.Where("retired_at IS NULL OR retired_at > ?", retiredAfter).
+		Order("created_at DESC").
+		Find(&keys).Error
+	if err != nil {
+		log.Printf("[ERROR] Failed to load signing keys: %v", err)
+		return nil, err
+	}
+	return keys, nil
+}
+
+// CreateSigningKey stores the new key and retires every key that was
+// signing before it as of the moment the new one takes over.
+func CreateSigningKey(db *gorm.DB, key *models.SigningKey) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(key).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.SigningKey{}).
+			Where("id <> ? AND retired_at IS NULL", key.ID).
+			Update("retired_at", *key.ActivatesAt).Error
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to store signing key %s: %v", key.ID, err)
+		return err
+	}
+	log.Printf("[INFO] Signing key %s (%s) is published and signs from %s", key.ID, key.Algorithm, key.ActivatesAt.Format(time.RFC3339))
+	return nil
+}
+
+func DeleteRetiredSigningKeys(db *gorm.DB, retiredBefore time.Time) error {
+	res := db.Where("retired_at IS NOT NULL AND retired_at <= ?", retiredBefore).Delete(&models.SigningKey{})
+	if res.Error != nil {
+		log.Printf("[ERROR] Failed to delete retired signing keys: %v", res.Error)
+		return res.Error
+	}
+	if res.RowsAffected > 0 {
+		log.Printf("[INFO] Deleted %d signing keys past their grace period", res.RowsAffected)
+	}
+	return nil
+}
+
+// LockSigningKeyRotation makes sure only one node rotates at a time. The
+// lock is never released explicitly; it simply expires.
+func LockSigningKeyRotation(ttl time.Duration) bool {
+	ok, err := Rdb.SetNX(ctx, signingKeyRotationLock, 1, ttl).Result()
+	if err != nil {
+		log.Printf("[WARN] Failed to take signing key rotation lock: %v", err)
+		return false
+	}
+	return ok
+}
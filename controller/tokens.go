@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused")
+)
+
+// --- Refresh Tokens ---
+
+func CreateRefreshToken(db *gorm.DB, token *models.RefreshToken) error {
+	if err := db.Create(token).Error; err != nil {
+		log.Printf("[ERROR] Failed to store refresh token for user ID=%d: %v", token.UserID, err)
+		return err
+	}
+	log.Printf("[INFO] Issued refresh token ID=%d (family=%s) for user ID=%d", token.ID, token.FamilyID, token.UserID)
+	return nil
+}
+
+func GetRefreshTokenByHash(db *gorm.DB, tokenHash string) (*models.RefreshToken, error) {
+	var token models.RefreshToken
+	if err := db.Where("token_hash = ?", tokenHash).First(&token).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrRefreshTokenInvalid
+		}
+		log.Printf("[ERROR] Failed to look up refresh token: %v", err)
+		return nil, err
+	}
+	return &token, nil
+}
+
+// RotateRefreshToken spends the token with the given hash and stores next in
+// its place, in the same family. A token can only be spent once: presenting
+// it again means it leaked, so the whole family is revoked and the
+// legitimate holder has to log in again.
+func RotateRefreshToken(db *gorm.DB, tokenHash string, next *models.RefreshToken) (*models.RefreshToken, error) {
+	var current *models.RefreshToken
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		current, err = GetRefreshTokenByHash(tx, tokenHash)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		switch {
+		case current.RevokedAt != nil:
+			return ErrRefreshTokenInvalid
+		case current.UsedAt != nil:
+			return ErrRefreshTokenReused
+		case now.After(current.ExpiresAt):
+			return ErrRefreshTokenInvalid
+		}
+
+		// two requests racing with the same token: only one of them gets to
+		// mark it used, the other one is treated as reuse
+		res := tx.Model(&models.RefreshToken{}).
+			Where("id = ? AND used_at IS NULL", current.ID).
+			Update("used_at", now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrRefreshTokenReused
+		}
+
+		next.UserID = current.UserID
+		next.FamilyID = current.FamilyID
+		return tx.Create(next).Error
+	})
+
+	if errors.Is(err, ErrRefreshTokenReused) {
+		log.Printf("[WARN] Refresh token ID=%d reused, revoking session %s of user ID=%d", current.ID, current.FamilyID, current.UserID)
+		if err := RevokeSession(db, current.FamilyID); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	if err != nil {
+		if !errors.Is(err, ErrRefreshTokenInvalid) {
+			log.Printf("[ERROR] Failed to rotate refresh token: %v", err)
+		}
+		return nil, err
+	}
+
+	log.Printf("[INFO] Rotated refresh token ID=%d -> ID=%d (family=%s)", current.ID, next.ID, next.FamilyID)
+	return current, nil
+}
+
+func RevokeRefreshTokenFamily(db *gorm.DB, familyID string) error {
+	res := db.Model(&models.RefreshToken{}).
+		Where("family_id = ? AND revoked_at IS NULL", familyID).
+		Update("revoked_at", time.Now())
+	if res.Error != nil {
+		log.Printf("[ERROR] Failed to revoke refresh token family %s: %v", familyID, res.Error)
+		return res.Error
+	}
+	log.Printf("[INFO] Revoked %d refresh tokens in family %s", res.RowsAffected, familyID)
+	return nil
+}
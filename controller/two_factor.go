@@ -0,0 +1,207 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+var ErrChallengeNotFound = errors.New("login challenge not found or expired")
+
+// --- Two-Factor Authentication ---
+
+func totpPendingKey(userID uint64) string {
+	return fmt.Sprintf("user:%d:totp:pending", userID)
+}
+
+func totpStepKey(userID uint64, step int64) string {
+	return fmt.Sprintf("user:%d:totp:step:%d", userID, step)
+}
+
+func loginChallengeKey(tokenHash string) string {
+	return "login:challenge:" + tokenHash
+}
+
+// SetPendingTOTPSecret keeps a freshly generated secret around until the
+// user proves their authenticator has it.
+func SetPendingTOTPSecret(userID uint64, secret string, ttl time.Duration) error {
+	if err := Rdb.Set(ctx, totpPendingKey(userID), secret, ttl).Err(); err != nil {
+		log.Printf("[ERROR] Failed to store pending TOTP secret for user ID=%d: %v", userID, err)
+		return err
+	}
+	return nil
+}
+
+func GetPendingTOTPSecret(userID uint64) (string, error) {
+	secret, err := Rdb.Get(ctx, totpPendingKey(userID)).Result()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			log.Printf("[ERROR] Failed to read pending TOTP secret for user ID=%d: %v", userID, err)
+		}
+		return "", err
+	}
+	return secret, nil
+}
+
+// UseTOTPStep records that the code for the given time step was used, so
+// the same code can't be replayed while it is still valid. It reports
+// whether the step was still unused.
+func UseTOTPStep(userID uint64, step int64, ttl time.Duration) (bool, error) {
+	ok, err := Rdb.SetNX(ctx, totpStepKey(userID, step), 1, ttl).Result()
+	if err != nil {
+		log.Printf("[ERROR] Failed to record TOTP use for user ID=%d: %v", userID, err)
+		return false, err
+	}
+	return ok, nil
+}
+
+func EnableTOTP(db *gorm.DB, userID uint64, secret string, codeHashes []string) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&models.User{}).
+			Where("id = ? AND totp_enabled_at IS NULL", userID).
+			Updates(map[string]any{"totp_secret": secret, "totp_enabled_at": time.Now()})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("two-factor authentication is already enabled")
+		}
+		return replaceRecoveryCodes(tx, userID, codeHashes)
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to enable TOTP for user ID=%d: %v", userID, err)
+		return err
+	}
+
+	if err := Rdb.Del(ctx, totpPendingKey(userID)).Err(); err != nil {
+		log.Printf("[WARN] Failed to clear pending TOTP secret for user ID=%d: %v", userID, err)
+	}
+	log.Printf("[INFO] TOTP enabled for user ID=%d", userID)
+	return nil
+}
+
+func DisableTOTP(db *gorm.DB, userID uint64) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.User{}).
+			Where("id = ?", userID).
+			Updates(map[string]any{"totp_secret": "", "totp_enabled_at": nil}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to disable TOTP for user ID=%d: %v", userID, err)
+		return err
+	}
+	log.Printf("[INFO] TOTP disabled for user ID=%d", userID)
+	return nil
+}
+
+func ReplaceRecoveryCodes(db *gorm.DB, userID uint64, codeHashes []string) error {
+	if err := db.Transaction(func(tx *gorm.DB) error {
+		return replaceRecoveryCodes(tx, userID, codeHashes)
+	}); err != nil {
+		log.Printf("[ERROR] Failed to replace recovery codes for user ID=%d: %v", userID, err)
+		return err
+	}
+	log.Printf("[INFO] Issued %d new recovery codes for user ID=%d", len(codeHashes), userID)
+	return nil
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, userID uint64, codeHashes []string) error {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return err
+	}
+	codes := make([]models.RecoveryCode, 0, len(codeHashes))
+	for _, hash := range codeHashes {
+		codes = append(codes, models.RecoveryCode{UserID: userID, CodeHash: hash})
+	}
+	return tx.Create(&codes).Error
+}
+
+// UseRecoveryCode spends the matching unused recovery code, if there is one.
+func UseRecoveryCode(db *gorm.DB, userID uint64, codeHash string) (bool, error) {
+	res := db.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, codeHash).
+		Update("used_at", time.Now())
+	if res.Error != nil {
+		log.Printf("[ERROR] Failed to use recovery code for user ID=%d: %v", userID, res.Error)
+		return false, res.Error
+	}
+	if res.RowsAffected > 0 {
+		log.Printf("[INFO] User ID=%d used a recovery code", userID)
+	}
+	return res.RowsAffected > 0, nil
+}
+
+func CountUnusedRecoveryCodes(db *gorm.DB, userID uint64) (int64, error) {
+	var count int64
+	err := db.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND used_at IS NULL", userID).
+		Count(&count).Error
+	if err != nil {
+		log.Printf("[ERROR] Failed to count recovery codes for user ID=%d: %v", userID, err)
+	}
+	return count, err
+}
+
+// --- Login Challenges ---
+
+// LoginChallenge is what a password login leaves behind for the second step.
+type LoginChallenge struct {
+	UserID     uint64
+	DeviceName string
+	Attempts   int64
+}
+
+func CreateLoginChallenge(tokenHash string, challenge LoginChallenge, ttl time.Duration) error {
+	key := loginChallengeKey(tokenHash)
+	_, err := Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, map[string]any{
+			"user_id":     challenge.UserID,
+			"device_name": challenge.DeviceName,
+			"attempts":    0,
+		})
+		pipe.Expire(ctx, key, ttl)
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR] Failed to store login challenge for user ID=%d: %v", challenge.UserID, err)
+	}
+	return err
+}
+
+// AttemptLoginChallenge counts one try against the challenge and returns it
+// with the number of tries so far, this one included.
+func AttemptLoginChallenge(tokenHash string) (*LoginChallenge, error) {
+	key := loginChallengeKey(tokenHash)
+	attempts, err := Rdb.HIncrBy(ctx, key, "attempts", 1).Result()
+	if err != nil {
+		log.Printf("[ERROR] Failed to count login challenge attempt: %v", err)
+		return nil, err
+	}
+
+	fields, err := Rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		log.Printf("[ERROR] Failed to read login challenge: %v", err)
+		return nil, err
+	}
+	userID, err := strconv.ParseUint(fields["user_id"], 10, 64)
+	if err != nil {
+		// the increment above recreated an expired (or made up) challenge
+		Rdb.Del(ctx, key)
+		return nil, ErrChallengeNotFound
+	}
+	return &LoginChallenge{UserID: userID, DeviceName: fields["device_name"], Attempts: attempts}, nil
+}
+
+func DeleteLoginChallenge(tokenHash string) error {
+	return Rdb.Del(ctx, loginChallengeKey(tokenHash)).Err()
+}
@@ -0,0 +1,78 @@
+package controller
+
+import (
+	"log"
+
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// UserMatch is a search hit with the number of channels it shares with the
+// user searching.
+type UserMatch struct {
+	models.User    `gorm:"embedded"`
+	SharedChannels int64 `gorm:"column:shared_channels"`
+}
+
+// UserSearch holds the lowercased query and the LIKE patterns (with \ as
+// escape) it is matched with, from best match to worst.
+type UserSearch struct {
+	Exact      string
+	Prefix     string
+	WordPrefix string
+	Substring  string
+	Fuzzy      string
+}
+
+// --- User Search ---
+
+// SearchUsers returns up to max active users, other than the viewer, whose
+// username or display name matches search.Fuzzy. Exact matches come first,
+// then names or words in them starting with the query, then names containing
+// it, then the rest; within each, users sharing the most channels with the
+// viewer come first. Ranking happens in the query so that max cuts off the
+// worst matches. Users the viewer blocked, or who blocked the viewer, are
+// left out.
+func SearchUsers(db *gorm.DB, viewerID uint64, search UserSearch, max int) ([]UserMatch, error) {
+	shared := db.Table("user_channels AS theirs").
+		Select("COUNT(*)").
+		Joins("JOIN user_channels AS mine ON mine.channel_id = theirs.channel_id AND mine.user_id = ?", viewerID).
+		Where("theirs.user_id = users.id")
+
+	blocked := db.Model(&models.Block{}).Select("blocked_id").Where("blocker_id = ?", viewerID)
+	blockedBy := db.Model(&models.Block{}).Select("blocker_id").Where("blocked_id = ?", viewerID)
+
+	rank := clause.Expr{
+		SQL: `CASE
+			WHEN LOWER(users.username) = ? OR LOWER(users.display_name) = ? THEN 0
+			WHEN LOWER(users.username) LIKE ? ESCAPE '\' OR LOWER(users.display_name) LIKE ? ESCAPE '\'
+				OR LOWER(users.username) LIKE ? ESCAPE '\' OR LOWER(users.display_name) LIKE ? ESCAPE '\' THEN 1
+			WHEN LOWER(users.username) LIKE ? ESCAPE '\' OR LOWER(users.display_name) LIKE ? ESCAPE '\' THEN 2
+			ELSE 3
+		END`,
+		Vars: []any{
+			search.Exact, search.Exact,
+			search.Prefix, search.Prefix, search.WordPrefix, search.WordPrefix,
+			search.Substring, search.Substring,
+		},
+	}
+
+	var matches []UserMatch
+	err := db.Model(&models.User{}).
+		Select("users.*, (?) AS shared_channels", shared).
+		Where("users.disabled_at IS NULL AND users.id <> ?", viewerID).
+		Where("users.id NOT IN (?) AND users.id NOT IN (?)", blocked, blockedBy).
+		Where(`LOWER(users.username) LIKE ? ESCAPE '\' OR LOWER(users.display_name) LIKE ? ESCAPE '\'`, search.Fuzzy, search.Fuzzy).
+		Order(clause.OrderBy{Expression: clause.Expr{
+			SQL:  "?, shared_channels DESC, LENGTH(users.username), users.username",
+			Vars: []any{rank},
+		}}).
+		Limit(max).
+		Find(&matches).Error
+	if err != nil {
+		log.Printf("[ERROR] Failed to search users for userID=%d: %v", viewerID, err)
+		return nil, err
+	}
+	return matches, nil
+}
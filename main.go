@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"log"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -23,6 +24,7 @@ func InitDB() {
 		panic("Failed to connect to database: " + err.Error())
 	}
 	controller.InitRedis()
+	controller.InitEventBus()
 }
 
 
@@ -32,6 +34,19 @@ func main() {
 
 	r := gin.Default()
 
+	// gin believes X-Forwarded-For from anyone by default, and per-IP login
+	// throttling could be sidestepped with a made-up header; without
+	// TRUSTED_PROXIES no proxy is trusted at all
+	var proxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	if err := r.SetTrustedProxies(proxies); err != nil {
+		panic("Invalid TRUSTED_PROXIES: " + err.Error())
+	}
+
 	routes.MapRoutes(r, config.DB)
 
 
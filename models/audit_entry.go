@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+)
+
+const (
+	AuditLoginLockout   = "login.lockout"
+	AuditPasswordChange = "password.change"
+	AuditPasswordReset  = "password.reset"
+	AuditEmailVerified  = "email.verified"
+	AuditIdentityLinked = "identity.linked"
+	AuditInviteCreated  = "invite.created"
+	AuditInviteUsed     = "invite.used"
+	AuditDeactivated    = "account.deactivated"
+	AuditAccountDeleted = "account.deleted"
+	AuditDataExport     = "data.export"
+	AuditUserDisabled   = "admin.user.disabled"
+	AuditUserEnabled    = "admin.user.enabled"
+	AuditAdminGranted   = "admin.granted"
+	AuditAdminRevoked   = "admin.revoked"
+	AuditForcedReset    = "admin.password.reset"
+	AuditChannelDeleted = "admin.channel.deleted"
+	AuditMessageDeleted = "admin.message.deleted"
+)
+
+// AuditEntry records a security-relevant event. UserID is only set when the
+// event can be tied to an existing account.
+type AuditEntry struct {
+	ID        uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
+	Action    string    `gorm:"size:64;not null;index" json:"action"`
+	UserID    *uint64   `gorm:"index" json:"user_id,omitempty"`
+	Subject   string    `gorm:"size:128" json:"subject"`
+	IP        string    `gorm:"column:ip;size:45" json:"ip"`
+	Details   string    `gorm:"type:text" json:"details"`
+	CreatedAt time.Time `gorm:"column:created_at;autoCreateTime;index" json:"created_at"`
+}
@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+)
+
+// Avatar is one size of a user's profile picture, stored as PNG.
+type Avatar struct {
+	UserID    uint64    `gorm:"primaryKey" json:"user_id"`
+	Size      int       `gorm:"primaryKey" json:"size"`
+	Data      []byte    `gorm:"not null" json:"-"`
+	CreatedAt time.Time `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+}
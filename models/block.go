@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+)
+
+// Block hides BlockedID's messages from BlockerID and keeps the two apart.
+type Block struct {
+	BlockerID uint64    `gorm:"primaryKey" json:"-"`
+	BlockedID uint64    `gorm:"primaryKey;index" json:"user_id"`
+	CreatedAt time.Time `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+
+	Blocker User `gorm:"foreignKey:BlockerID;constraint:OnDelete:CASCADE" json:"-"`
+	Blocked User `gorm:"foreignKey:BlockedID;constraint:OnDelete:CASCADE" json:"-"`
+}
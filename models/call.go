@@ -0,0 +1,47 @@
+package models
+
+import (
+	"time"
+)
+
+const (
+	CallRinging = "ringing"
+	CallActive  = "active"
+	CallEnded   = "ended"
+)
+
+// Call tracks the signaling state of a voice/video call. Media flows peer to
+// peer; the server only relays SDP and ICE candidates between participants,
+// so calls live in Redis rather than the database.
+type Call struct {
+	ID           string     `json:"id"`
+	ChannelID    uint64     `json:"channel_id"`
+	InitiatorID  uint64     `json:"initiator_id"`
+	CalleeID     uint64     `json:"callee_id,omitempty"`
+	Media        string     `json:"media"`
+	State        string     `json:"state"`
+	Participants []uint64   `json:"participants"`
+	StartedAt    time.Time  `json:"started_at"`
+	RingsUntil   *time.Time `json:"rings_until,omitempty"`
+	AnsweredAt   *time.Time `json:"answered_at,omitempty"`
+	EndedAt      *time.Time `json:"ended_at,omitempty"`
+	EndReason    string     `json:"end_reason,omitempty"`
+}
+
+func (c *Call) IsDirect() bool {
+	return c.CalleeID != 0
+}
+
+// Unanswered reports whether the call rang out without anyone picking up.
+func (c *Call) Unanswered(now time.Time) bool {
+	return c.State == CallRinging && c.RingsUntil != nil && !now.Before(*c.RingsUntil)
+}
+
+func (c *Call) HasParticipant(userID uint64) bool {
+	for _, id := range c.Participants {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
@@ -13,3 +13,12 @@ type Channel struct {
 
 	Messages []Message `gorm:"foreignKey:ChannelID" json:"messages,omitempty"`
 }
+
+func (c *Channel) Payload() map[string]any {
+	return map[string]any{
+		"id":          c.ID,
+		"name":        c.Name,
+		"description": c.Description,
+		"updated_at":  c.UpdatedAt.Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+)
+
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// DataExport is a zip archive of everything stored about a user, built in
+// the background. Like avatars, the archive is kept in the database; it is
+// thrown away when it expires or a new export is requested.
+type DataExport struct {
+	ID          uint64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID      uint64     `gorm:"not null;index" json:"-"`
+	State       string     `gorm:"size:16;not null" json:"state"`
+	Size        int        `gorm:"not null;default:0" json:"size"`
+	Data        []byte     `json:"-"`
+	CreatedAt   time.Time  `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+	CompletedAt *time.Time `gorm:"column:completed_at" json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `gorm:"column:expires_at" json:"expires_at,omitempty"`
+
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+}
@@ -0,0 +1,143 @@
+package models
+
+// EventVersion is bumped whenever the envelope, or the data of an existing
+// event type, changes in a way older clients cannot ignore.
+const EventVersion = 1
+
+const (
+	EventMessageCreated = "message.created"
+	EventMessageDeleted = "message.deleted"
+	EventMemberJoined   = "member.joined"
+	EventMemberLeft     = "member.left"
+	EventChannelUpdated = "channel.updated"
+	EventChannelDeleted = "channel.deleted"
+	EventCallStarted    = "call.started"
+	EventCallUpdated    = "call.updated"
+	EventCallEnded      = "call.ended"
+	EventCallSignal     = "call.signal"
+	EventError          = "error"
+)
+
+// Event is the envelope for everything pushed to live clients, whatever the
+// transport. Seq is assigned when the event is published; it increases per
+// channel and is the cursor clients resume from (Last-Event-ID).
+//
+// Ephemeral events (call signaling, errors) carry no seq, are never replayed
+// and, when ToUserID is set, are only delivered to that user's connections.
+// FromUserID is set for events a user sent, so blocks can be applied.
+type Event struct {
+	Version    int    `json:"v"`
+	Type       string `json:"type"`
+	ChannelID  uint64 `json:"channel_id"`
+	Seq        uint64 `json:"seq"`
+	FromUserID uint64 `json:"from_user_id,omitempty"`
+	ToUserID   uint64 `json:"to_user_id,omitempty"`
+	Data       any    `json:"data"`
+}
+
+func (e *Event) IsEphemeral() bool {
+	return e.Type == EventCallSignal || e.Type == EventError
+}
+
+// Collapsed is a message as shown to someone who blocked its author: it is
+// still there, so the conversation around it makes sense, but its content
+// isn't.
+func (e *Event) Collapsed() *Event {
+	collapsed := *e
+	if data, ok := e.Data.(map[string]any); ok {
+		copied := make(map[string]any, len(data)+1)
+		for key, value := range data {
+			copied[key] = value
+		}
+		copied["content"] = ""
+		copied["blocked"] = true
+		collapsed.Data = copied
+	}
+	return &collapsed
+}
+
+func NewMessageEvent(m *Message) *Event {
+	return &Event{
+		Version:    EventVersion,
+		Type:       EventMessageCreated,
+		ChannelID:  m.ChannelID,
+		FromUserID: m.UserID,
+		Data:       m.Payload(),
+	}
+}
+
+func NewMemberEvent(eventType string, channelID uint64, user *User) *Event {
+	return &Event{
+		Version:   EventVersion,
+		Type:      eventType,
+		ChannelID: channelID,
+		Data: map[string]any{
+			"user_id": user.ID,
+			"user":    user.Summary(),
+		},
+	}
+}
+
+func NewMessageDeletedEvent(m *Message) *Event {
+	return &Event{
+		Version:   EventVersion,
+		Type:      EventMessageDeleted,
+		ChannelID: m.ChannelID,
+		Data:      map[string]any{"id": m.ID, "channel_id": m.ChannelID},
+	}
+}
+
+func NewChannelUpdatedEvent(ch *Channel) *Event {
+	return &Event{
+		Version:   EventVersion,
+		Type:      EventChannelUpdated,
+		ChannelID: ch.ID,
+		Data:      ch.Payload(),
+	}
+}
+
+func NewChannelDeletedEvent(channelID uint64) *Event {
+	return &Event{
+		Version:   EventVersion,
+		Type:      EventChannelDeleted,
+		ChannelID: channelID,
+		Data:      map[string]any{"id": channelID},
+	}
+}
+
+func NewCallEvent(eventType string, call *Call) *Event {
+	return &Event{
+		Version:   EventVersion,
+		Type:      eventType,
+		ChannelID: call.ChannelID,
+		Data:      call,
+	}
+}
+
+func NewCallSignalEvent(call *Call, fromUserID uint64, toUserID uint64, signal string, payload any) *Event {
+	return &Event{
+		Version:    EventVersion,
+		Type:       EventCallSignal,
+		ChannelID:  call.ChannelID,
+		FromUserID: fromUserID,
+		ToUserID:   toUserID,
+		Data: map[string]any{
+			"call_id":      call.ID,
+			"from_user_id": fromUserID,
+			"signal":       signal,
+			"payload":      payload,
+		},
+	}
+}
+
+func NewErrorEvent(channelID uint64, request string, message string) *Event {
+	return &Event{
+		Version:   EventVersion,
+		Type:      EventError,
+		ChannelID: channelID,
+		Data: map[string]any{
+			"request": request,
+			"error":   message,
+		},
+	}
+}
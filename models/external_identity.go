@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+)
+
+// ExternalIdentity links an account at an identity provider to a user.
+// Provider is the issuer and Subject the provider's stable ID for the
+// account; usernames and emails at the provider may change.
+type ExternalIdentity struct {
+	ID          uint64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID      uint64     `gorm:"not null;index" json:"user_id"`
+	Provider    string     `gorm:"size:255;not null;uniqueIndex:idx_external_identity" json:"provider"`
+	Subject     string     `gorm:"size:255;not null;uniqueIndex:idx_external_identity" json:"subject"`
+	Email       string     `gorm:"size:254" json:"email,omitempty"`
+	CreatedAt   time.Time  `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+	LastLoginAt *time.Time `gorm:"column:last_login_at" json:"last_login_at"`
+
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+)
+
+// Invite lets people register while registration is invite-only. Like
+// access tokens, only the SHA-256 of the code is stored, plus its start.
+type Invite struct {
+	ID          uint64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	CodeHash    string     `gorm:"column:code_hash;size:64;not null;unique" json:"-"`
+	Prefix      string     `gorm:"size:16;not null" json:"prefix"`
+	Note        string     `gorm:"size:128" json:"note,omitempty"`
+	CreatedByID *uint64    `gorm:"column:created_by_id;index" json:"created_by_id"`
+	MaxUses     int        `gorm:"column:max_uses;not null;default:1" json:"max_uses"`
+	Uses        int        `gorm:"not null;default:0" json:"uses"`
+	ExpiresAt   *time.Time `gorm:"column:expires_at" json:"expires_at"`
+	CreatedAt   time.Time  `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+
+	CreatedBy *User `gorm:"foreignKey:CreatedByID;constraint:OnDelete:SET NULL" json:"-"`
+}
+
+func (i *Invite) Usable(now time.Time) bool {
+	return i.Uses < i.MaxUses && (i.ExpiresAt == nil || now.Before(*i.ExpiresAt))
+}
@@ -11,15 +11,18 @@ type Message struct {
 	ChannelID uint64 `gorm:"not null" json:"channel_id"`
 	UserID    uint64 `gorm:"not null" json:"user_id"`
 	Content   string `gorm:"size:256;not null" json:"content"`
+	System    bool   `gorm:"not null;default:false" json:"system"`
 
 	CreatedAt time.Time `gorm:"column:created_at;autoCreateTime" json:"created_at"`
 	UpdatedAt time.Time `gorm:"column:updated_at;autoUpdateTime" json:"updated_at"`
 
 	Channel Channel `gorm:"foreignKey:ChannelID;constraint:OnDelete:CASCADE" json:"-"`
-	User    User    `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+	// Deleting an account deals with its messages first (see
+	// controller.DeleteUser); a cascade would take whole conversations along.
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:RESTRICT" json:"-"`
 }
 
-func (m *Message) ToJSONStringPayload() (string, error) {
+func (m *Message) Payload() map[string]any {
 	payload := map[string]any{
 		"id":         m.ID,
 		"channel_id": m.ChannelID,
@@ -27,8 +30,17 @@ func (m *Message) ToJSONStringPayload() (string, error) {
 		"content":    m.Content,
 		"created_at": m.CreatedAt.Format(time.RFC3339),
 	}
+	if m.System {
+		payload["system"] = true
+	}
+	if m.User.ID != 0 {
+		payload["author"] = m.User.Summary()
+	}
+	return payload
+}
 
-	jsonString, err := json.Marshal(payload)
+func (m *Message) ToJSONStringPayload() (string, error) {
+	jsonString, err := json.Marshal(m.Payload())
 	if err != nil {
 		return "", err
 	}
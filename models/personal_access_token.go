@@ -0,0 +1,47 @@
+package models
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PersonalAccessToken lets scripts call the API without a password or
+// session. Only the SHA-256 of the token is stored; Prefix is the start of
+// the token, kept so users can tell their tokens apart.
+type PersonalAccessToken struct {
+	ID         uint64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID     uint64     `gorm:"not null;index" json:"user_id"`
+	Name       string     `gorm:"size:64;not null" json:"name"`
+	Prefix     string     `gorm:"size:32;not null" json:"prefix"`
+	TokenHash  string     `gorm:"column:token_hash;size:64;not null;unique" json:"-"`
+	Scopes     string     `gorm:"size:255;not null" json:"-"`
+	ExpiresAt  *time.Time `gorm:"column:expires_at" json:"expires_at"`
+	LastUsedAt *time.Time `gorm:"column:last_used_at" json:"last_used_at"`
+	LastUsedIP string     `gorm:"column:last_used_ip;size:45" json:"last_used_ip,omitempty"`
+	CreatedAt  time.Time  `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+
+	ScopeList []string `gorm:"-" json:"scopes"`
+
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+}
+
+func (t *PersonalAccessToken) SetScopes(scopes []string) {
+	t.ScopeList = scopes
+	t.Scopes = strings.Join(scopes, " ")
+}
+
+func (t *PersonalAccessToken) HasScope(scope string) bool {
+	return slices.Contains(t.ScopeList, scope)
+}
+
+func (t *PersonalAccessToken) IsExpired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+func (t *PersonalAccessToken) AfterFind(tx *gorm.DB) error {
+	t.ScopeList = strings.Fields(t.Scopes)
+	return nil
+}
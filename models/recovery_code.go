@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+)
+
+// RecoveryCode lets a user past the second factor once, e.g. after losing
+// their authenticator. Only the SHA-256 of the code is stored.
+type RecoveryCode struct {
+	ID        uint64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID    uint64     `gorm:"not null;index" json:"user_id"`
+	CodeHash  string     `gorm:"column:code_hash;size:64;not null" json:"-"`
+	UsedAt    *time.Time `gorm:"column:used_at" json:"used_at,omitempty"`
+	CreatedAt time.Time  `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+}
@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+)
+
+// RefreshToken is one link in a chain of rotated refresh tokens. Every token
+// issued from the same login shares a FamilyID, which is the ID of that
+// login's Session; only the SHA-256 of the opaque token is stored.
+type RefreshToken struct {
+	ID        uint64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID    uint64     `gorm:"not null;index" json:"user_id"`
+	FamilyID  string     `gorm:"column:family_id;size:32;not null;index" json:"family_id"`
+	TokenHash string     `gorm:"column:token_hash;size:64;not null;unique" json:"-"`
+	ExpiresAt time.Time  `gorm:"column:expires_at;not null" json:"expires_at"`
+	UsedAt    *time.Time `gorm:"column:used_at" json:"used_at,omitempty"`
+	RevokedAt *time.Time `gorm:"column:revoked_at" json:"revoked_at,omitempty"`
+	CreatedAt time.Time  `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+}
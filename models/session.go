@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+)
+
+// Session is one login on one device. Its ID doubles as the family of the
+// refresh tokens rotated from that login and is embedded (as "sid") in every
+// access token issued for it.
+type Session struct {
+	ID         string     `gorm:"primaryKey;size:32" json:"id"`
+	UserID     uint64     `gorm:"not null;index" json:"user_id"`
+	Device     string     `gorm:"size:64" json:"device"`
+	IP         string     `gorm:"column:ip;size:45" json:"ip"`
+	UserAgent  string     `gorm:"column:user_agent;size:256" json:"user_agent"`
+	CreatedAt  time.Time  `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+	LastSeenAt time.Time  `gorm:"column:last_seen_at" json:"last_seen_at"`
+	ExpiresAt  time.Time  `gorm:"column:expires_at;not null" json:"expires_at"`
+	RevokedAt  *time.Time `gorm:"column:revoked_at" json:"-"`
+
+	Current bool `gorm:"-" json:"current"`
+
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+}
+
+func (s *Session) IsActive(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
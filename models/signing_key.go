@@ -0,0 +1,19 @@
+package models
+
+import (
+	"time"
+)
+
+// SigningKey is a key pair used to sign access tokens. A new key is
+// published ahead of ActivatesAt, from when on it signs; the key it replaces
+// is retired at the same moment and only verifies, until its grace period
+// runs out and it is deleted. A nil ActivatesAt means the key signed from
+// the start.
+type SigningKey struct {
+	ID          string     `gorm:"primaryKey;size:32" json:"kid"`
+	Algorithm   string     `gorm:"size:16;not null" json:"alg"`
+	PrivateKey  string     `gorm:"column:private_key;type:text;not null" json:"-"`
+	CreatedAt   time.Time  `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+	ActivatesAt *time.Time `gorm:"column:activates_at" json:"activates_at,omitempty"`
+	RetiredAt   *time.Time `gorm:"column:retired_at" json:"retired_at,omitempty"`
+}
@@ -1,14 +1,105 @@
 package models
 
 import (
+	"fmt"
 	"time"
 )
 
+// Messages of deleted accounts can be kept under a shared placeholder user.
+// Registration can't produce its username, and it can never log in.
+const (
+	DeletedUsername    = "[deleted]"
+	DeletedDisplayName = "Deleted user"
+)
+
 type User struct {
 	ID           uint64    `gorm:"primaryKey;autoIncrement" json:"id"`
 	Username     string    `gorm:"size:32;not null;unique" json:"username"`
-	PasswordHash string    `gorm:"column:password_hash;size:128;not null" json:"password_hash"`
+	PasswordHash string    `gorm:"column:password_hash;size:128;not null" json:"-"`
 	DisplayName  string    `gorm:"column:display_name;size:64;not null" json:"display_name"`
 	CreatedAt    time.Time `gorm:"column:created_at;autoCreateTime" json:"created_at"`
 	UpdatedAt    time.Time `gorm:"column:updated_at;autoUpdateTime" json:"updated_at"`
+
+	DisabledAt *time.Time `gorm:"column:disabled_at" json:"disabled_at,omitempty"`
+
+	// Admin is granted through the admin API, or at startup to the user IDs
+	// in ADMIN_USERS.
+	Admin bool `gorm:"not null;default:false" json:"-"`
+
+	// Email is optional and private to its owner; nil rather than "" so the
+	// unique index allows any number of users without one.
+	Email           *string    `gorm:"size:254;uniqueIndex" json:"-"`
+	EmailVerifiedAt *time.Time `gorm:"column:email_verified_at" json:"-"`
+
+	TOTPSecret    string     `gorm:"column:totp_secret;size:64" json:"-"`
+	TOTPEnabledAt *time.Time `gorm:"column:totp_enabled_at" json:"totp_enabled_at,omitempty"`
+
+	Bio      string `gorm:"size:256;not null;default:''" json:"bio"`
+	Pronouns string `gorm:"size:32;not null;default:''" json:"pronouns"`
+	Timezone string `gorm:"size:64;not null;default:''" json:"timezone"`
+
+	StatusText      string     `gorm:"column:status_text;size:128;not null;default:''" json:"status_text"`
+	StatusEmoji     string     `gorm:"column:status_emoji;size:32;not null;default:''" json:"status_emoji"`
+	StatusExpiresAt *time.Time `gorm:"column:status_expires_at" json:"status_expires_at,omitempty"`
+
+	AvatarUpdatedAt *time.Time `gorm:"column:avatar_updated_at" json:"-"`
+}
+
+func (u *User) TwoFactorEnabled() bool {
+	return u.TOTPEnabledAt != nil
+}
+
+func (u *User) EmailAddress() string {
+	if u.Email == nil {
+		return ""
+	}
+	return *u.Email
+}
+
+// EmailPending is true while the user has an address that hasn't been
+// verified yet.
+func (u *User) EmailPending() bool {
+	return u.Email != nil && u.EmailVerifiedAt == nil
+}
+
+// AvatarURL is empty for users without an avatar. The version parameter
+// changes with every upload, so the images can be cached for good.
+func (u *User) AvatarURL() string {
+	if u.AvatarUpdatedAt == nil {
+		return ""
+	}
+	return fmt.Sprintf("/users/%d/avatar?v=%d", u.ID, u.AvatarUpdatedAt.Unix())
+}
+
+// Profile is what other users get to see. An expired status is left out.
+func (u *User) Profile(now time.Time) map[string]any {
+	profile := map[string]any{
+		"id":           u.ID,
+		"username":     u.Username,
+		"display_name": u.DisplayName,
+		"bio":          u.Bio,
+		"pronouns":     u.Pronouns,
+		"timezone":     u.Timezone,
+		"avatar_url":   u.AvatarURL(),
+		"created_at":   u.CreatedAt.Format(time.RFC3339),
+	}
+	if u.DisabledAt != nil {
+		profile["deactivated"] = true
+	}
+	if (u.StatusText != "" || u.StatusEmoji != "") && (u.StatusExpiresAt == nil || now.Before(*u.StatusExpiresAt)) {
+		status := map[string]any{"text": u.StatusText, "emoji": u.StatusEmoji}
+		if u.StatusExpiresAt != nil {
+			status["expires_at"] = u.StatusExpiresAt.Format(time.RFC3339)
+		}
+		profile["status"] = status
+	}
+	return profile
+}
+
+func (u *User) Summary() map[string]any {
+	return map[string]any{
+		"id":           u.ID,
+		"username":     u.Username,
+		"display_name": u.DisplayName,
+	}
 }
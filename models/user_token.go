@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+)
+
+const (
+	TokenPasswordReset     = "password_reset"
+	TokenEmailVerification = "email_verification"
+)
+
+// UserToken is a single-use token mailed to a user. Only its SHA-256 is
+// stored. Email records the address a verification token was sent to, so
+// changing the address in the meantime invalidates it.
+type UserToken struct {
+	ID        uint64     `gorm:"primaryKey;autoIncrement" json:"id"`
+	UserID    uint64     `gorm:"not null;index" json:"user_id"`
+	Purpose   string     `gorm:"size:32;not null" json:"purpose"`
+	TokenHash string     `gorm:"column:token_hash;size:64;not null;unique" json:"-"`
+	Email     string     `gorm:"size:254" json:"email,omitempty"`
+	ExpiresAt time.Time  `gorm:"column:expires_at;not null" json:"expires_at"`
+	UsedAt    *time.Time `gorm:"column:used_at" json:"used_at,omitempty"`
+	CreatedAt time.Time  `gorm:"column:created_at;autoCreateTime" json:"created_at"`
+
+	User User `gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE" json:"-"`
+}
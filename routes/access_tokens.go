@@ -0,0 +1,91 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"github.com/rtk-rnjn/ping/routes/internals"
+	"gorm.io/gorm"
+)
+
+type CreateAccessTokenRequest struct {
+	Name          string   `json:"name" binding:"required"`
+	Scopes        []string `json:"scopes" binding:"required"`
+	ExpiresInDays int      `json:"expires_in_days,omitempty"`
+}
+
+func ListAccessTokensHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		tokens, err := controller.GetUserPersonalAccessTokens(db, user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list access tokens"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"tokens": tokens, "available_scopes": internals.AccessTokenScopes})
+	}
+}
+
+// CreateAccessTokenHandler returns the token in the response only; it can't
+// be retrieved later.
+func CreateAccessTokenHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		var req CreateAccessTokenRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Printf("[ERROR] CreateAccessTokenHandler: Invalid JSON: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.ExpiresInDays < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": internals.ErrAccessTokenExpiry.Error()})
+			return
+		}
+
+		expiresIn := time.Duration(req.ExpiresInDays) * 24 * time.Hour
+		raw, token, err := internals.CreatePersonalAccessToken(db, user.ID, req.Name, req.Scopes, expiresIn)
+		if err != nil {
+			if internals.IsAccessTokenRequestError(err) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("[ERROR] Failed to create access token for userID=%d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create access token"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"token": raw, "access_token": token})
+	}
+}
+
+func RevokeAccessTokenHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Access token not found"})
+			return
+		}
+
+		if err := controller.DeletePersonalAccessToken(db, user.ID, id); err != nil {
+			if errors.Is(err, controller.ErrAccessTokenNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Access token not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke access token"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Access token revoked"})
+	}
+}
@@ -0,0 +1,205 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"github.com/rtk-rnjn/ping/routes/internals"
+	"gorm.io/gorm"
+)
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type SetEmailRequest struct {
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+func accountError(c *gin.Context, err error, action string) {
+	var throttled *internals.LoginThrottledError
+	switch {
+	case errors.As(err, &throttled):
+		tooManyAttempts(c, throttled)
+	case internals.IsAccountRequestError(err):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, internals.ErrWrongPassword),
+		errors.Is(err, internals.ErrReauthRequired):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, controller.ErrUserTokenInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, controller.ErrEmailTaken),
+		errors.Is(err, internals.ErrNothingToVerify),
+		errors.Is(err, internals.ErrVerificationIsOff):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, internals.ErrExportPending),
+		errors.Is(err, internals.ErrExportNotReady):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, controller.ErrExportNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, internals.ErrMailRateLimited),
+		errors.Is(err, internals.ErrExportTooSoon):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+	default:
+		log.Printf("[ERROR] Failed to %s: %v", action, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to " + action})
+	}
+}
+
+// --- Password ---
+
+// ChangePasswordHandler keeps the calling session and signs out the rest.
+func ChangePasswordHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		var req ChangePasswordRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Printf("[ERROR] ChangePasswordHandler: Invalid JSON: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		err := internals.ChangePassword(db, user.ID, c.GetString("session_id"), req.CurrentPassword, req.NewPassword, internals.NewClientInfo(c, ""))
+		if err != nil {
+			accountError(c, err, "change password")
+			return
+		}
+
+		log.Printf("[INFO] UserID=%d changed their password", user.ID)
+		c.JSON(http.StatusOK, gin.H{"message": "Password changed, other sessions were signed out"})
+	}
+}
+
+// ForgotPasswordHandler answers the same way whether or not the address is
+// known.
+func ForgotPasswordHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ForgotPasswordRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Printf("[ERROR] ForgotPasswordHandler: Invalid JSON: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := internals.RequestPasswordReset(db, req.Email, internals.NewClientInfo(c, "")); err != nil {
+			accountError(c, err, "request a password reset")
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"message": "If an account uses that address, a reset link is on its way"})
+	}
+}
+
+func ResetPasswordHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req ResetPasswordRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Printf("[ERROR] ResetPasswordHandler: Invalid JSON: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := internals.ResetPassword(db, req.Token, req.Password, internals.NewClientInfo(c, "")); err != nil {
+			accountError(c, err, "reset password")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Password reset, log in with the new password"})
+	}
+}
+
+// --- Email ---
+
+func GetEmailHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		var current models.User
+		if err := db.First(&current, user.ID).Error; err != nil {
+			log.Printf("[ERROR] Failed to load userID=%d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load email address"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"email":       current.Email,
+			"verified":    current.Email != nil && !current.EmailPending(),
+			"verified_at": current.EmailVerifiedAt,
+		})
+	}
+}
+
+func SetEmailHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		var req SetEmailRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Printf("[ERROR] SetEmailHandler: Invalid JSON: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		updated, err := internals.SetEmail(db, user.ID, req.Email, req.Password, internals.NewClientInfo(c, ""))
+		if err != nil {
+			accountError(c, err, "change email address")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"email":    updated.Email,
+			"verified": !updated.EmailPending(),
+		})
+	}
+}
+
+func ResendVerificationHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		if err := internals.ResendVerificationMail(db, user.ID); err != nil {
+			accountError(c, err, "send verification mail")
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{"message": "Verification mail sent"})
+	}
+}
+
+func VerifyEmailHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req VerifyEmailRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Printf("[ERROR] VerifyEmailHandler: Invalid JSON: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := internals.VerifyEmail(db, req.Token, internals.NewClientInfo(c, "")); err != nil {
+			accountError(c, err, "verify email address")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Email address verified"})
+	}
+}
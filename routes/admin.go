@@ -0,0 +1,279 @@
+package routes
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"github.com/rtk-rnjn/ping/routes/internals"
+	"gorm.io/gorm"
+)
+
+type CreateInviteRequest struct {
+	MaxUses       int    `json:"max_uses,omitempty"`
+	ExpiresInDays *int   `json:"expires_in_days,omitempty"`
+	Note          string `json:"note,omitempty"`
+}
+
+// --- Invites ---
+
+func ListInvitesHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		invites, err := controller.GetInvites(db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list invites"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"invites": invites, "registration_mode": internals.RegistrationMode()})
+	}
+}
+
+// CreateInviteHandler defaults to a single-use code that expires in a week;
+// expires_in_days of 0 makes one that never expires.
+func CreateInviteHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		var req CreateInviteRequest
+		// every field is optional, so an empty body is fine
+		if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+			log.Printf("[ERROR] CreateInviteHandler: Invalid JSON: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if req.MaxUses == 0 {
+			req.MaxUses = 1
+		}
+		expiresIn := internals.DefaultInviteLife
+		if req.ExpiresInDays != nil {
+			expiresIn = time.Duration(*req.ExpiresInDays) * 24 * time.Hour
+		}
+
+		code, invite, err := internals.CreateInvite(db, user, req.MaxUses, expiresIn, req.Note, internals.NewClientInfo(c, ""))
+		if err != nil {
+			if internals.IsInviteRequestError(err) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("[ERROR] Failed to create invite for userID=%d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create invite"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{"code": code, "invite": invite})
+	}
+}
+
+func DeleteInviteHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found"})
+			return
+		}
+
+		if err := controller.DeleteInvite(db, id); err != nil {
+			if errors.Is(err, controller.ErrInviteNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found"})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete invite"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Invite deleted"})
+	}
+}
+
+type SetAdminRequest struct {
+	Admin *bool `json:"admin" binding:"required"`
+}
+
+func adminError(c *gin.Context, err error, action string) {
+	switch {
+	case internals.IsAdminRequestError(err):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, internals.ErrBootstrapAdmin):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, controller.ErrUserNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	case errors.Is(err, controller.ErrChannelNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
+	case errors.Is(err, controller.ErrMessageNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+	default:
+		log.Printf("[ERROR] Failed to %s: %v", action, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to " + action})
+	}
+}
+
+// --- Users ---
+
+// AdminListUsersHandler serves GET /admin/users?q=ali&status=disabled&limit=50&offset=0.
+func AdminListUsersHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(internals.DefaultUserListLimit)))
+		if err != nil {
+			limit = -1
+		}
+		offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if err != nil {
+			offset = -1
+		}
+
+		users, total, err := internals.ListUsers(db, c.Query("q"), c.Query("status"), limit, offset)
+		if err != nil {
+			adminError(c, err, "list users")
+			return
+		}
+
+		response := gin.H{"users": users, "total": total, "next_offset": nil}
+		if next := offset + len(users); int64(next) < total {
+			response["next_offset"] = next
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+func AdminGetUserHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := userIDParam(c)
+		if !ok {
+			return
+		}
+
+		user, err := controller.GetUserProfile(db, id)
+		if err != nil {
+			adminError(c, err, "get user")
+			return
+		}
+
+		c.JSON(http.StatusOK, internals.AdminUserView(user))
+	}
+}
+
+func AdminSetUserDisabledHandler(db *gorm.DB, disabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		admin := c.MustGet("user").(*models.User)
+		id, ok := userIDParam(c)
+		if !ok {
+			return
+		}
+
+		user, err := internals.SetUserDisabled(db, admin, id, disabled, internals.NewClientInfo(c, ""))
+		if err != nil {
+			adminError(c, err, "update user")
+			return
+		}
+
+		c.JSON(http.StatusOK, internals.AdminUserView(user))
+	}
+}
+
+func AdminSetAdminHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		admin := c.MustGet("user").(*models.User)
+		id, ok := userIDParam(c)
+		if !ok {
+			return
+		}
+
+		var req SetAdminRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Printf("[ERROR] AdminSetAdminHandler: Invalid JSON: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := internals.SetAdmin(db, admin, id, *req.Admin, internals.NewClientInfo(c, ""))
+		if err != nil {
+			adminError(c, err, "update user")
+			return
+		}
+
+		c.JSON(http.StatusOK, internals.AdminUserView(user))
+	}
+}
+
+// AdminResetPasswordHandler only answers with the reset token when there is
+// no address to mail it to.
+func AdminResetPasswordHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		admin := c.MustGet("user").(*models.User)
+		id, ok := userIDParam(c)
+		if !ok {
+			return
+		}
+
+		token, err := internals.ForcePasswordReset(db, admin, id, internals.NewClientInfo(c, ""))
+		if err != nil {
+			adminError(c, err, "reset password")
+			return
+		}
+
+		if token != "" {
+			c.JSON(http.StatusOK, gin.H{"message": "Password reset, the user has no email address", "token": token})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Password reset, a link was mailed to the user"})
+	}
+}
+
+// --- Channels and Messages ---
+
+func AdminDeleteChannelHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		admin := c.MustGet("user").(*models.User)
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
+			return
+		}
+
+		if err := internals.DeleteChannel(db, admin, id, internals.NewClientInfo(c, "")); err != nil {
+			adminError(c, err, "delete channel")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Channel deleted"})
+	}
+}
+
+func AdminDeleteMessageHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		admin := c.MustGet("user").(*models.User)
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Message not found"})
+			return
+		}
+
+		if err := internals.DeleteMessage(db, admin, id, internals.NewClientInfo(c, "")); err != nil {
+			adminError(c, err, "delete message")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Message deleted"})
+	}
+}
+
+// --- Statistics ---
+
+func AdminStatsHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		stats, err := controller.GetInstanceStats(db)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to gather statistics"})
+			return
+		}
+
+		c.JSON(http.StatusOK, stats)
+	}
+}
@@ -1,12 +1,16 @@
 package routes
 
 import (
+	"errors"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 
+	"github.com/rtk-rnjn/ping/controller"
 	"github.com/rtk-rnjn/ping/routes/internals"
 )
 
@@ -14,10 +18,102 @@ type AuthRequest struct {
 	Username    string `json:"username"`
 	Password    string `json:"password"`
 	DisplayName string `json:"display_name,omitempty"`
+	Email       string `json:"email,omitempty"`
+	InviteCode  string `json:"invite_code,omitempty"`
+	DeviceName  string `json:"device_name,omitempty"`
+
+	ProofOfWork *internals.ProofOfWork `json:"proof_of_work,omitempty"`
 }
 
 type TokenResponse struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+type ChallengeResponse struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+	ExpiresIn         int64  `json:"expires_in"`
+}
+
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code" binding:"required"`
+	DeviceName     string `json:"device_name,omitempty"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+func newTokenResponse(tokens *internals.TokenPair) TokenResponse {
+	return TokenResponse{
+		Token:        tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    int64(tokens.ExpiresIn.Seconds()),
+	}
+}
+
+func tooManyAttempts(c *gin.Context, throttled *internals.LoginThrottledError) {
+	seconds := int64(math.Ceil(throttled.RetryAfter.Seconds()))
+	c.Header("Retry-After", strconv.FormatInt(seconds, 10))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":       "Too many login attempts, try again later",
+		"retry_after": seconds,
+	})
+}
+
+// checkProofOfWork answers a missing or bad solution with a fresh challenge,
+// so the client can solve it and retry straight away.
+func checkProofOfWork(c *gin.Context, purpose string, proof *internals.ProofOfWork) bool {
+	err := internals.CheckProofOfWork(purpose, proof)
+	if err == nil {
+		return true
+	}
+	if !internals.IsProofOfWorkRejection(err) {
+		log.Printf("[ERROR] Failed to check proof of work: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check proof of work"})
+		return false
+	}
+	rejectProofOfWork(c, purpose, err)
+	return false
+}
+
+func rejectProofOfWork(c *gin.Context, purpose string, err error) {
+	log.Printf("[WARN] Proof of work for %s rejected from %s: %v", purpose, c.ClientIP(), err)
+	body := gin.H{"error": err.Error(), "proof_of_work_required": true}
+	if challenge, err := internals.NewProofOfWorkChallenge(purpose); err == nil {
+		body["proof_of_work"] = challenge
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusBadRequest, body)
+}
+
+// ProofOfWorkHandler issues a challenge to solve before registering or
+// logging in.
+func ProofOfWorkHandler(c *gin.Context) {
+	purpose := c.DefaultQuery("purpose", internals.PurposeRegister)
+	challenge, err := internals.NewProofOfWorkChallenge(purpose)
+	if errors.Is(err, internals.ErrUnknownPurpose) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] Failed to issue proof-of-work challenge: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue challenge"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, gin.H{
+		"challenge":  challenge.Challenge,
+		"algorithm":  challenge.Algorithm,
+		"difficulty": challenge.Difficulty,
+		"expires_in": challenge.ExpiresIn,
+		"purpose":    purpose,
+		"required":   internals.ProofOfWorkRequired(purpose),
+	})
 }
 
 func RegisterHandler(db *gorm.DB) gin.HandlerFunc {
@@ -30,19 +126,58 @@ func RegisterHandler(db *gorm.DB) gin.HandlerFunc {
 		}
 
 		log.Printf("[INFO] Attempting to register user: username='%s'", req.Username)
-
-		token, err := internals.RegisterUser(db, req.Username, req.Password, req.DisplayName)
+		tokens, err := internals.RegisterUser(db, internals.Registration{
+			Username:    req.Username,
+			Password:    req.Password,
+			DisplayName: req.DisplayName,
+			Email:       req.Email,
+			InviteCode:  req.InviteCode,
+			ProofOfWork: req.ProofOfWork,
+		}, internals.NewClientInfo(c, req.DeviceName))
 		if err != nil {
-			log.Printf("[ERROR] Failed to register user '%s': %v", req.Username, err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Registration failed"})
+			var invalid *internals.ValidationError
+			switch {
+			case errors.As(err, &invalid):
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid registration", "fields": invalid.Fields})
+			case internals.IsProofOfWorkRejection(err):
+				rejectProofOfWork(c, internals.PurposeRegister, err)
+			case errors.Is(err, internals.ErrRegistrationClosed),
+				errors.Is(err, internals.ErrInviteRequired):
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error(), "registration_mode": internals.RegistrationMode()})
+			case errors.Is(err, internals.ErrUsernameTaken):
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "fields": gin.H{"username": err.Error()}})
+			case errors.Is(err, controller.ErrEmailTaken):
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "fields": gin.H{"email": err.Error()}})
+			default:
+				log.Printf("[ERROR] Failed to register user '%s': %v", req.Username, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Registration failed"})
+			}
+			return
+		}
+		if tokens == nil {
+			log.Printf("[INFO] User registered, waiting for email verification: username='%s'", req.Username)
+			c.JSON(http.StatusCreated, gin.H{
+				"message":                     "Check your email to verify your address, then log in",
+				"email_verification_required": true,
+			})
 			return
 		}
 
 		log.Printf("[INFO] User registered successfully: username='%s'", req.Username)
-		c.JSON(http.StatusOK, TokenResponse{Token: token})
+		c.JSON(http.StatusOK, newTokenResponse(tokens))
 	}
 }
 
+// RegistrationInfoHandler tells clients which sign-up form to show.
+func RegistrationInfoHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"mode":               internals.RegistrationMode(),
+		"email_verification": internals.EmailVerificationMode(),
+		"sso_enabled":        internals.SSOEnabled(),
+		"proof_of_work":      internals.ProofOfWorkRequired(internals.PurposeRegister),
+	})
+}
+
 func LoginHandler(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req AuthRequest
@@ -53,15 +188,122 @@ func LoginHandler(db *gorm.DB) gin.HandlerFunc {
 		}
 
 		log.Printf("[INFO] Attempting login for user: username='%s'", req.Username)
+		if !checkProofOfWork(c, internals.PurposeLogin, req.ProofOfWork) {
+			return
+		}
 
-		token, err := internals.LoginUser(db, req.Username, req.Password)
+		tokens, challenge, err := internals.LoginUser(db, req.Username, req.Password, internals.NewClientInfo(c, req.DeviceName))
+		var throttled *internals.LoginThrottledError
+		if errors.As(err, &throttled) {
+			tooManyAttempts(c, throttled)
+			return
+		}
+		if errors.Is(err, internals.ErrEmailNotVerified) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Verify your email address before logging in"})
+			return
+		}
 		if err != nil {
 			log.Printf("[WARN] Login failed for user '%s': %v", req.Username, err)
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 			return
 		}
+		if challenge != nil {
+			log.Printf("[INFO] Second factor required for user: username='%s'", req.Username)
+			c.JSON(http.StatusOK, ChallengeResponse{
+				TwoFactorRequired: true,
+				ChallengeToken:    challenge.Token,
+				ExpiresIn:         int64(challenge.ExpiresIn.Seconds()),
+			})
+			return
+		}
 
 		log.Printf("[INFO] User logged in successfully: username='%s'", req.Username)
-		c.JSON(http.StatusOK, TokenResponse{Token: token})
+		c.JSON(http.StatusOK, newTokenResponse(tokens))
 	}
 }
+
+func TwoFactorLoginHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req TwoFactorLoginRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Printf("[ERROR] TwoFactorLoginHandler: Invalid JSON: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		tokens, err := internals.CompleteTwoFactorLogin(db, req.ChallengeToken, req.Code, internals.NewClientInfo(c, req.DeviceName))
+		var throttled *internals.LoginThrottledError
+		if errors.As(err, &throttled) {
+			tooManyAttempts(c, throttled)
+			return
+		}
+		if err != nil {
+			if internals.IsTwoFactorRejection(err) {
+				log.Printf("[WARN] Second factor rejected: %v", err)
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code or expired challenge"})
+				return
+			}
+			log.Printf("[ERROR] Failed to complete two-factor login: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Login failed"})
+			return
+		}
+
+		c.JSON(http.StatusOK, newTokenResponse(tokens))
+	}
+}
+
+func RefreshHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req RefreshRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Printf("[ERROR] RefreshHandler: Invalid JSON: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		tokens, err := internals.RefreshTokens(db, req.RefreshToken, internals.NewClientInfo(c, ""))
+		if err != nil {
+			if internals.IsInvalidRefreshToken(err) {
+				log.Printf("[WARN] Refresh rejected: %v", err)
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token"})
+				return
+			}
+			log.Printf("[ERROR] Failed to refresh tokens: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh tokens"})
+			return
+		}
+
+		c.JSON(http.StatusOK, newTokenResponse(tokens))
+	}
+}
+
+func LogoutHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req RefreshRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Printf("[ERROR] LogoutHandler: Invalid JSON: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := internals.Logout(db, req.RefreshToken); err != nil {
+			if internals.IsInvalidRefreshToken(err) {
+				log.Printf("[WARN] Logout with unknown refresh token")
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+				return
+			}
+			log.Printf("[ERROR] Failed to log out: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
+	}
+}
+
+func JWKSHandler(c *gin.Context) {
+	// a new key is published for longer than this before it signs, so a
+	// verifier refetching on expiry never meets a kid it doesn't know
+	c.Header("Cache-Control", "public, max-age="+strconv.Itoa(int(internals.JWKSMaxAge.Seconds())))
+	c.JSON(http.StatusOK, internals.JWKS())
+}
@@ -0,0 +1,83 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"github.com/rtk-rnjn/ping/routes/internals"
+	"gorm.io/gorm"
+)
+
+type BlockRequest struct {
+	UserID uint64 `json:"user_id" binding:"required"`
+}
+
+func ListBlocksHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		blocked, err := internals.BlockedUsers(db, user)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list blocked users"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"blocked": blocked})
+	}
+}
+
+func BlockUserHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		var req BlockRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Printf("[ERROR] BlockUserHandler: Invalid JSON: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		created, err := internals.BlockUser(db, user, req.UserID)
+		switch {
+		case errors.Is(err, internals.ErrBlockSelf),
+			errors.Is(err, internals.ErrTooManyBlocks):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, controller.ErrUserNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		case err != nil:
+			log.Printf("[ERROR] Failed to block userID=%d for userID=%d: %v", req.UserID, user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to block user"})
+		case created:
+			c.JSON(http.StatusCreated, gin.H{"message": "User blocked"})
+		default:
+			c.JSON(http.StatusOK, gin.H{"message": "User was already blocked"})
+		}
+	}
+}
+
+func UnblockUserHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		id, ok := userIDParam(c)
+		if !ok {
+			return
+		}
+
+		err := controller.UnblockUser(db, user.ID, id)
+		if errors.Is(err, controller.ErrBlockNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unblock user"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "User unblocked"})
+	}
+}
@@ -0,0 +1,117 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+)
+
+const (
+	frameCallStart  = "call.start"
+	frameCallAccept = "call.accept"
+	frameCallReject = "call.reject"
+	frameCallLeave  = "call.leave"
+	frameCallOffer  = "call.offer"
+	frameCallAnswer = "call.answer"
+	frameCallICE    = "call.ice"
+)
+
+var errCallsNotAllowed = errors.New("token lacks the calls scope")
+
+// ClientFrame is what clients send over the WebSocket, in the negotiated
+// encoding. Data carries the SDP or ICE candidate and is relayed verbatim.
+type ClientFrame struct {
+	Type     string `json:"type"`
+	CallID   string `json:"call_id,omitempty"`
+	ToUserID uint64 `json:"to_user_id,omitempty"`
+	Media    string `json:"media,omitempty"`
+	Data     any    `json:"data,omitempty"`
+}
+
+// callSession remembers the calls joined through one connection so that
+// they can be left when the connection goes away.
+type callSession struct {
+	db        *gorm.DB
+	user      *models.User
+	channelID uint64
+	calls     map[string]struct{}
+
+	// false for connections made with an access token without the calls scope
+	allowed bool
+}
+
+func newCallSession(db *gorm.DB, user *models.User, channelID uint64, allowed bool) *callSession {
+	return &callSession{
+		db:        db,
+		user:      user,
+		channelID: channelID,
+		calls:     make(map[string]struct{}),
+		allowed:   allowed,
+	}
+}
+
+func (s *callSession) handle(frame *ClientFrame) error {
+	if !s.allowed && strings.HasPrefix(frame.Type, "call.") {
+		return errCallsNotAllowed
+	}
+
+	switch frame.Type {
+	case frameCallStart:
+		call, err := controller.StartCall(s.db, s.channelID, s.user, frame.ToUserID, frame.Media)
+		if err != nil {
+			return err
+		}
+		s.calls[call.ID] = struct{}{}
+
+	case frameCallAccept:
+		call, err := controller.AcceptCall(s.db, frame.CallID, s.channelID, s.user)
+		if err != nil {
+			return err
+		}
+		s.calls[call.ID] = struct{}{}
+
+	case frameCallReject:
+		return controller.RejectCall(s.db, frame.CallID, s.channelID, s.user)
+
+	case frameCallLeave:
+		if _, ok := s.calls[frame.CallID]; !ok {
+			return controller.ErrCallNotFound
+		}
+		delete(s.calls, frame.CallID)
+		return controller.LeaveCall(s.db, frame.CallID, s.user.ID)
+
+	case frameCallOffer, frameCallAnswer, frameCallICE:
+		signal := strings.TrimPrefix(frame.Type, "call.")
+		return controller.RelaySignal(s.db, frame.CallID, s.channelID, s.user, frame.ToUserID, signal, frame.Data)
+
+	default:
+		return fmt.Errorf("unknown frame type %q", frame.Type)
+	}
+	return nil
+}
+
+func (s *callSession) leaveAll() {
+	for callID := range s.calls {
+		if err := controller.LeaveCall(s.db, callID, s.user.ID); err != nil {
+			log.Printf("[WARN] Failed to leave call %s for user %d on disconnect: %v", callID, s.user.ID, err)
+		}
+	}
+}
+
+func frameError(err error) string {
+	for _, known := range []error{controller.ErrCallNotFound, controller.ErrCallEnded, controller.ErrCallForbidden, controller.ErrInvalidCall, errCallsNotAllowed} {
+		if errors.Is(err, known) {
+			return err.Error()
+		}
+	}
+	if strings.HasPrefix(err.Error(), "unknown frame type") {
+		return err.Error()
+	}
+	return "internal error"
+}
@@ -102,6 +102,63 @@ func GetChannelUsersHandler(db *gorm.DB) gin.HandlerFunc {
 	}
 }
 
+func UpdateChannelHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, exists := c.Get("user")
+		if !exists {
+			log.Println("[WARN] Unauthorized attempt to update channel")
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+			return
+		}
+
+		var req struct {
+			ChannelID   uint64  `json:"channel_id"`
+			Name        *string `json:"name"`
+			Description *string `json:"description"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Printf("[ERROR] UpdateChannelHandler: Invalid JSON: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		updates := map[string]any{}
+		if req.Name != nil {
+			updates["name"] = *req.Name
+		}
+		if req.Description != nil {
+			updates["description"] = *req.Description
+		}
+		if len(updates) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Nothing to update"})
+			return
+		}
+
+		member, err := controller.IsUserInChannel(db, user.(*models.User).ID, req.ChannelID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check channel membership"})
+			return
+		}
+		if !member {
+			log.Printf("[WARN] UserID=%d tried to update ChannelID=%d without being a member", user.(*models.User).ID, req.ChannelID)
+			c.JSON(http.StatusForbidden, gin.H{"error": "You are not a member of this channel"})
+			return
+		}
+
+		log.Printf("[INFO] UserID=%d updating ChannelID=%d", user.(*models.User).ID, req.ChannelID)
+
+		channel, err := controller.UpdateChannel(db, req.ChannelID, updates)
+		if err != nil {
+			log.Printf("[ERROR] Failed to update channel: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update channel"})
+			return
+		}
+
+		log.Printf("[INFO] ChannelID=%d updated successfully by UserID=%d", channel.ID, user.(*models.User).ID)
+		c.JSON(http.StatusOK, channel)
+	}
+}
+
 func CreateChannelHandler(db *gorm.DB) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var req struct {
@@ -0,0 +1,245 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+)
+
+const (
+	eventReplayLimit = 256
+	sseKeepAlive     = 15 * time.Second
+	longPollTimeout  = 25 * time.Second
+)
+
+type PollResponse struct {
+	Events      []*models.Event `json:"events"`
+	LastEventID uint64          `json:"last_event_id"`
+}
+
+func ChannelEventStreamHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		channelID, err := extractChannelID(c)
+		if err != nil {
+			return
+		}
+
+		if !verifyUserMembership(c, channelID) {
+			return
+		}
+
+		lastID, err := extractLastEventID(c)
+		if err != nil {
+			return
+		}
+
+		sub, err := subscribeChannel(c, channelID)
+		if err != nil {
+			return
+		}
+		defer closeSubscription(sub, channelID)
+
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
+
+		missed, err := replayEvents(sub, lastID)
+		if err != nil {
+			log.Printf("[WARN] Could not replay events after seq=%d (channelID=%d): %v", lastID, channelID, err)
+		}
+		replayed := make(map[uint64]struct{}, len(missed))
+		for _, event := range missed {
+			if err := writeSSEvent(c.Writer, event); err != nil {
+				return
+			}
+			replayed[event.Seq] = struct{}{}
+		}
+		c.Writer.Flush()
+
+		log.Printf("[INFO] SSE stream established for channelID=%d (resuming after seq=%d)", channelID, lastID)
+
+		keepAlive := time.NewTicker(sseKeepAlive)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-c.Request.Context().Done():
+				log.Printf("[INFO] SSE client disconnected (channelID=%d)", channelID)
+				return
+
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(c.Writer, ": keepalive\n\n"); err != nil {
+					log.Printf("[ERROR] Failed to write SSE keepalive (channelID=%d): %v", channelID, err)
+					return
+				}
+				c.Writer.Flush()
+
+			case event, ok := <-sub.Events():
+				if !ok {
+					if reason := sub.Revoked(); reason != "" {
+						log.Printf("[INFO] Ending SSE stream for channelID=%d: %s", channelID, reason)
+						fmt.Fprintf(c.Writer, "event: revoked\ndata: {\"reason\":%q}\n\n", reason)
+						c.Writer.Flush()
+					}
+					return
+				}
+
+				if _, ok := replayed[event.Seq]; ok {
+					continue
+				}
+
+				if err := writeSSEvent(c.Writer, event); err != nil {
+					return
+				}
+				log.Printf("[DEBUG] Sent SSE event to client (channelID=%d): seq=%d", channelID, event.Seq)
+			}
+		}
+	}
+}
+
+func ChannelEventPollHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		channelID, err := extractChannelID(c)
+		if err != nil {
+			return
+		}
+
+		if !verifyUserMembership(c, channelID) {
+			return
+		}
+
+		lastID, err := extractLastEventID(c)
+		if err != nil {
+			return
+		}
+
+		sub, err := subscribeChannel(c, channelID)
+		if err != nil {
+			return
+		}
+		defer closeSubscription(sub, channelID)
+
+		events, err := replayEvents(sub, lastID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch events"})
+			return
+		}
+
+		replayed := make(map[uint64]struct{}, len(events))
+		for _, event := range events {
+			replayed[event.Seq] = struct{}{}
+		}
+
+		if len(events) == 0 {
+			timeout := time.NewTimer(longPollTimeout)
+			defer timeout.Stop()
+
+		wait:
+			for {
+				select {
+				case <-c.Request.Context().Done():
+					log.Printf("[INFO] Long-poll client disconnected (channelID=%d)", channelID)
+					return
+
+				case <-timeout.C:
+					break wait
+
+				case event, ok := <-sub.Events():
+					if !ok {
+						break wait
+					}
+
+					if _, ok := replayed[event.Seq]; ok {
+						continue
+					}
+					events = append(events, event)
+					break wait
+				}
+			}
+		}
+
+		if reason := sub.Revoked(); reason != "" {
+			log.Printf("[INFO] Ending long-poll for channelID=%d: %s", channelID, reason)
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access revoked", "reason": reason})
+			return
+		}
+
+		for _, event := range events {
+			lastID = max(lastID, event.Seq)
+		}
+
+		log.Printf("[INFO] Long-poll returning %d events for channelID=%d", len(events), channelID)
+		c.JSON(http.StatusOK, PollResponse{Events: events, LastEventID: lastID})
+	}
+}
+
+func extractLastEventID(c *gin.Context) (uint64, error) {
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	if lastEventID == "" {
+		return 0, nil
+	}
+
+	lastID, err := strconv.ParseUint(lastEventID, 10, 64)
+	if err != nil {
+		log.Printf("[ERROR] Invalid Last-Event-ID format: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Last-Event-ID"})
+		return 0, err
+	}
+
+	return lastID, nil
+}
+
+// replayEvents returns what the viewer missed, as they get to see it.
+func replayEvents(sub *controller.Subscription, afterID uint64) ([]*models.Event, error) {
+	if afterID == 0 {
+		return []*models.Event{}, nil
+	}
+	events, err := controller.ReplayEvents(sub.ChannelID, afterID, eventReplayLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	visible := events[:0]
+	for _, event := range events {
+		if event = sub.Visible(event); event != nil {
+			visible = append(visible, event)
+		}
+	}
+	return visible, nil
+}
+
+func writeSSEvent(w gin.ResponseWriter, event *models.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[ERROR] Failed to marshal SSE event (channelID=%d): %v", event.ChannelID, err)
+		return err
+	}
+
+	// ephemeral events carry no seq and must not move the client's cursor
+	if event.Seq != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", event.Seq); err != nil {
+			log.Printf("[ERROR] Failed to write SSE event (channelID=%d): %v", event.ChannelID, err)
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+		log.Printf("[ERROR] Failed to write SSE event (channelID=%d): %v", event.ChannelID, err)
+		return err
+	}
+	w.Flush()
+	return nil
+}
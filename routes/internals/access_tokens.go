@@ -0,0 +1,204 @@
+package internals
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+// Tokens look like ping_pat_<43 url-safe characters>; the marker keeps them
+// apart from JWTs and makes leaked ones easy to scan for.
+const (
+	accessTokenMarker  = "ping_pat_"
+	accessTokenPrefix  = 8
+	maxAccessTokens    = 50
+	maxAccessTokenName = 64
+	maxAccessTokenLife = 366 * 24 * time.Hour
+	tokenScopesKey     = "token_scopes"
+	accessTokenIDKey   = "access_token_id"
+)
+
+const (
+	ScopeChannelsRead  = "channels:read"
+	ScopeChannelsWrite = "channels:write"
+	ScopeMessagesRead  = "messages:read"
+	ScopeMessagesWrite = "messages:write"
+	ScopeCalls         = "calls"
+	ScopeUsersRead     = "users:read"
+)
+
+// AccessTokenScopes lists every scope a token can be given.
+var AccessTokenScopes = []string{
+	ScopeChannelsRead,
+	ScopeChannelsWrite,
+	ScopeMessagesRead,
+	ScopeMessagesWrite,
+	ScopeCalls,
+	ScopeUsersRead,
+}
+
+var (
+	ErrTooManyAccessTokens = fmt.Errorf("at most %d access tokens per user", maxAccessTokens)
+	ErrAccessTokenName     = fmt.Errorf("name must be 1-%d characters", maxAccessTokenName)
+	ErrNoScopes            = errors.New("at least one scope is required")
+	ErrUnknownScope        = errors.New("unknown scope")
+	ErrAccessTokenExpiry   = fmt.Errorf("expiry must be in the future and at most %d days away", int(maxAccessTokenLife.Hours()/24))
+)
+
+// --- Personal Access Tokens ---
+
+func IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, accessTokenMarker)
+}
+
+func normalizeScopes(scopes []string) ([]string, error) {
+	normalized := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if !slices.Contains(AccessTokenScopes, scope) {
+			return nil, fmt.Errorf("%w %q", ErrUnknownScope, scope)
+		}
+		if !slices.Contains(normalized, scope) {
+			normalized = append(normalized, scope)
+		}
+	}
+	if len(normalized) == 0 {
+		return nil, ErrNoScopes
+	}
+	slices.Sort(normalized)
+	return normalized, nil
+}
+
+// CreatePersonalAccessToken returns the token itself, which is never shown
+// again, and its stored record. expiresIn of zero means it never expires.
+func CreatePersonalAccessToken(db *gorm.DB, userID uint64, name string, scopes []string, expiresIn time.Duration) (string, *models.PersonalAccessToken, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || utf8.RuneCountInString(name) > maxAccessTokenName {
+		return "", nil, ErrAccessTokenName
+	}
+	scopes, err := normalizeScopes(scopes)
+	if err != nil {
+		return "", nil, err
+	}
+	if expiresIn < 0 || expiresIn > maxAccessTokenLife {
+		return "", nil, ErrAccessTokenExpiry
+	}
+
+	count, err := controller.CountPersonalAccessTokens(db, userID)
+	if err != nil {
+		return "", nil, err
+	}
+	if count >= maxAccessTokens {
+		return "", nil, ErrTooManyAccessTokens
+	}
+
+	secret, err := randomToken(32)
+	if err != nil {
+		return "", nil, err
+	}
+	raw := accessTokenMarker + secret
+
+	token := &models.PersonalAccessToken{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    raw[:len(accessTokenMarker)+accessTokenPrefix],
+		TokenHash: hashToken(raw),
+	}
+	token.SetScopes(scopes)
+	if expiresIn > 0 {
+		expiresAt := time.Now().Add(expiresIn)
+		token.ExpiresAt = &expiresAt
+	}
+	if err := controller.CreatePersonalAccessToken(db, token); err != nil {
+		return "", nil, err
+	}
+	return raw, token, nil
+}
+
+func ValidatePersonalAccessToken(db *gorm.DB, raw string) (*models.User, *models.PersonalAccessToken, error) {
+	token, err := controller.GetPersonalAccessTokenByHash(db, hashToken(raw))
+	if err != nil {
+		log.Printf("[WARN] Unknown personal access token %.13s...", raw)
+		return nil, nil, fmt.Errorf("invalid token")
+	}
+	if token.IsExpired(time.Now()) {
+		log.Printf("[WARN] Expired personal access token ID=%d", token.ID)
+		return nil, nil, fmt.Errorf("token expired")
+	}
+
+	user, err := controller.GetUserByID(db, token.UserID)
+	if err != nil {
+		log.Printf("[ERROR] User not found for access token ID=%d: %v", token.ID, err)
+		return nil, nil, fmt.Errorf("user not found")
+	}
+	if user.DisabledAt != nil {
+		log.Printf("[WARN] Rejecting access token ID=%d of disabled userID=%d", token.ID, user.ID)
+		return nil, nil, fmt.Errorf("account disabled")
+	}
+	return user, token, nil
+}
+
+// --- Scopes ---
+
+// TokenScopes returns the scopes of the access token behind the request.
+// ok is false for session (JWT) requests, which may do anything.
+func TokenScopes(c *gin.Context) ([]string, bool) {
+	value, ok := c.Get(tokenScopesKey)
+	if !ok {
+		return nil, false
+	}
+	return value.([]string), true
+}
+
+// HasScope is true for session requests and for access tokens that carry
+// the scope.
+func HasScope(c *gin.Context, scope string) bool {
+	scopes, limited := TokenScopes(c)
+	return !limited || slices.Contains(scopes, scope)
+}
+
+// RequireScope lets a request through if it was made with a session, or
+// with an access token that has the scope.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !HasScope(c, scope) {
+			log.Printf("[WARN] Access token ID=%d lacks scope %s for %s", c.GetUint64(accessTokenIDKey), scope, c.FullPath())
+			c.JSON(http.StatusForbidden, gin.H{"error": "Token lacks the " + scope + " scope"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireSession keeps access tokens out of account management: they can't
+// list sessions, change passwords or mint more tokens, whatever their scopes.
+func RequireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, limited := TokenScopes(c); limited {
+			log.Printf("[WARN] Access token ID=%d used for %s", c.GetUint64(accessTokenIDKey), c.FullPath())
+			c.JSON(http.StatusForbidden, gin.H{"error": "This endpoint needs a login session, not an access token"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func IsAccessTokenRequestError(err error) bool {
+	return errors.Is(err, ErrTooManyAccessTokens) ||
+		errors.Is(err, ErrAccessTokenName) ||
+		errors.Is(err, ErrNoScopes) ||
+		errors.Is(err, ErrAccessTokenExpiry) ||
+		errors.Is(err, ErrUnknownScope)
+}
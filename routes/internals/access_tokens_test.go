@@ -0,0 +1,32 @@
+package internals
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm/schema"
+)
+
+func TestAccessTokenPrefixFitsColumn(t *testing.T) {
+	db := newTestDB(t)
+	user := createTestUser(t, db, "ann", "")
+
+	raw, token, err := CreatePersonalAccessToken(db, user.ID, "ci", []string{ScopeCalls}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(raw, token.Prefix) || !strings.HasPrefix(token.Prefix, accessTokenMarker) {
+		t.Errorf("prefix %q doesn't start the token %q", token.Prefix, raw)
+	}
+
+	// SQLite doesn't enforce VARCHAR sizes, other databases do
+	tokens, err := schema.Parse(&models.PersonalAccessToken{}, &sync.Map{}, schema.NamingStrategy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := tokens.LookUpField("Prefix").Size; len(token.Prefix) > size {
+		t.Errorf("prefix is %d characters, the column holds %d", len(token.Prefix), size)
+	}
+}
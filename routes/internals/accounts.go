@@ -0,0 +1,386 @@
+package internals
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultPasswordResetTTL     = time.Hour
+	defaultEmailVerificationTTL = 48 * time.Hour
+	mailCooldown                = time.Minute
+	minPasswordLength           = 8
+)
+
+const (
+	EmailVerificationOff      = "off"
+	EmailVerificationOptional = "optional"
+	EmailVerificationRequired = "required"
+)
+
+var (
+	ErrWrongPassword     = errors.New("current password is incorrect")
+	ErrPasswordTooShort  = fmt.Errorf("password must be at least %d characters", minPasswordLength)
+	ErrInvalidEmail      = errors.New("invalid email address")
+	ErrEmailRequired     = errors.New("an email address is required")
+	ErrEmailNotVerified  = errors.New("email address has not been verified")
+	ErrNothingToVerify   = errors.New("no unverified email address")
+	ErrMailRateLimited   = errors.New("an email was sent recently, try again in a minute")
+	ErrVerificationIsOff = errors.New("email verification is turned off")
+	ErrReauthRequired    = fmt.Errorf("log in again, then retry within %s", reauthWindow)
+)
+
+// reauthWindow is how recently a user without a password must have logged in
+// to confirm changes that would otherwise need the password.
+const reauthWindow = 5 * time.Minute
+
+// --- Account Settings ---
+
+func EmailVerificationMode() string {
+	switch mode := strings.ToLower(os.Getenv("EMAIL_VERIFICATION")); mode {
+	case "":
+		return EmailVerificationOptional
+	case EmailVerificationOff, EmailVerificationOptional, EmailVerificationRequired:
+		return mode
+	default:
+		log.Printf("[WARN] Invalid EMAIL_VERIFICATION %q, using %s", mode, EmailVerificationOptional)
+		return EmailVerificationOptional
+	}
+}
+
+// NormalizeEmail accepts a bare address only, no display name, and returns
+// it lowercased.
+func NormalizeEmail(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	addr, err := mail.ParseAddress(raw)
+	if err != nil || addr.Address != raw || addr.Name != "" || len(raw) > 254 {
+		return "", ErrInvalidEmail
+	}
+	return strings.ToLower(raw), nil
+}
+
+// appLink points mail at the web app when APP_URL is set; otherwise the mail
+// just carries the token for the client to submit.
+func appLink(path string, token string) string {
+	base := strings.TrimRight(os.Getenv("APP_URL"), "/")
+	if base == "" {
+		return ""
+	}
+	return base + path + "?token=" + url.QueryEscape(token)
+}
+
+func mailBody(intro string, link string, token string, outro string) string {
+	var b strings.Builder
+	b.WriteString(intro + "\n\n")
+	if link != "" {
+		b.WriteString(link + "\n\n")
+	} else {
+		b.WriteString("Token: " + token + "\n\n")
+	}
+	b.WriteString(outro + "\n")
+	return b.String()
+}
+
+func issueUserToken(db *gorm.DB, user *models.User, purpose string, ttl time.Duration) (string, error) {
+	raw, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	err = controller.CreateUserToken(db, &models.UserToken{
+		UserID:    user.ID,
+		Purpose:   purpose,
+		TokenHash: hashToken(raw),
+		Email:     user.EmailAddress(),
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	return raw, err
+}
+
+func audit(db *gorm.DB, action string, user *models.User, ip string, details string) {
+	controller.CreateAuditEntry(db, &models.AuditEntry{
+		Action:  action,
+		UserID:  &user.ID,
+		Subject: "user:" + user.Username,
+		IP:      ip,
+		Details: details,
+	})
+}
+
+// checkCurrentPassword guards account changes made with an access token.
+// Wrong guesses count as failed logins, so a stolen token can't be used to
+// brute-force the password.
+func checkCurrentPassword(db *gorm.DB, user *models.User, password string, client ClientInfo) error {
+	if user.PasswordHash == "" {
+		// nothing to guess, so nothing to count against the user
+		return ErrWrongPassword
+	}
+	if err := CheckLoginAllowed(user.Username, client.IP); err != nil {
+		return err
+	}
+	if !CheckPasswordHash(user.PasswordHash, password) {
+		log.Printf("[WARN] Wrong current password from userID=%d", user.ID)
+		RecordFailedLogin(db, user.Username, client.IP, user)
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+// confirmAccountOwner guards deactivation and deletion. Users who sign in
+// through SSO or LDAP have no password to confirm with, so for them the
+// session making the request must have logged in a moment ago; access tokens
+// have no login to show for it.
+func confirmAccountOwner(db *gorm.DB, user *models.User, sessionID string, password string, client ClientInfo) error {
+	if user.PasswordHash != "" {
+		if password == "" {
+			return ErrWrongPassword
+		}
+		return checkCurrentPassword(db, user, password, client)
+	}
+
+	if sessionID == "" {
+		return ErrReauthRequired
+	}
+	loggedIn, err := controller.GetSessionLoginTime(db, sessionID)
+	if errors.Is(err, controller.ErrSessionNotFound) {
+		return ErrReauthRequired
+	}
+	if err != nil {
+		return err
+	}
+	if time.Since(loggedIn) > reauthWindow {
+		log.Printf("[INFO] UserID=%d has no password and last logged in at %s, asking for a new login", user.ID, loggedIn.Format(time.RFC3339))
+		return ErrReauthRequired
+	}
+	return nil
+}
+
+// --- Password Change and Reset ---
+
+// ChangePassword sets a new password and logs out every other session; the
+// session making the change stays signed in.
+func ChangePassword(db *gorm.DB, userID uint64, sessionID string, current string, next string, client ClientInfo) error {
+	user, err := loadUser(db, userID)
+	if err != nil {
+		return err
+	}
+	if err := checkCurrentPassword(db, user, current, client); err != nil {
+		return err
+	}
+	if err := ValidatePassword(next, user.Username); err != nil {
+		return err
+	}
+
+	hash, err := HashPassword(next)
+	if err != nil {
+		return err
+	}
+	if err := controller.SetPasswordHash(db, user.ID, hash); err != nil {
+		return err
+	}
+	if err := controller.RevokeUserSessions(db, user.ID, sessionID); err != nil {
+		log.Printf("[WARN] Failed to revoke other sessions of userID=%d: %v", user.ID, err)
+	}
+	audit(db, models.AuditPasswordChange, user, client.IP, "other sessions revoked")
+
+	if user.Email != nil {
+		sendMail(MailMessage{
+			To:      *user.Email,
+			Subject: "Your password was changed",
+			Body: "The password for your account " + user.Username + " was just changed and your other sessions were signed out.\n\n" +
+				"If this wasn't you, reset your password right away.\n",
+		})
+	}
+	return nil
+}
+
+// RequestPasswordReset mails a reset link if the address belongs to an
+// active account. The caller can't tell whether it did.
+func RequestPasswordReset(db *gorm.DB, email string, client ClientInfo) error {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return err
+	}
+
+	user, err := controller.GetUserByEmail(db, email)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("[INFO] Password reset requested for unknown address from %s", client.IP)
+			return nil
+		}
+		return err
+	}
+	if user.DisabledAt != nil {
+		log.Printf("[WARN] Password reset requested for disabled userID=%d", user.ID)
+		return nil
+	}
+	if !controller.LockMail("reset:"+email, mailCooldown) {
+		log.Printf("[WARN] Password reset for userID=%d requested again too soon", user.ID)
+		return nil
+	}
+
+	ttl := envDuration("PASSWORD_RESET_TTL", defaultPasswordResetTTL)
+	token, err := issueUserToken(db, user, models.TokenPasswordReset, ttl)
+	if err != nil {
+		return err
+	}
+	sendMail(MailMessage{
+		To:      email,
+		Subject: "Reset your password",
+		Body: mailBody(
+			"Someone asked to reset the password for your account "+user.Username+". Use this to choose a new one:",
+			appLink("/reset-password", token), token,
+			fmt.Sprintf("It works once and expires in %s. If you didn't ask for this, you can ignore this mail.", ttl),
+		),
+	})
+	return nil
+}
+
+// ResetPassword spends a reset token on a new password. Every session and
+// access token is revoked and any login lockout lifted, since whoever holds
+// the token has proven they own the mailbox.
+func ResetPassword(db *gorm.DB, token string, password string, client ClientInfo) error {
+	// the username isn't known until the token is spent
+	if err := ValidatePassword(password, ""); err != nil {
+		return err
+	}
+	used, err := controller.ConsumeUserToken(db, models.TokenPasswordReset, hashToken(token))
+	if err != nil {
+		return err
+	}
+	user, err := loadUser(db, used.UserID)
+	if err != nil {
+		return err
+	}
+	if user.DisabledAt != nil {
+		log.Printf("[WARN] Reset token used for disabled userID=%d", user.ID)
+		return controller.ErrUserTokenInvalid
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	if err := controller.SetPasswordHash(db, user.ID, hash); err != nil {
+		return err
+	}
+	if err := controller.RevokeUserSessions(db, user.ID, ""); err != nil {
+		log.Printf("[WARN] Failed to revoke sessions of userID=%d: %v", user.ID, err)
+	}
+	// whoever had the account may have left an access token behind
+	if err := controller.DeleteUserPersonalAccessTokens(db, user.ID); err != nil {
+		log.Printf("[WARN] Failed to revoke access tokens of userID=%d: %v", user.ID, err)
+	}
+	ResetLoginFailures(user.Username)
+	audit(db, models.AuditPasswordReset, user, client.IP, "all sessions and access tokens revoked")
+
+	// the link reached the inbox, which is as good as verifying it
+	if user.EmailPending() && used.Email == user.EmailAddress() {
+		controller.MarkEmailVerified(db, user.ID, used.Email)
+	}
+	return nil
+}
+
+// --- Email Verification ---
+
+func sendVerificationMail(db *gorm.DB, user *models.User) error {
+	ttl := envDuration("EMAIL_VERIFICATION_TTL", defaultEmailVerificationTTL)
+	token, err := issueUserToken(db, user, models.TokenEmailVerification, ttl)
+	if err != nil {
+		return err
+	}
+	sendMail(MailMessage{
+		To:      user.EmailAddress(),
+		Subject: "Verify your email address",
+		Body: mailBody(
+			"Confirm that this address belongs to your account "+user.Username+":",
+			appLink("/verify-email", token), token,
+			fmt.Sprintf("This expires in %s.", ttl),
+		),
+	})
+	return nil
+}
+
+// SetEmail changes the user's address after checking their password, and
+// sends a verification mail to the new one.
+func SetEmail(db *gorm.DB, userID uint64, email string, password string, client ClientInfo) (*models.User, error) {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	user, err := loadUser(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCurrentPassword(db, user, password, client); err != nil {
+		return nil, err
+	}
+	if user.EmailAddress() == email {
+		return user, nil
+	}
+
+	if err := controller.SetUserEmail(db, user.ID, email); err != nil {
+		return nil, err
+	}
+	user.Email = &email
+	user.EmailVerifiedAt = nil
+	if EmailVerificationMode() != EmailVerificationOff {
+		if err := sendVerificationMail(db, user); err != nil {
+			log.Printf("[WARN] Failed to send verification mail to userID=%d: %v", user.ID, err)
+		}
+	}
+	return user, nil
+}
+
+func ResendVerificationMail(db *gorm.DB, userID uint64) error {
+	if EmailVerificationMode() == EmailVerificationOff {
+		return ErrVerificationIsOff
+	}
+	user, err := loadUser(db, userID)
+	if err != nil {
+		return err
+	}
+	if !user.EmailPending() {
+		return ErrNothingToVerify
+	}
+	if !controller.LockMail(fmt.Sprintf("verify:%d", user.ID), mailCooldown) {
+		return ErrMailRateLimited
+	}
+	return sendVerificationMail(db, user)
+}
+
+func VerifyEmail(db *gorm.DB, token string, client ClientInfo) error {
+	used, err := controller.ConsumeUserToken(db, models.TokenEmailVerification, hashToken(token))
+	if err != nil {
+		return err
+	}
+	user, err := loadUser(db, used.UserID)
+	if err != nil {
+		return err
+	}
+	if err := controller.MarkEmailVerified(db, user.ID, used.Email); err != nil {
+		return err
+	}
+	audit(db, models.AuditEmailVerified, user, client.IP, used.Email)
+	return nil
+}
+
+// IsAccountRequestError is true for errors caused by what the client sent
+// rather than by the server.
+func IsAccountRequestError(err error) bool {
+	return errors.Is(err, ErrPasswordTooShort) ||
+		errors.Is(err, ErrPasswordTooLong) ||
+		errors.Is(err, ErrPasswordTooCommon) ||
+		errors.Is(err, ErrPasswordHasUsername) ||
+		errors.Is(err, ErrInvalidEmail) ||
+		errors.Is(err, ErrEmailRequired)
+}
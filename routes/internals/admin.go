@@ -0,0 +1,274 @@
+package internals
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultUserListLimit = 50
+	MaxUserListLimit     = 200
+)
+
+var (
+	ErrAdminSelf      = errors.New("admins can't do this to their own account")
+	ErrBootstrapAdmin = errors.New("users listed in ADMIN_USERS are always admins")
+	ErrUserListPaging = fmt.Errorf("limit must be 1-%d and offset at least 0", MaxUserListLimit)
+	ErrUserListStatus = errors.New("status must be active, disabled or admin")
+	ErrUserListQuery  = fmt.Errorf("q must be at most %d characters", maxSearchQuery)
+)
+
+// --- Administrators ---
+
+// bootstrapAdmins holds the user IDs from ADMIN_USERS. They are promoted at
+// startup and can't be demoted, since the next start would promote them again.
+var bootstrapAdmins = map[uint64]bool{}
+
+// InitAdmins sets the admin flag on the existing accounts listed in
+// ADMIN_USERS; that's how the first admin gets in. IDs rather than usernames,
+// because a username that is free can be taken by anybody.
+func InitAdmins(db *gorm.DB) {
+	for _, value := range envList("ADMIN_USERS", ",") {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || id == 0 {
+			log.Printf("[ERROR] ADMIN_USERS: %q is not a user ID", value)
+			continue
+		}
+		bootstrapAdmins[id] = true
+
+		user, err := controller.GetUserProfile(db, id)
+		if err != nil {
+			log.Printf("[WARN] ADMIN_USERS: user ID=%d not promoted: %v", id, err)
+			continue
+		}
+		if user.Admin {
+			continue
+		}
+		if _, err := controller.SetUserAdmin(db, id, true); err != nil {
+			log.Printf("[ERROR] ADMIN_USERS: failed to promote user ID=%d: %v", id, err)
+			continue
+		}
+		audit(db, models.AuditAdminGranted, user, "", "listed in ADMIN_USERS")
+	}
+}
+
+func IsAdmin(user *models.User) bool {
+	return user.Admin
+}
+
+// RequireAdmin runs after MiddlewareJWTAuth and RequireSession.
+func RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+		if !IsAdmin(user) {
+			log.Printf("[WARN] UserID=%d is not an admin, denied %s", user.ID, c.FullPath())
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admins only"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// AdminUserView is what admins see of an account: the public profile plus
+// its state and private settings.
+func AdminUserView(user *models.User) map[string]any {
+	view := user.Profile(time.Now())
+	view["email"] = user.Email
+	view["email_verified"] = user.Email != nil && !user.EmailPending()
+	view["disabled_at"] = user.DisabledAt
+	view["admin"] = IsAdmin(user)
+	view["two_factor_enabled"] = user.TwoFactorEnabled()
+	return view
+}
+
+// adminAudit records what an admin did to a user in that user's log.
+func adminAudit(db *gorm.DB, action string, admin *models.User, target *models.User, client ClientInfo) {
+	audit(db, action, target, client.IP, "by admin "+admin.Username)
+}
+
+// --- Users ---
+
+// ListUsers pages through all accounts. q finds a substring of the username,
+// display name or email address.
+func ListUsers(db *gorm.DB, q string, status string, limit int, offset int) ([]map[string]any, int64, error) {
+	if limit < 1 || limit > MaxUserListLimit || offset < 0 {
+		return nil, 0, ErrUserListPaging
+	}
+	switch status {
+	case "", controller.UserStatusActive, controller.UserStatusDisabled, controller.UserStatusAdmin:
+	default:
+		return nil, 0, ErrUserListStatus
+	}
+	q = strings.TrimSpace(q)
+	if utf8.RuneCountInString(q) > maxSearchQuery {
+		return nil, 0, ErrUserListQuery
+	}
+	pattern := ""
+	if q != "" {
+		escape := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+		pattern = "%" + escape.Replace(strings.ToLower(q)) + "%"
+	}
+
+	users, total, err := controller.ListUsers(db, pattern, status, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	views := make([]map[string]any, len(users))
+	for i := range users {
+		views[i] = AdminUserView(&users[i])
+	}
+	return views, total, nil
+}
+
+// SetUserDisabled disables or re-enables someone else's account. Disabling
+// signs them out everywhere and closes their live connections.
+func SetUserDisabled(db *gorm.DB, admin *models.User, userID uint64, disabled bool, client ClientInfo) (*models.User, error) {
+	if userID == admin.ID {
+		return nil, ErrAdminSelf
+	}
+	if _, err := controller.GetUserProfile(db, userID); err != nil {
+		return nil, err
+	}
+	user, err := controller.SetUserDisabled(db, userID, disabled)
+	if err != nil {
+		return nil, err
+	}
+	action := models.AuditUserEnabled
+	if disabled {
+		action = models.AuditUserDisabled
+	}
+	adminAudit(db, action, admin, user, client)
+	return user, nil
+}
+
+// SetAdmin grants or revokes the admin flag. Admins can't demote themselves,
+// so there is always one left.
+func SetAdmin(db *gorm.DB, admin *models.User, userID uint64, grant bool, client ClientInfo) (*models.User, error) {
+	if userID == admin.ID {
+		return nil, ErrAdminSelf
+	}
+	user, err := controller.GetUserProfile(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !grant && bootstrapAdmins[user.ID] {
+		return nil, ErrBootstrapAdmin
+	}
+	if user.Admin == grant {
+		return user, nil
+	}
+
+	if user, err = controller.SetUserAdmin(db, userID, grant); err != nil {
+		return nil, err
+	}
+	action := models.AuditAdminRevoked
+	if grant {
+		action = models.AuditAdminGranted
+	}
+	adminAudit(db, action, admin, user, client)
+	return user, nil
+}
+
+// ForcePasswordReset throws the user's password away and signs them out
+// everywhere. The reset link is mailed to them; for users without an email
+// address the token is returned so the admin can hand it over.
+func ForcePasswordReset(db *gorm.DB, admin *models.User, userID uint64, client ClientInfo) (string, error) {
+	if userID == admin.ID {
+		return "", ErrAdminSelf
+	}
+	user, err := controller.GetUserProfile(db, userID)
+	if err != nil {
+		return "", err
+	}
+
+	if err := controller.SetPasswordHash(db, user.ID, ""); err != nil {
+		return "", err
+	}
+	if err := controller.RevokeUserSessions(db, user.ID, ""); err != nil {
+		log.Printf("[WARN] Failed to revoke sessions of userID=%d: %v", user.ID, err)
+	}
+	if err := controller.DeleteUserPersonalAccessTokens(db, user.ID); err != nil {
+		log.Printf("[WARN] Failed to revoke access tokens of userID=%d: %v", user.ID, err)
+	}
+	if err := controller.RevokeUserAccess(user.ID, controller.RevokedSignedOut); err != nil {
+		log.Printf("[WARN] Failed to revoke live access of userID=%d: %v", user.ID, err)
+	}
+	adminAudit(db, models.AuditForcedReset, admin, user, client)
+
+	ttl := envDuration("PASSWORD_RESET_TTL", defaultPasswordResetTTL)
+	token, err := issueUserToken(db, user, models.TokenPasswordReset, ttl)
+	if err != nil {
+		return "", err
+	}
+	if user.Email == nil {
+		return token, nil
+	}
+	sendMail(MailMessage{
+		To:      *user.Email,
+		Subject: "Choose a new password",
+		Body: mailBody(
+			"An administrator has reset the password for your account "+user.Username+" and signed you out. Choose a new one here:",
+			appLink("/reset-password", token), token,
+			fmt.Sprintf("It works once and expires in %s.", ttl),
+		),
+	})
+	return "", nil
+}
+
+// --- Channels and Messages ---
+
+func DeleteChannel(db *gorm.DB, admin *models.User, channelID uint64, client ClientInfo) error {
+	var channel models.Channel
+	if err := db.First(&channel, channelID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return controller.ErrChannelNotFound
+		}
+		return err
+	}
+	if err := controller.DeleteChannel(db, channelID); err != nil {
+		return err
+	}
+	controller.CreateAuditEntry(db, &models.AuditEntry{
+		Action:  models.AuditChannelDeleted,
+		UserID:  &admin.ID,
+		Subject: fmt.Sprintf("channel:%d", channelID),
+		IP:      client.IP,
+		Details: fmt.Sprintf("#%s by admin %s", channel.Name, admin.Username),
+	})
+	return nil
+}
+
+func DeleteMessage(db *gorm.DB, admin *models.User, messageID uint64, client ClientInfo) error {
+	msg, err := controller.DeleteMessage(db, messageID)
+	if err != nil {
+		return err
+	}
+	controller.CreateAuditEntry(db, &models.AuditEntry{
+		Action:  models.AuditMessageDeleted,
+		UserID:  &admin.ID,
+		Subject: fmt.Sprintf("message:%d", messageID),
+		IP:      client.IP,
+		Details: fmt.Sprintf("by user ID=%d in channel ID=%d, deleted by admin %s", msg.UserID, msg.ChannelID, admin.Username),
+	})
+	return nil
+}
+
+// IsAdminRequestError is true for errors caused by what the admin sent.
+func IsAdminRequestError(err error) bool {
+	return errors.Is(err, ErrUserListPaging) ||
+		errors.Is(err, ErrUserListStatus) ||
+		errors.Is(err, ErrUserListQuery) ||
+		errors.Is(err, ErrAdminSelf)
+}
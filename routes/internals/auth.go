@@ -1,6 +1,11 @@
 package internals
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -10,122 +15,293 @@ import (
 	"github.com/rtk-rnjn/ping/config"
 	"github.com/rtk-rnjn/ping/controller"
 	"github.com/rtk-rnjn/ping/models"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
-var (
-	jwtSecret = []byte(os.Getenv("JWT_SECRET"))
+const (
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
 )
 
-func HashPassword(password string) (string, error) {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 12)
-	if err != nil {
-		log.Printf("[ERROR] Failed to hash password: %v", err)
+// TokenPair is handed out on register, login and refresh. The access token
+// is a short-lived JWT; the refresh token is opaque and single-use.
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    time.Duration
+	SessionID    string
+}
+
+// AccessClaims identifies an access token: TokenID is its jti, SessionID the
+// session (sid) it was issued for.
+type AccessClaims struct {
+	TokenID   string
+	SessionID string
+	UserID    uint64
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
 	}
-	return string(bytes), err
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		log.Printf("[WARN] Invalid %s %q, using %s", name, value, fallback)
+		return fallback
+	}
+	return ttl
+}
+
+func accessTokenTTL() time.Duration {
+	return envDuration("ACCESS_TOKEN_TTL", defaultAccessTokenTTL)
+}
+
+func refreshTokenTTL() time.Duration {
+	return envDuration("REFRESH_TOKEN_TTL", defaultRefreshTokenTTL)
 }
 
-func CheckPasswordHash(hash, password string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+func GenerateJWT(user *models.User, sessionID string) (string, error) {
+	log.Printf("[INFO] Generating JWT for userID=%d (session=%s)", user.ID, sessionID)
+	jti, err := randomToken(16)
 	if err != nil {
-		log.Printf("[WARN] Password hash mismatch")
+		log.Printf("[ERROR] Failed to generate token ID: %v", err)
+		return "", err
 	}
-	return err == nil
-}
 
-func GenerateJWT(user *models.User) (string, error) {
-	log.Printf("[INFO] Generating JWT for userID=%d", user.ID)
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+	now := time.Now()
+	signedToken, err := signingKeys.sign(jwt.MapClaims{
 		"id":       user.ID,
 		"username": user.Username,
-		"exp":      time.Now().Add(time.Hour * 72).Unix(),
+		"jti":      jti,
+		"sid":      sessionID,
+		"iat":      now.Unix(),
+		"exp":      now.Add(accessTokenTTL()).Unix(),
 	})
-	signedToken, err := token.SignedString(jwtSecret)
 	if err != nil {
 		log.Printf("[ERROR] Failed to sign JWT: %v", err)
 	}
 	return signedToken, err
 }
 
-func ValidateJWT(tokenString string) (*models.User, error) {
-	log.Printf("[INFO] Validating JWT: %.10s...", tokenString)
+func randomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRefreshToken() (string, *models.RefreshToken, error) {
+	raw, err := randomToken(32)
+	if err != nil {
+		log.Printf("[ERROR] Failed to generate refresh token: %v", err)
+		return "", nil, err
+	}
+	return raw, &models.RefreshToken{
+		TokenHash: hashToken(raw),
+		ExpiresAt: time.Now().Add(refreshTokenTTL()),
+	}, nil
+}
+
+// IssueTokens starts a new session, and with it a new refresh token family,
+// for the user.
+func IssueTokens(db *gorm.DB, user *models.User, client ClientInfo) (*TokenPair, error) {
+	raw, refresh, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	session := &models.Session{
+		ID:         hex.EncodeToString(id),
+		UserID:     user.ID,
+		Device:     client.device(),
+		IP:         client.IP,
+		UserAgent:  client.userAgent(),
+		LastSeenAt: time.Now(),
+		ExpiresAt:  refresh.ExpiresAt,
+	}
+	if err := controller.CreateSession(db, session); err != nil {
+		return nil, err
+	}
+
+	refresh.UserID = user.ID
+	refresh.FamilyID = session.ID
+	if err := controller.CreateRefreshToken(db, refresh); err != nil {
+		return nil, err
+	}
+
+	accessToken, err := GenerateJWT(user, session.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{AccessToken: accessToken, RefreshToken: raw, ExpiresIn: accessTokenTTL(), SessionID: session.ID}, nil
+}
+
+func RefreshTokens(db *gorm.DB, refreshToken string, client ClientInfo) (*TokenPair, error) {
+	raw, next, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
 
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (any, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			errMsg := fmt.Sprintf("unexpected signing method: %v", token.Header["alg"])
-			log.Printf("[ERROR] %s", errMsg)
-			return nil, fmt.Errorf("%s", errMsg)
+	if _, err := controller.RotateRefreshToken(db, hashToken(refreshToken), next); err != nil {
+		return nil, err
+	}
+
+	user, err := controller.GetUserByID(db, next.UserID)
+	if err != nil {
+		log.Printf("[ERROR] User not found for refresh token of userID=%d: %v", next.UserID, err)
+		return nil, controller.ErrRefreshTokenInvalid
+	}
+	if user.DisabledAt != nil {
+		log.Printf("[WARN] Refusing to refresh tokens for disabled userID=%d", user.ID)
+		if err := controller.RevokeSession(db, next.FamilyID); err != nil {
+			return nil, err
 		}
-		return jwtSecret, nil
-	})
+		return nil, controller.ErrRefreshTokenInvalid
+	}
+
+	if err := controller.RefreshSession(db, next.FamilyID, client.IP, client.userAgent(), next.ExpiresAt); err != nil {
+		return nil, err
+	}
+
+	accessToken, err := GenerateJWT(user, next.FamilyID)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenPair{AccessToken: accessToken, RefreshToken: raw, ExpiresIn: accessTokenTTL(), SessionID: next.FamilyID}, nil
+}
+
+// Logout ends the session the refresh token belongs to, which also
+// invalidates the access tokens issued for it.
+func Logout(db *gorm.DB, refreshToken string) error {
+	token, err := controller.GetRefreshTokenByHash(db, hashToken(refreshToken))
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] Logging out userID=%d (session=%s)", token.UserID, token.FamilyID)
+	return controller.RevokeSession(db, token.FamilyID)
+}
+
+func IsInvalidRefreshToken(err error) bool {
+	return errors.Is(err, controller.ErrRefreshTokenInvalid) || errors.Is(err, controller.ErrRefreshTokenReused)
+}
+
+func ValidateJWT(tokenString string) (*models.User, *AccessClaims, error) {
+	log.Printf("[INFO] Validating JWT: %.10s...", tokenString)
+
+	token, err := jwt.Parse(tokenString, signingKeys.verificationKey,
+		jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg(), jwt.SigningMethodRS256.Alg()}))
 	if err != nil || !token.Valid {
 		log.Printf("[ERROR] Invalid or expired token: %v", err)
-		return nil, fmt.Errorf("invalid token")
+		return nil, nil, fmt.Errorf("invalid token")
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
 		log.Println("[ERROR] JWT claims could not be parsed")
-		return nil, fmt.Errorf("invalid claims")
+		return nil, nil, fmt.Errorf("invalid claims")
 	}
 
 	userIDFloat, ok := claims["id"].(float64)
 	if !ok {
 		log.Println("[ERROR] JWT missing or malformed 'id' claim")
-		return nil, fmt.Errorf("invalid user ID in token")
+		return nil, nil, fmt.Errorf("invalid user ID in token")
 	}
 	userID := uint64(userIDFloat)
 
+	jti, _ := claims["jti"].(string)
+	sid, _ := claims["sid"].(string)
+	if jti == "" || sid == "" {
+		log.Println("[ERROR] JWT missing 'jti' or 'sid' claim")
+		return nil, nil, fmt.Errorf("invalid token")
+	}
+
 	log.Printf("[INFO] Extracted userID=%d from token", userID)
 	user, err := controller.GetUserByID(config.DB, userID)
 	if err != nil || user == nil {
 		log.Printf("[ERROR] User not found for userID=%d: %v", userID, err)
-		return nil, fmt.Errorf("user not found")
+		return nil, nil, fmt.Errorf("user not found")
 	}
 
-	return user, nil
-}
+	if user.DisabledAt != nil {
+		log.Printf("[WARN] Rejecting token for disabled userID=%d", userID)
+		return nil, nil, fmt.Errorf("account disabled")
+	}
 
-func RegisterUser(db *gorm.DB, username string, password string, displayName string) (string, error) {
-	log.Printf("[INFO] Registering new user: username='%s'", username)
+	return user, &AccessClaims{TokenID: jti, SessionID: sid, UserID: userID}, nil
+}
 
-	hashed, err := HashPassword(password)
+// CheckSession rejects access tokens whose session has been logged out,
+// revoked, or has expired.
+func CheckSession(db *gorm.DB, claims *AccessClaims) (*models.Session, error) {
+	session, err := controller.GetSessionByID(db, claims.SessionID)
 	if err != nil {
-		log.Printf("[ERROR] Failed to hash password for user '%s': %v", username, err)
-		return "", err
+		log.Printf("[ERROR] Session %s of token %s not found: %v", claims.SessionID, claims.TokenID, err)
+		return nil, fmt.Errorf("invalid session")
 	}
-
-	user := models.User{
-		Username:     username,
-		PasswordHash: hashed,
-		DisplayName:  displayName,
+	if session.UserID != claims.UserID {
+		log.Printf("[ERROR] Session %s does not belong to userID=%d", claims.SessionID, claims.UserID)
+		return nil, fmt.Errorf("invalid session")
 	}
-
-	if err := controller.CreateUser(config.DB, &user); err != nil {
-		log.Printf("[ERROR] Failed to create user '%s': %v", username, err)
-		return "", fmt.Errorf("failed to create user")
+	if !session.IsActive(time.Now()) {
+		log.Printf("[WARN] Rejecting token %s of revoked or expired session %s", claims.TokenID, claims.SessionID)
+		return nil, fmt.Errorf("session revoked")
 	}
-
-	log.Printf("[INFO] User '%s' registered successfully with userID=%d", username, user.ID)
-	return GenerateJWT(&user)
+	return session, nil
 }
 
-func LoginUser(db *gorm.DB, username, password string) (string, error) {
+// LoginUser returns tokens, or a challenge when the user has 2FA enabled.
+// The password is checked by the backends in AUTH_BACKENDS.
+func LoginUser(db *gorm.DB, username, password string, client ClientInfo) (*TokenPair, *TwoFactorChallenge, error) {
 	log.Printf("[INFO] Attempting login for username='%s'", username)
 
-	var user models.User
-	err := db.Where("username = ?", username).First(&user).Error
+	if err := CheckLoginAllowed(username, client.IP); err != nil {
+		return nil, nil, err
+	}
+
+	user, err := authenticate(db, username, password)
 	if err != nil {
-		log.Printf("[ERROR] Username '%s' not found: %v", username, err)
-		return "", fmt.Errorf("invalid credentials")
+		log.Printf("[WARN] Invalid credentials for username='%s'", username)
+		RecordFailedLogin(db, username, client.IP, user)
+		return nil, nil, ErrInvalidCredentials
+	}
+
+	if user.DisabledAt != nil {
+		log.Printf("[WARN] Login attempt for disabled username='%s'", username)
+		RecordFailedLogin(db, username, client.IP, user)
+		return nil, nil, ErrInvalidCredentials
 	}
 
-	if !CheckPasswordHash(user.PasswordHash, password) {
-		log.Printf("[WARN] Invalid password attempt for username='%s'", username)
-		return "", fmt.Errorf("invalid credentials")
+	// accounts from before verification was required may have no address
+	// at all; those can still log in
+	if user.EmailPending() && EmailVerificationMode() == EmailVerificationRequired {
+		log.Printf("[WARN] Login for userID=%d before verifying their email", user.ID)
+		return nil, nil, ErrEmailNotVerified
+	}
+
+	return finishLogin(db, user, client)
+}
+
+// finishLogin is what every login does once it knows who the user is,
+// whether from a password or from an identity provider.
+func finishLogin(db *gorm.DB, user *models.User, client ClientInfo) (*TokenPair, *TwoFactorChallenge, error) {
+	if user.TwoFactorEnabled() {
+		challenge, err := newLoginChallenge(user, client)
+		return nil, challenge, err
 	}
 
-	log.Printf("[INFO] Login successful for username='%s' (userID=%d)", username, user.ID)
-	return GenerateJWT(&user)
+	log.Printf("[INFO] Login successful for username='%s' (userID=%d)", user.Username, user.ID)
+	ResetLoginFailures(user.Username)
+	tokens, err := IssueTokens(db, user, client)
+	return tokens, nil, err
 }
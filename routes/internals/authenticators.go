@@ -0,0 +1,108 @@
+package internals
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticator checks a username and password against one backend. It
+// returns ErrInvalidCredentials when the backend doesn't accept them; the
+// user may still be set then, so the failure can be audited against them.
+type Authenticator interface {
+	Name() string
+	Authenticate(db *gorm.DB, username string, password string) (*models.User, error)
+}
+
+var authenticators = []Authenticator{localAuthenticator{}}
+
+// InitAuthenticators sets up the backends named in AUTH_BACKENDS, which
+// LoginUser tries in that order.
+func InitAuthenticators() {
+	var configured []Authenticator
+	for _, name := range strings.Split(envString("AUTH_BACKENDS", "local"), ",") {
+		switch name = strings.ToLower(strings.TrimSpace(name)); name {
+		case "":
+		case "local":
+			configured = append(configured, localAuthenticator{})
+		case "ldap":
+			a, err := newLDAPAuthenticator()
+			if err != nil {
+				log.Printf("[ERROR] LDAP backend not enabled: %v", err)
+				continue
+			}
+			configured = append(configured, a)
+		default:
+			log.Printf("[WARN] Unknown auth backend %q in AUTH_BACKENDS", name)
+		}
+	}
+	if len(configured) == 0 {
+		log.Printf("[WARN] No usable auth backend in AUTH_BACKENDS, using local")
+		configured = append(configured, localAuthenticator{})
+	}
+
+	authenticators = configured
+	names := make([]string, len(configured))
+	for i, a := range configured {
+		names[i] = a.Name()
+	}
+	log.Printf("[INFO] Password logins are checked against: %s", strings.Join(names, ", "))
+}
+
+// authenticate asks each backend in turn; the first to accept the password
+// wins. A backend that is down is skipped rather than failing the login.
+func authenticate(db *gorm.DB, username string, password string) (*models.User, error) {
+	var known *models.User
+	for _, a := range authenticators {
+		user, err := a.Authenticate(db, username, password)
+		if err == nil {
+			return user, nil
+		}
+		if user != nil {
+			known = user
+		}
+		if !errors.Is(err, ErrInvalidCredentials) {
+			log.Printf("[ERROR] %s authentication for username='%s' failed: %v", a.Name(), username, err)
+		}
+	}
+	return known, ErrInvalidCredentials
+}
+
+// --- Local Passwords ---
+
+type localAuthenticator struct{}
+
+func (localAuthenticator) Name() string {
+	return "local"
+}
+
+func (localAuthenticator) Authenticate(db *gorm.DB, username string, password string) (*models.User, error) {
+	var user models.User
+	if err := db.Where("username = ?", username).First(&user).Error; err != nil {
+		burnPasswordCheck(password)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+	if !checkUserPassword(db, &user, password) {
+		return &user, ErrInvalidCredentials
+	}
+	return &user, nil
+}
+
+func envList(name string, sep string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(name), sep) {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
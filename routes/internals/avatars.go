@@ -0,0 +1,139 @@
+package internals
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"log"
+
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+const (
+	MaxAvatarBytes    = 8 << 20
+	maxAvatarSide     = 4096
+	DefaultAvatarSize = 128
+)
+
+// AvatarSizes are the square sizes every avatar is stored in, smallest first.
+var AvatarSizes = []int{32, 64, 128, 256}
+
+var (
+	ErrAvatarFormat     = errors.New("avatar must be a PNG, JPEG or GIF image")
+	ErrAvatarDimensions = fmt.Errorf("avatar must be at most %dx%d pixels", maxAvatarSide, maxAvatarSide)
+)
+
+// AvatarSize picks the smallest stored size that is at least as big as the
+// one asked for.
+func AvatarSize(wanted int) int {
+	for _, size := range AvatarSizes {
+		if size >= wanted {
+			return size
+		}
+	}
+	return AvatarSizes[len(AvatarSizes)-1]
+}
+
+// decodeAvatar checks the dimensions before decoding, so a small file that
+// claims to be huge can't make us allocate the memory for it.
+func decodeAvatar(data []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrAvatarFormat
+	}
+	if config.Width < 1 || config.Height < 1 || config.Width > maxAvatarSide || config.Height > maxAvatarSide {
+		return nil, ErrAvatarDimensions
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrAvatarFormat
+	}
+	return img, nil
+}
+
+// cropSquare cuts the largest centred square out of img.
+func cropSquare(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	side := min(b.Dx(), b.Dy())
+	origin := image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2)
+
+	square := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(square, square.Bounds(), img, origin, draw.Src)
+	return square
+}
+
+// scale resizes a square image by averaging the source pixels that fall
+// under each target pixel. Premultiplied alpha keeps transparent edges from
+// turning dark. Enlarging repeats pixels.
+func scale(src *image.RGBA, size int) *image.RGBA {
+	n := src.Bounds().Dx()
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for dy := 0; dy < size; dy++ {
+		y0 := dy * n / size
+		y1 := max((dy+1)*n/size, y0+1)
+		for dx := 0; dx < size; dx++ {
+			x0 := dx * n / size
+			x1 := max((dx+1)*n/size, x0+1)
+
+			var sum [4]int
+			for y := y0; y < y1; y++ {
+				row := src.Pix[y*src.Stride+x0*4 : y*src.Stride+x1*4]
+				for i := 0; i < len(row); i += 4 {
+					sum[0] += int(row[i])
+					sum[1] += int(row[i+1])
+					sum[2] += int(row[i+2])
+					sum[3] += int(row[i+3])
+				}
+			}
+			count := (x1 - x0) * (y1 - y0)
+			out := dst.Pix[dy*dst.Stride+dx*4:]
+			for i, v := range sum {
+				out[i] = uint8((v + count/2) / count)
+			}
+		}
+	}
+	return dst
+}
+
+// ResizeAvatar turns an uploaded image into PNGs of every avatar size.
+func ResizeAvatar(data []byte) (map[int][]byte, error) {
+	img, err := decodeAvatar(data)
+	if err != nil {
+		return nil, err
+	}
+	square := cropSquare(img)
+
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	images := make(map[int][]byte, len(AvatarSizes))
+	for _, size := range AvatarSizes {
+		var buf bytes.Buffer
+		if err := encoder.Encode(&buf, scale(square, size)); err != nil {
+			return nil, err
+		}
+		images[size] = buf.Bytes()
+	}
+	return images, nil
+}
+
+func SetAvatar(db *gorm.DB, user *models.User, data []byte) (*models.User, error) {
+	images, err := ResizeAvatar(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := controller.SaveAvatar(db, user.ID, images); err != nil {
+		return nil, err
+	}
+	log.Printf("[INFO] UserID=%d uploaded a new avatar", user.ID)
+	return loadUser(db, user.ID)
+}
+
+func IsAvatarRequestError(err error) bool {
+	return errors.Is(err, ErrAvatarFormat) || errors.Is(err, ErrAvatarDimensions)
+}
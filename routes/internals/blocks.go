@@ -0,0 +1,50 @@
+package internals
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+const maxBlocks = 1000
+
+var (
+	ErrBlockSelf     = errors.New("you can't block yourself")
+	ErrTooManyBlocks = fmt.Errorf("at most %d users can be blocked", maxBlocks)
+)
+
+// BlockUser blocks the user with blockedID for blocker. It returns false if
+// they were blocked already.
+func BlockUser(db *gorm.DB, blocker *models.User, blockedID uint64) (bool, error) {
+	if blockedID == blocker.ID {
+		return false, ErrBlockSelf
+	}
+	if _, err := controller.GetUserProfile(db, blockedID); err != nil {
+		return false, err
+	}
+	count, err := controller.CountBlocks(db, blocker.ID)
+	if err != nil {
+		return false, err
+	}
+	if count >= maxBlocks {
+		return false, ErrTooManyBlocks
+	}
+	return controller.BlockUser(db, blocker.ID, blockedID)
+}
+
+// BlockedUsers lists the users blocker has blocked, newest first.
+func BlockedUsers(db *gorm.DB, blocker *models.User) ([]map[string]any, error) {
+	blocks, err := controller.GetBlocks(db, blocker.ID)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]map[string]any, len(blocks))
+	for i, block := range blocks {
+		users[i] = block.Blocked.Summary()
+		users[i]["blocked_at"] = block.CreatedAt
+	}
+	return users, nil
+}
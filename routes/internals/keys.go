@@ -0,0 +1,389 @@
+package internals
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultJWTAlgorithm   = "EdDSA"
+	defaultKeyRotation    = 30 * 24 * time.Hour
+	defaultKeyGracePeriod = 24 * time.Hour
+	rsaKeyBits            = 2048
+
+	keyRefreshInterval = time.Minute
+	keyReloadCooldown  = 5 * time.Second
+	keyStartupAttempts = 10
+
+	// JWKSMaxAge is how long verifiers may cache the published keys. A new
+	// key is published for longer than that, and longer than nodes take to
+	// reload, before it signs anything.
+	JWKSMaxAge    = 5 * time.Minute
+	keyPrepublish = JWKSMaxAge + keyRefreshInterval
+)
+
+var signingMethods = map[string]jwt.SigningMethod{
+	jwt.SigningMethodEdDSA.Alg(): jwt.SigningMethodEdDSA,
+	jwt.SigningMethodRS256.Alg(): jwt.SigningMethodRS256,
+}
+
+// --- Signing Keys ---
+
+// keyring holds the keys every node signs and verifies with. Keys live in
+// the database so all nodes share them; each node reloads them periodically
+// and, when a token names a kid it hasn't seen, right away.
+type keyring struct {
+	db        *gorm.DB
+	algorithm string
+	rotation  time.Duration
+	grace     time.Duration
+
+	mu         sync.RWMutex
+	active     *signingKey
+	next       *signingKey // published, signs from next.activatesAt
+	keys       map[string]*signingKey
+	lastReload time.Time
+}
+
+type signingKey struct {
+	id          string
+	method      jwt.SigningMethod
+	private     crypto.Signer
+	public      crypto.PublicKey
+	createdAt   time.Time
+	activatesAt time.Time
+	retiredAt   *time.Time
+}
+
+var signingKeys *keyring
+
+func InitSigningKeys(db *gorm.DB) {
+	algorithm := os.Getenv("JWT_ALGORITHM")
+	if algorithm == "" {
+		algorithm = defaultJWTAlgorithm
+	}
+	if _, ok := signingMethods[algorithm]; !ok {
+		log.Fatalf("[FATAL] Unsupported JWT_ALGORITHM %q (use EdDSA or RS256)", algorithm)
+	}
+
+	grace := envDuration("JWT_KEY_GRACE_PERIOD", defaultKeyGracePeriod)
+	if grace < accessTokenTTL() {
+		log.Printf("[WARN] JWT_KEY_GRACE_PERIOD %s is shorter than ACCESS_TOKEN_TTL, using %s", grace, accessTokenTTL())
+		grace = accessTokenTTL()
+	}
+	if os.Getenv("JWT_SECRET") != "" {
+		log.Println("[WARN] JWT_SECRET is set but no longer used; tokens are signed with keys stored in the database")
+	}
+
+	signingKeys = &keyring{
+		db:        db,
+		algorithm: algorithm,
+		rotation:  envDuration("JWT_KEY_ROTATION", defaultKeyRotation),
+		grace:     grace,
+		keys:      make(map[string]*signingKey),
+	}
+
+	// on a fresh database another node may be creating the first key; give
+	// it a moment instead of racing it
+	for attempt := 1; ; attempt++ {
+		if err := signingKeys.reload(); err != nil {
+			log.Fatalf("[FATAL] Failed to load signing keys: %v", err)
+		}
+		signingKeys.rotateIfDue()
+		if signingKeys.current() != nil {
+			break
+		}
+		if attempt == keyStartupAttempts {
+			log.Fatalf("[FATAL] No signing key available")
+		}
+		time.Sleep(time.Second)
+	}
+	log.Printf("[INFO] JWT signing with %s, rotating every %s (grace period %s)", algorithm, signingKeys.rotation, grace)
+
+	go signingKeys.run()
+}
+
+func (k *keyring) run() {
+	ticker := time.NewTicker(keyRefreshInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := k.reload(); err != nil {
+			continue
+		}
+		k.rotateIfDue()
+	}
+}
+
+func (k *keyring) reload() error {
+	rows, err := controller.GetSigningKeys(k.db, time.Now().Add(-k.grace))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	keys := make(map[string]*signingKey, len(rows))
+	var active, next *signingKey
+	for _, row := range rows {
+		key, err := parseSigningKey(row)
+		if err != nil {
+			log.Printf("[ERROR] Skipping unusable signing key %s: %v", row.ID, err)
+			continue
+		}
+		keys[key.id] = key
+		switch {
+		case key.activatesAt.After(now):
+			if next == nil || key.activatesAt.After(next.activatesAt) {
+				next = key
+			}
+		case key.retiredAt == nil || key.retiredAt.After(now):
+			if active == nil || key.activatesAt.After(active.activatesAt) {
+				active = key
+			}
+		}
+	}
+
+	k.mu.Lock()
+	k.keys = keys
+	k.active = active
+	k.next = next
+	k.lastReload = now
+	k.mu.Unlock()
+	return nil
+}
+
+// current is the key to sign with. The next key takes over at its
+// activation time on every node, without waiting for a reload.
+func (k *keyring) current() *signingKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.next != nil && !time.Now().Before(k.next.activatesAt) {
+		return k.next
+	}
+	return k.active
+}
+
+// due reports whether the active key needs a successor published, which
+// happens keyPrepublish before the key has been signing for the rotation
+// period.
+func (k *keyring) due() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.next != nil {
+		return false
+	}
+	return k.active == nil ||
+		k.active.method.Alg() != k.algorithm ||
+		time.Since(k.active.activatesAt) >= k.rotation-keyPrepublish
+}
+
+func (k *keyring) rotateIfDue() {
+	if !k.due() {
+		return
+	}
+	if !controller.LockSigningKeyRotation(keyRefreshInterval) {
+		return
+	}
+
+	// someone may have rotated between our last reload and taking the lock
+	if err := k.reload(); err != nil || !k.due() {
+		return
+	}
+
+	row, err := generateSigningKey(k.algorithm)
+	if err != nil {
+		log.Printf("[ERROR] Failed to generate %s signing key: %v", k.algorithm, err)
+		return
+	}
+	// with nothing signing yet there is nobody to warn ahead
+	activatesAt := row.CreatedAt
+	if k.current() != nil {
+		activatesAt = activatesAt.Add(keyPrepublish)
+	}
+	row.ActivatesAt = &activatesAt
+	if err := controller.CreateSigningKey(k.db, row); err != nil {
+		return
+	}
+	if err := controller.DeleteRetiredSigningKeys(k.db, time.Now().Add(-k.grace)); err != nil {
+		log.Printf("[WARN] Failed to clean up retired signing keys: %v", err)
+	}
+	if err := k.reload(); err != nil {
+		log.Printf("[ERROR] Failed to reload signing keys after rotation: %v", err)
+	}
+}
+
+func (k *keyring) lookup(kid string) *signingKey {
+	k.mu.RLock()
+	key := k.keys[kid]
+	stale := time.Since(k.lastReload) >= keyReloadCooldown
+	k.mu.RUnlock()
+
+	if key == nil && stale {
+		if err := k.reload(); err == nil {
+			k.mu.RLock()
+			key = k.keys[kid]
+			k.mu.RUnlock()
+		}
+	}
+	if key == nil || (key.retiredAt != nil && time.Since(*key.retiredAt) > k.grace) {
+		return nil
+	}
+	return key
+}
+
+func (k *keyring) sign(claims jwt.MapClaims) (string, error) {
+	key := k.current()
+	if key == nil {
+		return "", fmt.Errorf("no active signing key")
+	}
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.id
+	return token.SignedString(key.private)
+}
+
+func (k *keyring) verificationKey(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	key := k.lookup(kid)
+	if key == nil {
+		log.Printf("[ERROR] Token signed with unknown or expired key %q", kid)
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		log.Printf("[ERROR] Token alg %s does not match key %s (%s)", token.Method.Alg(), kid, key.method.Alg())
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.public, nil
+}
+
+// JWKS publishes the public half of every key that may still verify, and of
+// the next key before it signs anything.
+func JWKS() map[string]any {
+	signingKeys.mu.RLock()
+	defer signingKeys.mu.RUnlock()
+
+	ordered := make([]*signingKey, 0, len(signingKeys.keys))
+	for _, key := range signingKeys.keys {
+		ordered = append(ordered, key)
+	}
+	slices.SortFunc(ordered, func(a, b *signingKey) int {
+		return b.createdAt.Compare(a.createdAt)
+	})
+
+	keys := make([]map[string]any, 0, len(ordered))
+	for _, key := range ordered {
+		if key.retiredAt != nil && time.Since(*key.retiredAt) > signingKeys.grace {
+			continue
+		}
+		jwk := map[string]any{
+			"kid": key.id,
+			"alg": key.method.Alg(),
+			"use": "sig",
+		}
+		switch public := key.public.(type) {
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(public)
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		}
+		keys = append(keys, jwk)
+	}
+	return map[string]any{"keys": keys}
+}
+
+func generateSigningKey(algorithm string) (*models.SigningKey, error) {
+	var private crypto.Signer
+	var err error
+	switch algorithm {
+	case jwt.SigningMethodEdDSA.Alg():
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case jwt.SigningMethodRS256.Alg():
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	default:
+		err = fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	return &models.SigningKey{
+		ID:         hex.EncodeToString(id),
+		Algorithm:  algorithm,
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		CreatedAt:  time.Now(),
+	}, nil
+}
+
+func parseSigningKey(row models.SigningKey) (*signingKey, error) {
+	method, ok := signingMethods[row.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", row.Algorithm)
+	}
+	block, _ := pem.Decode([]byte(row.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("invalid PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	var private crypto.Signer
+	switch key := parsed.(type) {
+	case ed25519.PrivateKey:
+		private = key
+	case *rsa.PrivateKey:
+		private = key
+	}
+	if private == nil || (method == jwt.SigningMethodEdDSA) != isEd25519(private) {
+		return nil, fmt.Errorf("%T cannot be used for %s", parsed, row.Algorithm)
+	}
+
+	key := &signingKey{
+		id:          row.ID,
+		method:      method,
+		private:     private,
+		public:      private.Public(),
+		createdAt:   row.CreatedAt,
+		activatesAt: row.CreatedAt,
+		retiredAt:   row.RetiredAt,
+	}
+	if row.ActivatesAt != nil {
+		key.activatesAt = *row.ActivatesAt
+	}
+	return key, nil
+}
+
+func isEd25519(key crypto.Signer) bool {
+	_, ok := key.(ed25519.PrivateKey)
+	return ok
+}
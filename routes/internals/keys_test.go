@@ -0,0 +1,91 @@
+package internals
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+)
+
+func jwksKids() []string {
+	var kids []string
+	for _, jwk := range JWKS()["keys"].([]map[string]any) {
+		kids = append(kids, jwk["kid"].(string))
+	}
+	return kids
+}
+
+func signedKid(t *testing.T, k *keyring) string {
+	t.Helper()
+	raw, err := k.sign(jwt.MapClaims{"sub": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Parse(raw, k.verificationKey)
+	if err != nil {
+		t.Fatalf("own token doesn't verify: %v", err)
+	}
+	return token.Header["kid"].(string)
+}
+
+func TestSigningKeyIsPublishedBeforeItSigns(t *testing.T) {
+	db := newTestDB(t)
+	k := &keyring{
+		db:        db,
+		algorithm: defaultJWTAlgorithm,
+		rotation:  time.Hour,
+		grace:     time.Hour,
+		keys:      make(map[string]*signingKey),
+	}
+	signingKeys = k
+	t.Cleanup(func() { signingKeys = nil })
+
+	// the very first key signs straight away
+	k.rotateIfDue()
+	first := k.current()
+	if first == nil || k.next != nil {
+		t.Fatalf("first key: current=%v next=%v", first, k.next)
+	}
+	if kid := signedKid(t, k); kid != first.id {
+		t.Fatalf("signed with %s, want %s", kid, first.id)
+	}
+
+	// once the first key is nearly due, its successor is published...
+	due := time.Now().Add(-k.rotation + keyPrepublish/2)
+	if err := db.Model(&models.SigningKey{}).Where("id = ?", first.id).Update("activates_at", due).Error; err != nil {
+		t.Fatal(err)
+	}
+	controller.Rdb.FlushAll(t.Context())
+	k.reload()
+	k.rotateIfDue()
+	next := k.next
+	if next == nil {
+		t.Fatal("no successor published")
+	}
+	if until := time.Until(next.activatesAt); until < keyPrepublish-time.Minute {
+		t.Errorf("successor signs in %s, want about %s", until, keyPrepublish)
+	}
+	if kids := jwksKids(); len(kids) != 2 || kids[0] != next.id || kids[1] != first.id {
+		t.Errorf("JWKS has %v, want [%s %s]", kids, next.id, first.id)
+	}
+
+	// ...but the first key keeps signing, and nothing more is published
+	controller.Rdb.FlushAll(t.Context())
+	k.rotateIfDue()
+	if k.next != next || len(k.keys) != 2 {
+		t.Errorf("published another key while one was pending")
+	}
+	if kid := signedKid(t, k); kid != first.id {
+		t.Errorf("signed with %s before the successor's time, want %s", kid, first.id)
+	}
+
+	// at its time the successor takes over, even before the next reload
+	k.mu.Lock()
+	next.activatesAt = time.Now()
+	k.mu.Unlock()
+	if kid := signedKid(t, k); kid != next.id {
+		t.Errorf("signed with %s after the successor's time, want %s", kid, next.id)
+	}
+}
@@ -0,0 +1,268 @@
+package internals
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+const (
+	ldapProvider       = "ldap"
+	defaultLDAPTimeout = 10 * time.Second
+)
+
+// ldapAuthenticator checks passwords by binding to the directory as the
+// user. No service account is needed: everything it reads afterwards, it
+// reads with the user's own rights.
+type ldapAuthenticator struct {
+	url           string
+	startTLS      bool
+	timeout       time.Duration
+	bindTemplates []string
+	baseDN        string
+	userFilter    string
+	nameAttribute string
+	idAttribute   string
+	allowedGroups []string
+}
+
+func newLDAPAuthenticator() (*ldapAuthenticator, error) {
+	a := &ldapAuthenticator{
+		url:           os.Getenv("LDAP_URL"),
+		startTLS:      envBool("LDAP_START_TLS", false),
+		timeout:       envDuration("LDAP_TIMEOUT", defaultLDAPTimeout),
+		bindTemplates: envList("LDAP_BIND_DN_TEMPLATE", ";"),
+		baseDN:        os.Getenv("LDAP_BASE_DN"),
+		userFilter:    os.Getenv("LDAP_USER_FILTER"),
+		nameAttribute: envString("LDAP_DISPLAY_NAME_ATTRIBUTE", "displayName"),
+		idAttribute:   envString("LDAP_ID_ATTRIBUTE", "entryUUID"),
+		allowedGroups: envList("LDAP_ALLOWED_GROUPS", ";"),
+	}
+	if a.url == "" {
+		return nil, fmt.Errorf("LDAP_URL is not set")
+	}
+	if len(a.bindTemplates) == 0 {
+		return nil, fmt.Errorf("LDAP_BIND_DN_TEMPLATE is not set")
+	}
+	for _, template := range a.bindTemplates {
+		if !strings.Contains(template, "{username}") {
+			return nil, fmt.Errorf("LDAP_BIND_DN_TEMPLATE %q has no {username}", template)
+		}
+	}
+	if (a.userFilter == "") != (a.baseDN == "") {
+		return nil, fmt.Errorf("LDAP_USER_FILTER and LDAP_BASE_DN must be set together")
+	}
+	return a, nil
+}
+
+func (a *ldapAuthenticator) Name() string {
+	return ldapProvider
+}
+
+func (a *ldapAuthenticator) Authenticate(db *gorm.DB, username string, password string) (*models.User, error) {
+	// an empty password would be an anonymous bind, which always succeeds
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	dn, err := a.bind(conn, username, password)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := a.lookup(conn, dn, username)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed, err := a.inAllowedGroup(conn, entry, username)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		log.Printf("[WARN] LDAP user '%s' is in none of LDAP_ALLOWED_GROUPS", username)
+		return nil, ErrInvalidCredentials
+	}
+	return a.directoryUser(db, username, entry)
+}
+
+func (a *ldapAuthenticator) dial() (*ldap.Conn, error) {
+	u, err := url.Parse(a.url)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+
+	conn, err := ldap.DialURL(a.url,
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.timeout}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(a.timeout)
+	if a.startTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// bind tries each template in turn, so users from several branches of the
+// tree (or a DN and a UPN form) can log in.
+func (a *ldapAuthenticator) bind(conn *ldap.Conn, username string, password string) (string, error) {
+	for _, template := range a.bindTemplates {
+		dn := strings.ReplaceAll(template, "{username}", ldap.EscapeDN(username))
+		err := conn.Bind(dn, password)
+		if err == nil {
+			return dn, nil
+		}
+		if !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return "", err
+		}
+	}
+	return "", ErrInvalidCredentials
+}
+
+// lookup reads the user's entry: the bind DN itself, or with LDAP_USER_FILTER
+// a search under LDAP_BASE_DN for binds that don't use a DN (AD's UPNs).
+func (a *ldapAuthenticator) lookup(conn *ldap.Conn, dn string, username string) (*ldap.Entry, error) {
+	attributes := []string{a.nameAttribute, "cn", a.idAttribute, "memberOf"}
+	req := ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, int(a.timeout.Seconds()), false,
+		"(objectClass=*)", attributes, nil)
+	if a.userFilter != "" {
+		filter := strings.ReplaceAll(a.userFilter, "{username}", ldap.EscapeFilter(username))
+		req = ldap.NewSearchRequest(a.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(a.timeout.Seconds()), false,
+			filter, attributes, nil)
+	}
+
+	res, err := conn.Search(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Entries) != 1 {
+		return nil, fmt.Errorf("expected one directory entry for '%s', found %d", username, len(res.Entries))
+	}
+	return res.Entries[0], nil
+}
+
+// inAllowedGroup trusts memberOf when the directory provides it and
+// otherwise looks for the user among each group's members.
+func (a *ldapAuthenticator) inAllowedGroup(conn *ldap.Conn, entry *ldap.Entry, username string) (bool, error) {
+	if len(a.allowedGroups) == 0 {
+		return true, nil
+	}
+	for _, group := range entry.GetAttributeValues("memberOf") {
+		for _, allowed := range a.allowedGroups {
+			if strings.EqualFold(group, allowed) {
+				return true, nil
+			}
+		}
+	}
+
+	filter := fmt.Sprintf("(|(member=%s)(uniqueMember=%s)(memberUid=%s))",
+		ldap.EscapeFilter(entry.DN), ldap.EscapeFilter(entry.DN), ldap.EscapeFilter(username))
+	for _, group := range a.allowedGroups {
+		req := ldap.NewSearchRequest(group, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, int(a.timeout.Seconds()), false,
+			filter, []string{"1.1"}, nil)
+		res, err := conn.Search(req)
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			log.Printf("[WARN] LDAP group %q in LDAP_ALLOWED_GROUPS does not exist", group)
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if len(res.Entries) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// subject identifies the entry across renames. entryUUID (objectGUID on
+// AD, which is binary) is preferred; the DN is the fallback.
+func (a *ldapAuthenticator) subject(entry *ldap.Entry) string {
+	raw := entry.GetRawAttributeValue(a.idAttribute)
+	switch {
+	case len(raw) == 0:
+		return strings.ToLower(entry.DN)
+	case utf8.Valid(raw):
+		return string(raw)
+	default:
+		return hex.EncodeToString(raw)
+	}
+}
+
+// directoryUser finds or creates the user for a directory entry, and keeps
+// their display name in step with the directory.
+func (a *ldapAuthenticator) directoryUser(db *gorm.DB, username string, entry *ldap.Entry) (*models.User, error) {
+	displayName := entry.GetAttributeValue(a.nameAttribute)
+	if displayName == "" {
+		displayName = entry.GetAttributeValue("cn")
+	}
+	displayName = truncate(strings.TrimSpace(displayName), 64)
+
+	subject := a.subject(entry)
+	identity, err := controller.GetExternalIdentity(db, ldapProvider, subject)
+	if err == nil {
+		user, err := loadUser(db, identity.UserID)
+		if err != nil {
+			return nil, err
+		}
+		controller.TouchExternalIdentity(db, identity, identity.Email)
+		if displayName != "" && displayName != user.DisplayName {
+			if err := controller.SetUserDisplayName(db, user.ID, displayName); err == nil {
+				user.DisplayName = displayName
+			}
+		}
+		return user, nil
+	}
+	if !errors.Is(err, controller.ErrIdentityNotFound) {
+		return nil, err
+	}
+
+	if !autoCreateAllowed("LDAP_AUTO_CREATE", true) {
+		log.Printf("[WARN] LDAP user '%s' has no account and LDAP_AUTO_CREATE is off", username)
+		return nil, ErrInvalidCredentials
+	}
+	// a local account with the same name belongs to someone else as far as
+	// we know; never hand it over to the directory user
+	taken, err := controller.UsernameTaken(db, username)
+	if err != nil {
+		return nil, err
+	}
+	if taken || ValidateUsername(username) != nil {
+		log.Printf("[WARN] Can't create an account for LDAP user '%s': username is taken or not allowed", username)
+		return nil, ErrInvalidCredentials
+	}
+
+	if displayName == "" {
+		displayName = username
+	}
+	user := &models.User{Username: username, DisplayName: displayName}
+	err = controller.CreateUserWithIdentity(db, user, &models.ExternalIdentity{Provider: ldapProvider, Subject: subject})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
@@ -0,0 +1,168 @@
+package internals
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+const (
+	loginFailureWindow = 15 * time.Minute
+	maxLoginBackoff    = 5 * time.Minute
+
+	userFreeAttempts = 3
+	ipFreeAttempts   = 10
+
+	defaultLockoutThreshold = 10
+	defaultLockoutDuration  = 15 * time.Minute
+
+	// an address is shared by everyone behind the same NAT, so it gets this
+	// many times the per-username allowance
+	ipThresholdFactor = 5
+)
+
+// LoginThrottledError is returned while logins are held back. It says the
+// same thing whether or not the username exists.
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LoginThrottledError) Error() string {
+	return fmt.Sprintf("too many login attempts, retry after %s", e.RetryAfter)
+}
+
+type throttlePolicy struct {
+	kind      string
+	free      int64
+	lockoutAt int64
+}
+
+type throttleSubject struct {
+	policy throttlePolicy
+	value  string
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// --- Login Throttling ---
+
+func lockoutThreshold() int64 {
+	if value := os.Getenv("LOGIN_LOCKOUT_THRESHOLD"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err == nil && n > userFreeAttempts {
+			return n
+		}
+		log.Printf("[WARN] Invalid LOGIN_LOCKOUT_THRESHOLD %q, using %d", value, defaultLockoutThreshold)
+	}
+	return defaultLockoutThreshold
+}
+
+func lockoutDuration() time.Duration {
+	return envDuration("LOGIN_LOCKOUT_DURATION", defaultLockoutDuration)
+}
+
+func throttleSubjects(username string, ip string) []throttleSubject {
+	threshold := lockoutThreshold()
+	subjects := []throttleSubject{}
+	if username = strings.ToLower(strings.TrimSpace(username)); username != "" {
+		subjects = append(subjects, throttleSubject{
+			policy: throttlePolicy{kind: "user", free: userFreeAttempts, lockoutAt: threshold},
+			value:  username,
+		})
+	}
+	if ip != "" {
+		subjects = append(subjects, throttleSubject{
+			policy: throttlePolicy{kind: "ip", free: ipFreeAttempts, lockoutAt: threshold * ipThresholdFactor},
+			value:  ip,
+		})
+	}
+	return subjects
+}
+
+// CheckLoginAllowed fails with a LoginThrottledError while the username or
+// the address is backing off or locked out. If Redis can't be reached logins
+// are let through rather than locking everybody out.
+func CheckLoginAllowed(username string, ip string) error {
+	var wait time.Duration
+	for _, subject := range throttleSubjects(username, ip) {
+		blocked, err := controller.LoginBlockedFor(subject.policy.kind, subject.value)
+		if err != nil {
+			continue
+		}
+		wait = max(wait, blocked)
+	}
+	if wait > 0 {
+		log.Printf("[WARN] Login for username='%s' from %s throttled for %s", username, ip, wait)
+		return &LoginThrottledError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// RecordFailedLogin counts a failed attempt against the username and the
+// address. Past the free attempts each failure doubles the wait before the
+// next try; at the threshold the subject is locked out and audited. user is
+// nil when the username doesn't exist, which changes nothing but the audit
+// entry.
+func RecordFailedLogin(db *gorm.DB, username string, ip string, user *models.User) {
+	for _, subject := range throttleSubjects(username, ip) {
+		policy := subject.policy
+		failures, err := controller.RecordLoginFailure(policy.kind, subject.value, loginFailureWindow)
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case failures >= policy.lockoutAt:
+			// start counting afresh once the lockout is over
+			lockout := lockoutDuration()
+			controller.ClearLoginFailures(policy.kind, subject.value)
+			if err := controller.BlockLogin(policy.kind, subject.value, "lockout", lockout); err != nil {
+				continue
+			}
+
+			entry := &models.AuditEntry{
+				Action:  models.AuditLoginLockout,
+				Subject: policy.kind + ":" + subject.value,
+				IP:      ip,
+				Details: fmt.Sprintf("%d failed logins within %s, locked for %s", failures, loginFailureWindow, lockout),
+			}
+			if policy.kind == "user" && user != nil {
+				entry.UserID = &user.ID
+			}
+			controller.CreateAuditEntry(db, entry)
+
+		case failures > policy.free:
+			exponent := float64(failures - policy.free - 1)
+			backoff := min(time.Duration(math.Pow(2, exponent))*time.Second, maxLoginBackoff)
+			controller.BlockLogin(policy.kind, subject.value, "backoff", backoff)
+		}
+	}
+}
+
+// ResetLoginFailures forgets the username's failures after a successful
+// login. The address keeps its count; one good password shouldn't buy a
+// fresh allowance for every other account tried from there.
+func ResetLoginFailures(username string) {
+	controller.ClearLoginFailures("user", strings.ToLower(strings.TrimSpace(username)))
+}
+
+// burnPasswordCheck spends as long as a real password check, so unknown
+// usernames can't be told apart by response time.
+func burnPasswordCheck(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = HashPassword("ping-dummy-password")
+	})
+	CheckPasswordHash(dummyHash, password)
+}
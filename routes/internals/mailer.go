@@ -0,0 +1,212 @@
+package internals
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Mail ---
+
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers account mail. SMTP is for production; the file mailer
+// appends messages to a file (or the log) so development setups and tests
+// can pick up links without a mail server.
+type Mailer interface {
+	Send(msg MailMessage) error
+}
+
+var errNoMailer = errors.New("MAILER is not set")
+
+var mailer Mailer = noMailer{}
+
+// InitMailer picks the mailer. Mail carries reset and verification tokens, so
+// it only goes to the log when MAILER=log asks for that; with MAILER unset it
+// isn't delivered at all.
+func InitMailer() {
+	switch kind := strings.ToLower(os.Getenv("MAILER")); kind {
+	case "":
+		mailer = noMailer{}
+		log.Println("[WARN] MAILER is not set, account mail (password resets, email verification) won't be delivered")
+	case "log":
+		mailer = &fileMailer{}
+		log.Println("[INFO] Mail is written to the log")
+	case "file":
+		path := os.Getenv("MAIL_FILE")
+		if path == "" {
+			log.Fatalf("[FATAL] MAILER=file needs MAIL_FILE")
+		}
+		mailer = &fileMailer{path: path}
+		log.Printf("[INFO] Mail is appended to %s", path)
+	case "smtp":
+		m, err := newSMTPMailer()
+		if err != nil {
+			log.Fatalf("[FATAL] Invalid SMTP configuration: %v", err)
+		}
+		mailer = m
+		log.Printf("[INFO] Mail is sent through %s", m.addr)
+	default:
+		log.Fatalf("[FATAL] Unknown MAILER %q (expected 'log', 'file' or 'smtp')", kind)
+	}
+}
+
+func mailFrom() string {
+	if from := os.Getenv("MAIL_FROM"); from != "" {
+		return from
+	}
+	return "ping <no-reply@localhost>"
+}
+
+// sendMail delivers in the background. Callers never wait on the mail
+// server, and a request for an unknown address takes as long as one for a
+// known one.
+func sendMail(msg MailMessage) {
+	go func() {
+		if err := mailer.Send(msg); err != nil {
+			log.Printf("[ERROR] Failed to send '%s' to %s: %v", msg.Subject, msg.To, err)
+			return
+		}
+		log.Printf("[INFO] Sent '%s' to %s", msg.Subject, msg.To)
+	}()
+}
+
+func formatMail(from string, msg MailMessage) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	buf.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return buf.Bytes()
+}
+
+// noMailer drops mail, so the tokens in it don't end up in the log.
+type noMailer struct{}
+
+func (noMailer) Send(msg MailMessage) error {
+	return errNoMailer
+}
+
+type fileMailer struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (m *fileMailer) Send(msg MailMessage) error {
+	raw := formatMail(mailFrom(), msg)
+	if m.path == "" {
+		log.Printf("[INFO] Mail:\n%s", raw)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.OpenFile(m.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintf(f, "%s\r\n\r\n", raw)
+	return err
+}
+
+// smtpMailer uses STARTTLS when the server offers it, or TLS from the start
+// on port 465.
+type smtpMailer struct {
+	addr     string
+	host     string
+	username string
+	password string
+}
+
+func newSMTPMailer() (*smtpMailer, error) {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil, fmt.Errorf("SMTP_HOST is not set")
+	}
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+	if _, err := mail.ParseAddress(mailFrom()); err != nil {
+		return nil, fmt.Errorf("invalid MAIL_FROM: %w", err)
+	}
+	return &smtpMailer{
+		addr:     net.JoinHostPort(host, port),
+		host:     host,
+		username: os.Getenv("SMTP_USERNAME"),
+		password: os.Getenv("SMTP_PASSWORD"),
+	}, nil
+}
+
+func (m *smtpMailer) Send(msg MailMessage) error {
+	from, err := mail.ParseAddress(mailFrom())
+	if err != nil {
+		return err
+	}
+
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if strings.HasSuffix(m.addr, ":465") {
+		conn, err = tls.DialWithDialer(dialer, "tcp", m.addr, &tls.Config{ServerName: m.host})
+	} else {
+		conn, err = dialer.Dial("tcp", m.addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(time.Minute))
+
+	client, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return err
+		}
+	}
+	if m.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(formatMail(mailFrom(), msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
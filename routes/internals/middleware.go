@@ -6,6 +6,8 @@ import (
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/rtk-rnjn/ping/config"
+	"github.com/rtk-rnjn/ping/controller"
 )
 
 func MiddlewareJWTAuth() gin.HandlerFunc {
@@ -30,9 +32,26 @@ func MiddlewareJWTAuth() gin.HandlerFunc {
 			log.Println("[WARN] Suspiciously short token")
 		}
 
+		if IsPersonalAccessToken(token) {
+			user, pat, err := ValidatePersonalAccessToken(config.DB, token)
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+				c.Abort()
+				return
+			}
+			controller.TouchPersonalAccessToken(config.DB, pat, c.ClientIP())
+
+			log.Printf("[INFO] Access token ID=%d accepted for user ID=%d", pat.ID, user.ID)
+			c.Set("user", user)
+			c.Set(accessTokenIDKey, pat.ID)
+			c.Set(tokenScopesKey, pat.ScopeList)
+			c.Next()
+			return
+		}
+
 		log.Printf("[INFO] Validating JWT: %.10s...", token) // print first 10 chars for trace
 
-		user, err := ValidateJWT(token)
+		user, claims, err := ValidateJWT(token)
 		if err != nil {
 			log.Printf("[ERROR] JWT validation failed: %v", err)
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
@@ -40,8 +59,18 @@ func MiddlewareJWTAuth() gin.HandlerFunc {
 			return
 		}
 
+		session, err := CheckSession(config.DB, claims)
+		if err != nil {
+			log.Printf("[WARN] Session check failed for user ID=%d: %v", user.ID, err)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
+			c.Abort()
+			return
+		}
+		controller.TouchSession(session)
+
 		log.Printf("[INFO] JWT validated successfully for user ID=%d", user.ID)
 		c.Set("user", user)
+		c.Set("session_id", claims.SessionID)
 		c.Next()
 	}
 }
@@ -0,0 +1,177 @@
+package internals
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockIdP is a small OpenID provider for tests: discovery, JWKS, an
+// authorization endpoint that approves everybody straight away and a token
+// endpoint that checks the client, the redirect URI and PKCE.
+type mockIdP struct {
+	*httptest.Server
+
+	ClientID     string
+	ClientSecret string
+	Key          *rsa.PrivateKey
+	KeyID        string
+
+	// Claims are put in the next ID tokens, on top of iss, aud, exp, iat
+	// and nonce. Tamper, when set, gets the last word on them.
+	Claims jwt.MapClaims
+	Tamper func(jwt.MapClaims)
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+type mockGrant struct {
+	challenge   string
+	nonce       string
+	redirectURI string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{
+		ClientID:     "ping-test",
+		ClientSecret: "s3cret",
+		Key:          key,
+		KeyID:        "test-key",
+		Claims:       jwt.MapClaims{},
+		codes:        make(map[string]mockGrant),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("GET /jwks", idp.jwks)
+	mux.HandleFunc("GET /authorize", idp.authorize)
+	mux.HandleFunc("POST /token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+func (idp *mockIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{
+		"issuer":                 idp.URL,
+		"authorization_endpoint": idp.URL + "/authorize",
+		"token_endpoint":         idp.URL + "/token",
+		"jwks_uri":               idp.URL + "/jwks",
+	})
+}
+
+func (idp *mockIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := idp.Key.PublicKey
+	writeJSON(w, http.StatusOK, map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": idp.KeyID,
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}}})
+}
+
+func (idp *mockIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != idp.ClientID ||
+		q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+	code, _ := randomToken(16)
+	idp.mu.Lock()
+	idp.codes[code] = mockGrant{
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+		redirectURI: q.Get("redirect_uri"),
+	}
+	idp.mu.Unlock()
+
+	back, _ := url.Parse(q.Get("redirect_uri"))
+	query := back.Query()
+	query.Set("code", code)
+	query.Set("state", q.Get("state"))
+	back.RawQuery = query.Encode()
+	http.Redirect(w, r, back.String(), http.StatusFound)
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	id, secret, _ := r.BasicAuth()
+	if id != idp.ClientID || secret != idp.ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	idp.mu.Lock()
+	grant, ok := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	idp.mu.Unlock()
+
+	switch {
+	case r.PostFormValue("grant_type") != "authorization_code", !ok:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	case r.PostFormValue("redirect_uri") != grant.redirectURI:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "redirect_uri"})
+		return
+	case pkceChallenge(r.PostFormValue("code_verifier")) != grant.challenge:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "code_verifier"})
+		return
+	}
+
+	claims := jwt.MapClaims{"nonce": grant.nonce}
+	writeJSON(w, http.StatusOK, map[string]string{
+		"access_token": "unused",
+		"token_type":   "Bearer",
+		"id_token":     idp.Sign(claims),
+	})
+}
+
+// Sign issues an ID token for this client with Claims and extra merged in.
+func (idp *mockIdP) Sign(extra jwt.MapClaims) string {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss": idp.URL,
+		"aud": idp.ClientID,
+		"iat": now.Unix(),
+		"exp": now.Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range idp.Claims {
+		claims[k] = v
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	if idp.Tamper != nil {
+		idp.Tamper(claims)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = idp.KeyID
+	signed, err := token.SignedString(idp.Key)
+	if err != nil {
+		panic(err)
+	}
+	return signed
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
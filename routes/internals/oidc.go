@@ -0,0 +1,749 @@
+package internals
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultOIDCScopes = "openid profile email"
+	SSOStateTTL       = 10 * time.Minute
+	ssoHandoffTTL     = time.Minute
+	oidcHTTPTimeout   = 10 * time.Second
+	oidcKeysMaxAge    = time.Hour
+	oidcKeysCooldown  = 30 * time.Second
+	oidcMaxResponse   = 1 << 20
+	maxUsernameLength = 32
+)
+
+var (
+	ErrSSODisabled        = errors.New("single sign-on is not configured")
+	ErrSSOFailed          = errors.New("single sign-on failed")
+	ErrSSONoAccount       = errors.New("no account is linked to this identity")
+	ErrSSOAccountDisabled = errors.New("account disabled")
+	ErrSSOHandoffInvalid  = errors.New("invalid or expired code")
+	ErrSSOWrongBrowser    = errors.New("single sign-on was started in another browser")
+	ErrLastLoginMethod    = errors.New("set a password before unlinking your only identity")
+)
+
+var usernameUnsafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// oidcProvider is the one identity provider the instance trusts. Discovery
+// and keys are fetched on first use, so the server starts even while the
+// provider is down.
+type oidcProvider struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	clientAuth   string
+	redirectURL  string
+	scopes       string
+
+	usernameClaim    string
+	displayNameClaim string
+	emailClaim       string
+	linkByEmail      bool
+
+	client *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// SSOLogin is someone the identity provider vouched for. LinkCode is set,
+// and User isn't, when the flow was started to add an identity to a
+// signed-in user rather than to log in.
+type SSOLogin struct {
+	User       *models.User
+	DeviceName string
+	LinkCode   string
+}
+
+var oidc *oidcProvider
+
+func envBool(name string, fallback bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("[WARN] Invalid %s %q, using %t", name, value, fallback)
+		return fallback
+	}
+	return b
+}
+
+func envString(name string, fallback string) string {
+	if value := strings.TrimSpace(os.Getenv(name)); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// --- Setup ---
+
+func InitOIDC() {
+	issuer := strings.TrimSpace(os.Getenv("OIDC_ISSUER"))
+	if issuer == "" {
+		log.Printf("[INFO] OIDC_ISSUER not set, single sign-on is off")
+		return
+	}
+
+	p := &oidcProvider{
+		issuer:           issuer,
+		clientID:         os.Getenv("OIDC_CLIENT_ID"),
+		clientSecret:     os.Getenv("OIDC_CLIENT_SECRET"),
+		clientAuth:       envString("OIDC_CLIENT_AUTH", "client_secret_basic"),
+		redirectURL:      os.Getenv("OIDC_REDIRECT_URL"),
+		scopes:           envString("OIDC_SCOPES", defaultOIDCScopes),
+		usernameClaim:    envString("OIDC_USERNAME_CLAIM", "preferred_username"),
+		displayNameClaim: envString("OIDC_DISPLAY_NAME_CLAIM", "name"),
+		emailClaim:       envString("OIDC_EMAIL_CLAIM", "email"),
+		linkByEmail:      envBool("OIDC_LINK_BY_EMAIL", false),
+		client:           &http.Client{Timeout: oidcHTTPTimeout},
+	}
+	if p.clientID == "" || p.redirectURL == "" {
+		log.Printf("[ERROR] OIDC_ISSUER is set but OIDC_CLIENT_ID or OIDC_REDIRECT_URL is missing, single sign-on is off")
+		return
+	}
+	if p.clientAuth != "client_secret_basic" && p.clientAuth != "client_secret_post" {
+		log.Printf("[WARN] Invalid OIDC_CLIENT_AUTH %q, using client_secret_basic", p.clientAuth)
+		p.clientAuth = "client_secret_basic"
+	}
+	if !strings.Contains(" "+p.scopes+" ", " openid ") {
+		p.scopes = "openid " + p.scopes
+	}
+
+	oidc = p
+	log.Printf("[INFO] Single sign-on enabled with %s", issuer)
+}
+
+func SSOEnabled() bool {
+	return oidc != nil
+}
+
+func (p *oidcProvider) getJSON(endpoint string, out any) error {
+	resp, err := p.client.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", endpoint, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponse)).Decode(out)
+}
+
+func (p *oidcProvider) config() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := p.getJSON(strings.TrimRight(p.issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		log.Printf("[ERROR] OIDC discovery failed: %v", err)
+		return nil, err
+	}
+	if d.Issuer != p.issuer {
+		log.Printf("[ERROR] OIDC discovery names issuer %q, expected %q", d.Issuer, p.issuer)
+		return nil, fmt.Errorf("issuer mismatch")
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("incomplete discovery document")
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// --- Provider Keys ---
+
+// key finds the provider's key for a kid. Keys are refetched when they're
+// old, or when an unknown kid turns up because the provider rotated.
+func (p *oidcProvider) key(kid string) (crypto.PublicKey, error) {
+	d, err := p.config()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lookup := func() crypto.PublicKey {
+		if kid == "" && len(p.keys) == 1 {
+			for _, k := range p.keys {
+				return k
+			}
+		}
+		return p.keys[kid]
+	}
+
+	stale := time.Since(p.keysFetched) > oidcKeysMaxAge
+	if k := lookup(); k != nil && !stale {
+		return k, nil
+	}
+	if !stale && time.Since(p.keysFetched) < oidcKeysCooldown {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	p.keysFetched = time.Now()
+	if err := p.getJSON(d.JWKSURI, &set); err != nil {
+		log.Printf("[ERROR] Failed to fetch OIDC keys: %v", err)
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		k, err := parseJWK(jwk)
+		if err != nil {
+			log.Printf("[WARN] Skipping OIDC key %q: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = k
+	}
+	p.keys = keys
+	log.Printf("[INFO] Loaded %d OIDC signing keys", len(keys))
+
+	if k := lookup(); k != nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+func parseJWK(jwk jsonWebKey) (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(b) == 0 {
+			return nil, fmt.Errorf("bad key parameter")
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("bad RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("bad Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+	}
+}
+
+// --- Authorization Code Flow ---
+
+func oidcStateKey(state string) string {
+	return "oidc:state:" + hashToken(state)
+}
+
+func ssoHandoffKey(code string) string {
+	return "sso:handoff:" + hashToken(code)
+}
+
+func ssoLinkKey(code string) string {
+	return "sso:link:" + hashToken(code)
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// BeginSSO returns the provider URL to send the browser to, and the value
+// of the cookie that binds the login to this browser; the callback only
+// completes a login for the browser holding it. A non-zero linkUserID links
+// the identity to that user instead of logging in.
+func BeginSSO(deviceName string, linkUserID uint64) (string, string, error) {
+	if oidc == nil {
+		return "", "", ErrSSODisabled
+	}
+	d, err := oidc.config()
+	if err != nil {
+		return "", "", ErrSSOFailed
+	}
+
+	state, err := randomToken(24)
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := randomToken(24)
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := randomToken(32)
+	if err != nil {
+		return "", "", err
+	}
+	err = controller.StoreLoginState(oidcStateKey(state), map[string]any{
+		"verifier":     verifier,
+		"nonce":        nonce,
+		"device_name":  truncate(deviceName, maxDeviceLength),
+		"link_user_id": linkUserID,
+	}, SSOStateTTL)
+	if err != nil {
+		return "", "", err
+	}
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidc.clientID},
+		"redirect_uri":          {oidc.redirectURL},
+		"scope":                 {oidc.scopes},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + query.Encode(), hashToken(state), nil
+}
+
+func (p *oidcProvider) exchangeCode(code string, verifier string) (string, error) {
+	d, err := p.config()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL},
+		"code_verifier": {verifier},
+		"client_id":     {p.clientID},
+	}
+	if p.clientSecret != "" && p.clientAuth == "client_secret_post" {
+		form.Set("client_secret", p.clientSecret)
+	}
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" && p.clientAuth == "client_secret_basic" {
+		req.SetBasicAuth(url.QueryEscape(p.clientID), url.QueryEscape(p.clientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponse)).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || body.Error != "" {
+		return "", fmt.Errorf("token endpoint: %s %s %s", resp.Status, body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", fmt.Errorf("token endpoint returned no id_token")
+	}
+	return body.IDToken, nil
+}
+
+func (p *oidcProvider) verifyIDToken(raw string, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims,
+		func(t *jwt.Token) (any, error) {
+			kid, _ := t.Header["kid"].(string)
+			return p.key(kid)
+		},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384", "EdDSA"}),
+		jwt.WithIssuer(p.issuer),
+		jwt.WithAudience(p.clientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// with more than one audience the token must say it was issued to us
+	aud, _ := claims.GetAudience()
+	azp, _ := claims["azp"].(string)
+	if (len(aud) > 1 || azp != "") && azp != p.clientID {
+		return nil, fmt.Errorf("token was issued to %q", azp)
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, fmt.Errorf("nonce mismatch")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, fmt.Errorf("token has no subject")
+	}
+	return claims, nil
+}
+
+func stringClaim(claims jwt.MapClaims, name string) string {
+	value, _ := claims[name].(string)
+	return strings.TrimSpace(value)
+}
+
+// emailVerified accepts the "true" string some providers send as well as a
+// proper boolean.
+func emailVerified(claims jwt.MapClaims) bool {
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		return v
+	case string:
+		return v == "true"
+	}
+	return false
+}
+
+// CompleteSSO handles the provider's redirect back: it checks the state and
+// that a login comes back to the browser that started it (binding is that
+// browser's cookie), redeems the code, verifies the ID token and works out
+// which user it is.
+//
+// Linking is never done here. Whoever started it may have had somebody
+// else's browser finish it, so the identity is parked under a LinkCode that
+// only the user who asked for the link can redeem.
+func CompleteSSO(db *gorm.DB, state string, binding string, code string, client ClientInfo) (*SSOLogin, error) {
+	if oidc == nil {
+		return nil, ErrSSODisabled
+	}
+	saved, err := controller.TakeLoginState(oidcStateKey(state))
+	if err != nil {
+		log.Printf("[WARN] SSO callback with unknown state from %s", client.IP)
+		return nil, ErrSSOFailed
+	}
+	linkUserID, _ := strconv.ParseUint(saved["link_user_id"], 10, 64)
+	if linkUserID == 0 && !hmac.Equal([]byte(binding), []byte(hashToken(state))) {
+		log.Printf("[WARN] SSO callback from %s without the browser binding of its state", client.IP)
+		return nil, ErrSSOWrongBrowser
+	}
+
+	idToken, err := oidc.exchangeCode(code, saved["verifier"])
+	if err != nil {
+		log.Printf("[ERROR] SSO code exchange failed: %v", err)
+		return nil, ErrSSOFailed
+	}
+	claims, err := oidc.verifyIDToken(idToken, saved["nonce"])
+	if err != nil {
+		log.Printf("[WARN] Rejected SSO ID token: %v", err)
+		return nil, ErrSSOFailed
+	}
+
+	login := &SSOLogin{DeviceName: saved["device_name"]}
+	if linkUserID != 0 {
+		login.LinkCode, err = parkIdentity(linkUserID, claims)
+		return login, err
+	}
+	login.User, err = resolveIdentity(db, claims, client)
+	if err != nil {
+		return nil, err
+	}
+	if login.User.DisabledAt != nil {
+		log.Printf("[WARN] SSO login for disabled userID=%d", login.User.ID)
+		return nil, ErrSSOAccountDisabled
+	}
+	return login, nil
+}
+
+func newIdentity(claims jwt.MapClaims) *models.ExternalIdentity {
+	return &models.ExternalIdentity{
+		Provider: oidc.issuer,
+		Subject:  stringClaim(claims, "sub"),
+		Email:    truncate(stringClaim(claims, oidc.emailClaim), 254),
+	}
+}
+
+// parkIdentity keeps a verified identity for the user who asked to link it,
+// under a short-lived code.
+func parkIdentity(userID uint64, claims jwt.MapClaims) (string, error) {
+	identity := newIdentity(claims)
+	code, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	err = controller.StoreLoginState(ssoLinkKey(code), map[string]any{
+		"link_user_id": userID,
+		"provider":     identity.Provider,
+		"subject":      identity.Subject,
+		"email":        identity.Email,
+	}, ssoHandoffTTL)
+	return code, err
+}
+
+// ConfirmIdentityLink links the identity parked under the code to the user,
+// provided they are the one who started linking it.
+func ConfirmIdentityLink(db *gorm.DB, user *models.User, code string, client ClientInfo) error {
+	saved, err := controller.TakeLoginState(ssoLinkKey(code))
+	if err != nil {
+		return ErrSSOHandoffInvalid
+	}
+	if saved["link_user_id"] != strconv.FormatUint(user.ID, 10) {
+		log.Printf("[WARN] userID=%d tried to redeem a link code started by userID=%s", user.ID, saved["link_user_id"])
+		return ErrSSOHandoffInvalid
+	}
+
+	identity := &models.ExternalIdentity{
+		UserID:   user.ID,
+		Provider: saved["provider"],
+		Subject:  saved["subject"],
+		Email:    saved["email"],
+	}
+	if err := controller.LinkExternalIdentity(db, identity); err != nil {
+		return err
+	}
+	audit(db, models.AuditIdentityLinked, user, client.IP, identity.Provider)
+	return nil
+}
+
+// resolveIdentity finds the user behind an identity: one already linked,
+// an existing user with the same verified address when OIDC_LINK_BY_EMAIL
+// allows it, or a new user when OIDC_AUTO_CREATE does.
+func resolveIdentity(db *gorm.DB, claims jwt.MapClaims, client ClientInfo) (*models.User, error) {
+	identity := newIdentity(claims)
+	email := ""
+	if emailVerified(claims) {
+		email, _ = NormalizeEmail(identity.Email)
+	}
+
+	existing, err := controller.GetExternalIdentity(db, identity.Provider, identity.Subject)
+	if err == nil {
+		controller.TouchExternalIdentity(db, existing, identity.Email)
+		return loadUser(db, existing.UserID)
+	}
+	if !errors.Is(err, controller.ErrIdentityNotFound) {
+		return nil, err
+	}
+
+	if oidc.linkByEmail && email != "" {
+		user, err := controller.GetUserByEmail(db, email)
+		if err == nil && !user.EmailPending() {
+			identity.UserID = user.ID
+			if err := controller.LinkExternalIdentity(db, identity); err != nil {
+				return nil, err
+			}
+			audit(db, models.AuditIdentityLinked, user, client.IP, identity.Provider+" (matched by email)")
+			return user, nil
+		}
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+
+	if !autoCreateAllowed("OIDC_AUTO_CREATE", false) {
+		log.Printf("[WARN] SSO login for unlinked subject at %s and OIDC_AUTO_CREATE is off", identity.Provider)
+		return nil, ErrSSONoAccount
+	}
+	return provisionUser(db, claims, identity, email)
+}
+
+// provisionUser creates a user without a password. Their address is kept
+// only if the provider verified it and nobody else here has it.
+func provisionUser(db *gorm.DB, claims jwt.MapClaims, identity *models.ExternalIdentity, email string) (*models.User, error) {
+	base := stringClaim(claims, oidc.usernameClaim)
+	if base == "" {
+		base, _, _ = strings.Cut(email, "@")
+	}
+	username, err := freeUsername(db, base)
+	if err != nil {
+		return nil, err
+	}
+
+	displayName := truncate(stringClaim(claims, oidc.displayNameClaim), 64)
+	if displayName == "" {
+		displayName = username
+	}
+	user := &models.User{Username: username, DisplayName: displayName}
+	if email != "" {
+		if taken, err := controller.EmailInUse(db, email, 0); err == nil && !taken {
+			now := time.Now()
+			user.Email = &email
+			user.EmailVerifiedAt = &now
+		}
+	}
+
+	if err := controller.CreateUserWithIdentity(db, user, identity); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// freeUsername cleans up what the provider suggested and, when it's taken,
+// appends -2, -3 and so on.
+func freeUsername(db *gorm.DB, base string) (string, error) {
+	base = strings.Trim(usernameUnsafe.ReplaceAllString(base, "-"), "-._")
+	if len(base) < minUsernameLength {
+		base = "user"
+	}
+	for n := 1; n <= 100; n++ {
+		suffix := ""
+		if n > 1 {
+			suffix = "-" + strconv.Itoa(n)
+		}
+		candidate := truncate(base, maxUsernameLength-len(suffix)) + suffix
+		taken, err := controller.UsernameTaken(db, candidate)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("no free username for %q", base)
+}
+
+// --- Handoff ---
+
+// CreateSSOHandoff parks a finished SSO login under a short-lived code, so
+// tokens never travel in a redirect URL. The app trades the code for them.
+func CreateSSOHandoff(login *SSOLogin) (string, error) {
+	code, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	err = controller.StoreLoginState(ssoHandoffKey(code), map[string]any{
+		"user_id":     login.User.ID,
+		"device_name": login.DeviceName,
+	}, ssoHandoffTTL)
+	return code, err
+}
+
+func ExchangeSSOHandoff(db *gorm.DB, code string, client ClientInfo) (*TokenPair, *TwoFactorChallenge, error) {
+	saved, err := controller.TakeLoginState(ssoHandoffKey(code))
+	if err != nil {
+		return nil, nil, ErrSSOHandoffInvalid
+	}
+	userID, _ := strconv.ParseUint(saved["user_id"], 10, 64)
+	user, err := loadUser(db, userID)
+	if err != nil {
+		return nil, nil, ErrSSOHandoffInvalid
+	}
+	if user.DisabledAt != nil {
+		return nil, nil, ErrSSOAccountDisabled
+	}
+	if client.DeviceName == "" {
+		client.DeviceName = saved["device_name"]
+	}
+	return finishLogin(db, user, client)
+}
+
+// FinishSSOLogin logs in the user the provider vouched for. 2FA still
+// applies: the provider proves who they are, not that they hold their phone.
+func FinishSSOLogin(db *gorm.DB, login *SSOLogin, client ClientInfo) (*TokenPair, *TwoFactorChallenge, error) {
+	if client.DeviceName == "" {
+		client.DeviceName = login.DeviceName
+	}
+	return finishLogin(db, login.User, client)
+}
+
+// --- Linked Identities ---
+
+// UnlinkIdentity refuses to remove the last way into an account that has
+// no password.
+func UnlinkIdentity(db *gorm.DB, userID uint64, identityID uint64) error {
+	user, err := loadUser(db, userID)
+	if err != nil {
+		return err
+	}
+	if user.PasswordHash == "" {
+		count, err := controller.CountUserIdentities(db, userID)
+		if err != nil {
+			return err
+		}
+		if count <= 1 {
+			return ErrLastLoginMethod
+		}
+	}
+	return controller.DeleteExternalIdentity(db, userID, identityID)
+}
@@ -0,0 +1,425 @@
+package internals
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+	"github.com/rtk-rnjn/ping/config"
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const testRedirectURL = "https://ping.test/auth/oidc/callback"
+
+var testClient = ClientInfo{IP: "192.0.2.1"}
+
+// newTestDB gives the test an empty database of its own and a Redis to go
+// with it.
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	controller.Rdb = redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// setupSSO points single sign-on at a fresh mock provider.
+func setupSSO(t *testing.T) (*gorm.DB, *mockIdP) {
+	t.Helper()
+	db := newTestDB(t)
+	idp := newMockIdP(t)
+	t.Setenv("OIDC_ISSUER", idp.URL)
+	t.Setenv("OIDC_CLIENT_ID", idp.ClientID)
+	t.Setenv("OIDC_CLIENT_SECRET", idp.ClientSecret)
+	t.Setenv("OIDC_REDIRECT_URL", testRedirectURL)
+	InitOIDC()
+	t.Cleanup(func() { oidc = nil })
+	if !SSOEnabled() {
+		t.Fatal("single sign-on is not enabled")
+	}
+	return db, idp
+}
+
+// authorize plays the browser: it starts the flow, lets the provider approve
+// it and returns the state and code the provider redirected back with, along
+// with the browser's binding cookie.
+func authorize(t *testing.T, idp *mockIdP, linkUserID uint64) (string, string, string) {
+	t.Helper()
+	loginURL, binding, err := BeginSSO("laptop", linkUserID)
+	if err != nil {
+		t.Fatalf("BeginSSO: %v", err)
+	}
+	if !strings.HasPrefix(loginURL, idp.URL+"/authorize?") {
+		t.Fatalf("login URL %q doesn't go to the provider", loginURL)
+	}
+
+	browser := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := browser.Get(loginURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("provider answered %s", resp.Status)
+	}
+
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(back.String(), testRedirectURL+"?") {
+		t.Fatalf("provider redirected to %q", resp.Header.Get("Location"))
+	}
+	return back.Query().Get("state"), binding, back.Query().Get("code")
+}
+
+func countUsers(t *testing.T, db *gorm.DB) int64 {
+	t.Helper()
+	var n int64
+	if err := db.Model(&models.User{}).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func createTestUser(t *testing.T, db *gorm.DB, username string, email string) *models.User {
+	t.Helper()
+	user := &models.User{Username: username, DisplayName: username, PasswordHash: "x"}
+	if email != "" {
+		now := time.Now()
+		user.Email = &email
+		user.EmailVerifiedAt = &now
+	}
+	if err := controller.CreateUser(db, user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// --- Authorization Code Flow ---
+
+func TestSSOProvisionsUser(t *testing.T) {
+	t.Setenv("OIDC_AUTO_CREATE", "true")
+	db, idp := setupSSO(t)
+	idp.Claims = jwt.MapClaims{
+		"sub":                "u-1",
+		"preferred_username": "ann smith",
+		"name":               "Ann Smith",
+		"email":              "Ann@Example.com",
+		"email_verified":     true,
+	}
+
+	state, binding, code := authorize(t, idp, 0)
+	login, err := CompleteSSO(db, state, binding, code, testClient)
+	if err != nil {
+		t.Fatalf("CompleteSSO: %v", err)
+	}
+	user := login.User
+	if user.Username != "ann-smith" || user.DisplayName != "Ann Smith" || login.DeviceName != "laptop" || login.LinkCode != "" {
+		t.Errorf("got user %q (%q) on %q, link code %q", user.Username, user.DisplayName, login.DeviceName, login.LinkCode)
+	}
+	if user.Email == nil || *user.Email != "ann@example.com" || user.EmailPending() {
+		t.Errorf("email = %v, want verified ann@example.com", user.Email)
+	}
+	if user.PasswordHash != "" {
+		t.Error("provisioned user has a password")
+	}
+
+	// the second time the identity is known
+	state, binding, code = authorize(t, idp, 0)
+	again, err := CompleteSSO(db, state, binding, code, testClient)
+	if err != nil {
+		t.Fatalf("second CompleteSSO: %v", err)
+	}
+	if again.User.ID != user.ID || countUsers(t, db) != 1 {
+		t.Errorf("second login gave user ID=%d of %d, want the same user", again.User.ID, countUsers(t, db))
+	}
+}
+
+func TestSSOStateIsSingleUse(t *testing.T) {
+	t.Setenv("OIDC_AUTO_CREATE", "true")
+	db, idp := setupSSO(t)
+	idp.Claims = jwt.MapClaims{"sub": "u-1", "preferred_username": "ann"}
+
+	if _, err := CompleteSSO(db, "made-up", "", "code", testClient); !errors.Is(err, ErrSSOFailed) {
+		t.Errorf("unknown state: err = %v, want ErrSSOFailed", err)
+	}
+
+	state, binding, code := authorize(t, idp, 0)
+	if _, err := CompleteSSO(db, state, binding, code, testClient); err != nil {
+		t.Fatalf("CompleteSSO: %v", err)
+	}
+	if _, err := CompleteSSO(db, state, binding, code, testClient); !errors.Is(err, ErrSSOFailed) {
+		t.Errorf("replayed state: err = %v, want ErrSSOFailed", err)
+	}
+}
+
+func TestSSOCodeNeedsVerifier(t *testing.T) {
+	_, idp := setupSSO(t)
+	idp.Claims = jwt.MapClaims{"sub": "u-1"}
+
+	_, _, code := authorize(t, idp, 0)
+	if _, err := oidc.exchangeCode(code, "not-the-verifier"); err == nil {
+		t.Fatal("code redeemed without the PKCE verifier")
+	}
+}
+
+func TestSSOAutoCreate(t *testing.T) {
+	tests := []struct {
+		name       string
+		autoCreate string
+		mode       string
+		wantErr    error
+	}{
+		{"off by default", "", "", ErrSSONoAccount},
+		{"explicitly off", "false", "", ErrSSONoAccount},
+		{"on", "true", "", nil},
+		{"on while registration is closed", "true", RegistrationClosed, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OIDC_AUTO_CREATE", tt.autoCreate)
+			t.Setenv("REGISTRATION_MODE", tt.mode)
+			db, idp := setupSSO(t)
+			idp.Claims = jwt.MapClaims{"sub": "u-1", "preferred_username": "ann"}
+
+			state, binding, code := authorize(t, idp, 0)
+			_, err := CompleteSSO(db, state, binding, code, testClient)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if want := map[bool]int64{true: 0, false: 1}[tt.wantErr != nil]; countUsers(t, db) != want {
+				t.Errorf("%d users, want %d", countUsers(t, db), want)
+			}
+		})
+	}
+}
+
+func TestSSOProvisionedUsernameIsFree(t *testing.T) {
+	t.Setenv("OIDC_AUTO_CREATE", "true")
+	db, idp := setupSSO(t)
+	createTestUser(t, db, "ann", "")
+	idp.Claims = jwt.MapClaims{"sub": "u-1", "preferred_username": "ann"}
+
+	state, binding, code := authorize(t, idp, 0)
+	login, err := CompleteSSO(db, state, binding, code, testClient)
+	if err != nil {
+		t.Fatalf("CompleteSSO: %v", err)
+	}
+	if login.User.Username != "ann-2" {
+		t.Errorf("username = %q, want ann-2", login.User.Username)
+	}
+}
+
+// --- Identity Linking ---
+
+func TestSSOLinksIdentity(t *testing.T) {
+	db, idp := setupSSO(t)
+	bob := createTestUser(t, db, "bob", "")
+	idp.Claims = jwt.MapClaims{"sub": "u-bob", "email": "bob@corp.example"}
+
+	state, binding, code := authorize(t, idp, bob.ID)
+	login, err := CompleteSSO(db, state, binding, code, testClient)
+	if err != nil {
+		t.Fatalf("CompleteSSO: %v", err)
+	}
+	if login.LinkCode == "" || login.User != nil {
+		t.Fatalf("callback returned user %v and link code %q, want only a link code", login.User, login.LinkCode)
+	}
+	if _, err := controller.GetExternalIdentity(db, idp.URL, "u-bob"); err == nil {
+		t.Fatal("identity linked before bob confirmed it")
+	}
+
+	if err := ConfirmIdentityLink(db, bob, login.LinkCode, testClient); err != nil {
+		t.Fatalf("ConfirmIdentityLink: %v", err)
+	}
+	identity, err := controller.GetExternalIdentity(db, idp.URL, "u-bob")
+	if err != nil || identity.UserID != bob.ID {
+		t.Fatalf("identity = %+v, %v", identity, err)
+	}
+	if err := ConfirmIdentityLink(db, bob, login.LinkCode, testClient); !errors.Is(err, ErrSSOHandoffInvalid) {
+		t.Errorf("redeemed link code twice: err = %v", err)
+	}
+
+	// from now on the identity logs bob in, with no auto-creation needed
+	state, binding, code = authorize(t, idp, 0)
+	login, err = CompleteSSO(db, state, binding, code, testClient)
+	if err != nil {
+		t.Fatalf("login after linking: %v", err)
+	}
+	if login.LinkCode != "" || login.User.ID != bob.ID {
+		t.Errorf("logged in as user ID=%d (link code %q), want bob", login.User.ID, login.LinkCode)
+	}
+}
+
+func TestSSOLinkCodeIsForTheRequester(t *testing.T) {
+	db, idp := setupSSO(t)
+	bob := createTestUser(t, db, "bob", "")
+	mallory := createTestUser(t, db, "mallory", "")
+
+	// mallory starts linking their own provider account and gets bob's
+	// browser to finish it; the code it yields is no use to bob
+	idp.Claims = jwt.MapClaims{"sub": "u-mallory"}
+	state, _, code := authorize(t, idp, mallory.ID)
+	login, err := CompleteSSO(db, state, "", code, testClient)
+	if err != nil {
+		t.Fatalf("CompleteSSO: %v", err)
+	}
+	if err := ConfirmIdentityLink(db, bob, login.LinkCode, testClient); !errors.Is(err, ErrSSOHandoffInvalid) {
+		t.Fatalf("bob redeemed mallory's link code: err = %v", err)
+	}
+	if _, err := controller.GetExternalIdentity(db, idp.URL, "u-mallory"); err == nil {
+		t.Error("identity linked to somebody")
+	}
+}
+
+func TestSSOLoginNeedsTheStartingBrowser(t *testing.T) {
+	t.Setenv("OIDC_AUTO_CREATE", "true")
+	db, idp := setupSSO(t)
+	idp.Claims = jwt.MapClaims{"sub": "u-1", "preferred_username": "ann"}
+
+	// a callback URL opened in a browser that never started the login
+	for _, binding := range []string{"", hashToken("another state")} {
+		state, _, code := authorize(t, idp, 0)
+		if _, err := CompleteSSO(db, state, binding, code, testClient); !errors.Is(err, ErrSSOWrongBrowser) {
+			t.Errorf("binding %q: err = %v, want ErrSSOWrongBrowser", binding, err)
+		}
+	}
+	if n := countUsers(t, db); n != 0 {
+		t.Errorf("%d users created", n)
+	}
+}
+
+func TestSSOLinksByVerifiedEmail(t *testing.T) {
+	t.Setenv("OIDC_LINK_BY_EMAIL", "true")
+	db, idp := setupSSO(t)
+	carol := createTestUser(t, db, "carol", "carol@example.com")
+
+	// an address the provider didn't verify proves nothing
+	idp.Claims = jwt.MapClaims{"sub": "u-carol", "email": "carol@example.com", "email_verified": false}
+	state, binding, code := authorize(t, idp, 0)
+	if _, err := CompleteSSO(db, state, binding, code, testClient); !errors.Is(err, ErrSSONoAccount) {
+		t.Fatalf("unverified email: err = %v, want ErrSSONoAccount", err)
+	}
+
+	idp.Claims["email_verified"] = "true"
+	state, binding, code = authorize(t, idp, 0)
+	login, err := CompleteSSO(db, state, binding, code, testClient)
+	if err != nil {
+		t.Fatalf("CompleteSSO: %v", err)
+	}
+	if login.User.ID != carol.ID {
+		t.Errorf("logged in as user ID=%d, want carol (ID=%d)", login.User.ID, carol.ID)
+	}
+}
+
+func TestSSODisabledAccount(t *testing.T) {
+	db, idp := setupSSO(t)
+	dave := createTestUser(t, db, "dave", "")
+	if err := controller.LinkExternalIdentity(db, &models.ExternalIdentity{UserID: dave.ID, Provider: idp.URL, Subject: "u-dave"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(dave).Update("disabled_at", time.Now()).Error; err != nil {
+		t.Fatal(err)
+	}
+	idp.Claims = jwt.MapClaims{"sub": "u-dave"}
+
+	state, binding, code := authorize(t, idp, 0)
+	if _, err := CompleteSSO(db, state, binding, code, testClient); !errors.Is(err, ErrSSOAccountDisabled) {
+		t.Errorf("err = %v, want ErrSSOAccountDisabled", err)
+	}
+}
+
+// --- ID Token Verification ---
+
+func TestVerifyIDToken(t *testing.T) {
+	_, idp := setupSSO(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const nonce = "n-0S6_WzA2Mj"
+
+	tests := []struct {
+		name   string
+		tamper func(jwt.MapClaims)
+		sign   func(jwt.MapClaims) string
+		ok     bool
+	}{
+		{name: "valid", ok: true},
+		{name: "several audiences with azp", tamper: func(c jwt.MapClaims) {
+			c["aud"] = []string{idp.ClientID, "other-app"}
+			c["azp"] = idp.ClientID
+		}, ok: true},
+		{name: "nonce mismatch", tamper: func(c jwt.MapClaims) { c["nonce"] = "someone-elses" }},
+		{name: "no nonce", tamper: func(c jwt.MapClaims) { delete(c, "nonce") }},
+		{name: "other audience", tamper: func(c jwt.MapClaims) { c["aud"] = "other-app" }},
+		{name: "several audiences without azp", tamper: func(c jwt.MapClaims) {
+			c["aud"] = []string{idp.ClientID, "other-app"}
+		}},
+		{name: "issued to another client", tamper: func(c jwt.MapClaims) { c["azp"] = "other-app" }},
+		{name: "other issuer", tamper: func(c jwt.MapClaims) { c["iss"] = "https://idp.evil.example" }},
+		{name: "expired", tamper: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{name: "no expiry", tamper: func(c jwt.MapClaims) { delete(c, "exp") }},
+		{name: "issued in the future", tamper: func(c jwt.MapClaims) { c["iat"] = time.Now().Add(time.Hour).Unix() }},
+		{name: "no subject", tamper: func(c jwt.MapClaims) { delete(c, "sub") }},
+		{name: "signed with another key", sign: func(c jwt.MapClaims) string {
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+			token.Header["kid"] = idp.KeyID
+			signed, _ := token.SignedString(otherKey)
+			return signed
+		}},
+		{name: "unsigned", sign: func(c jwt.MapClaims) string {
+			signed, _ := jwt.NewWithClaims(jwt.SigningMethodNone, c).SignedString(jwt.UnsafeAllowNoneSignatureType)
+			return signed
+		}},
+		{name: "HMAC with the public key", sign: func(c jwt.MapClaims) string {
+			signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString(idp.Key.PublicKey.N.Bytes())
+			return signed
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := jwt.MapClaims{"sub": "u-1", "nonce": nonce}
+			idp.Tamper = tt.tamper
+			raw := idp.Sign(claims)
+			idp.Tamper = nil
+			if tt.sign != nil {
+				// re-sign the provider's claims some other way
+				parsed, _, err := jwt.NewParser().ParseUnverified(raw, jwt.MapClaims{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				raw = tt.sign(parsed.Claims.(jwt.MapClaims))
+			}
+
+			_, err := oidc.verifyIDToken(raw, nonce)
+			if tt.ok && err != nil {
+				t.Errorf("rejected: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("accepted")
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package internals
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// Defaults follow the OWASP recommendation for Argon2id.
+const (
+	defaultArgon2Memory  = 19 * 1024 // KiB
+	defaultArgon2Time    = 2
+	defaultArgon2Threads = 1
+
+	argon2SaltBytes = 16
+	argon2KeyBytes  = 32
+)
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+var passwordParams = sync.OnceValue(func() argon2Params {
+	return argon2Params{
+		memory:  uint32(envUint("ARGON2_MEMORY", defaultArgon2Memory, 8*1024, 4*1024*1024)),
+		time:    uint32(envUint("ARGON2_TIME", defaultArgon2Time, 1, 100)),
+		threads: uint8(envUint("ARGON2_THREADS", defaultArgon2Threads, 1, 255)),
+	}
+})
+
+func envUint(name string, fallback uint64, lowest uint64, highest uint64) uint64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || n < lowest || n > highest {
+		log.Printf("[WARN] Invalid %s %q (expected %d-%d), using %d", name, value, lowest, highest, fallback)
+		return fallback
+	}
+	return n
+}
+
+// --- Password Hashing ---
+
+// HashPassword returns an Argon2id hash in PHC string format:
+// $argon2id$v=19$m=<KiB>,t=<passes>,p=<threads>$<salt>$<key>
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		log.Printf("[ERROR] Failed to hash password: %v", err)
+		return "", err
+	}
+	params := passwordParams()
+	key := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, argon2KeyBytes)
+	return encodeArgon2Hash(params, salt, key), nil
+}
+
+// CheckPasswordHash accepts Argon2id hashes as well as the bcrypt hashes
+// stored before the switch.
+func CheckPasswordHash(hash, password string) bool {
+	var ok bool
+	switch {
+	case hash == "":
+		ok = false
+	case isBcryptHash(hash):
+		ok = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	default:
+		ok = checkArgon2Hash(hash, password)
+	}
+	if !ok {
+		log.Printf("[WARN] Password hash mismatch")
+	}
+	return ok
+}
+
+// NeedsRehash reports whether the hash was made with bcrypt or with Argon2id
+// parameters other than the configured ones.
+func NeedsRehash(hash string) bool {
+	if isBcryptHash(hash) {
+		return true
+	}
+	params, salt, key, err := decodeArgon2Hash(hash)
+	if err != nil {
+		return true
+	}
+	return params != passwordParams() || len(salt) != argon2SaltBytes || len(key) != argon2KeyBytes
+}
+
+// checkUserPassword checks the password and, when it is right but the
+// stored hash is outdated, replaces the hash while the plain password is at
+// hand. Users move to the current parameters just by logging in.
+func checkUserPassword(db *gorm.DB, user *models.User, password string) bool {
+	// accounts created through single sign-on have no password
+	if user.PasswordHash == "" {
+		burnPasswordCheck(password)
+		return false
+	}
+	if !CheckPasswordHash(user.PasswordHash, password) {
+		return false
+	}
+	if !NeedsRehash(user.PasswordHash) {
+		return true
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return true
+	}
+	if err := controller.UpdatePasswordHash(db, user, hash); err != nil {
+		log.Printf("[WARN] Failed to upgrade password hash for userID=%d: %v", user.ID, err)
+	}
+	return true
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func encodeArgon2Hash(params argon2Params, salt []byte, key []byte) string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.memory, params.time, params.threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key))
+}
+
+func decodeArgon2Hash(hash string) (argon2Params, []byte, []byte, error) {
+	var params argon2Params
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return params, nil, nil, fmt.Errorf("not an argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2 parameters %q: %w", parts[3], err)
+	}
+	if params.memory == 0 || params.time == 0 || params.threads == 0 {
+		return params, nil, nil, fmt.Errorf("invalid argon2 parameters %q", parts[3])
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, fmt.Errorf("invalid argon2 key")
+	}
+	return params, salt, key, nil
+}
+
+func checkArgon2Hash(hash, password string) bool {
+	params, salt, key, err := decodeArgon2Hash(hash)
+	if err != nil {
+		log.Printf("[ERROR] Unusable password hash: %v", err)
+		return false
+	}
+	derived := argon2.IDKey([]byte(password), salt, params.time, params.memory, params.threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(derived, key) == 1
+}
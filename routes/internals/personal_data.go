@@ -0,0 +1,348 @@
+package internals
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultDataExportTTL = 7 * 24 * time.Hour
+	// a pending export this old was lost to a restart
+	exportStaleAfter = 15 * time.Minute
+	exportCooldown   = time.Hour
+)
+
+const (
+	DeletedMessagesAnonymise = "anonymise"
+	DeletedMessagesDelete    = "delete"
+)
+
+var (
+	ErrExportPending  = errors.New("a data export is already being prepared")
+	ErrExportTooSoon  = fmt.Errorf("a data export can be requested once per %s", exportCooldown)
+	ErrExportNotReady = errors.New("the data export isn't ready yet")
+)
+
+const exportReadme = `This archive holds everything ping stores about your account:
+
+profile.json        your profile and account settings
+avatar.png          your avatar, if you have one
+channels.json       the channels you are a member of
+messages.json       every message you have posted
+blocks.json         the people you have blocked
+sessions.json       where you are logged in
+access_tokens.json  your personal access tokens (not the tokens themselves)
+identities.json     accounts at identity providers linked to yours
+audit_log.json      security events recorded for your account
+
+ping has no reactions, files or direct messages, so there are none to export.
+`
+
+// DeletedMessagesPolicy says what happens to the messages of deleted
+// accounts. Anonymising is the default, so that deleting an account doesn't
+// tear holes into other people's conversations.
+func DeletedMessagesPolicy() string {
+	switch policy := strings.ToLower(os.Getenv("DELETED_ACCOUNT_MESSAGES")); policy {
+	case "":
+		return DeletedMessagesAnonymise
+	case DeletedMessagesAnonymise, DeletedMessagesDelete:
+		return policy
+	default:
+		log.Printf("[WARN] Invalid DELETED_ACCOUNT_MESSAGES %q, using %s", policy, DeletedMessagesAnonymise)
+		return DeletedMessagesAnonymise
+	}
+}
+
+// --- Deactivation and Deletion ---
+
+// DeactivateAccount disables the account like an admin would; everything is
+// kept and an admin can enable it again.
+func DeactivateAccount(db *gorm.DB, userID uint64, sessionID string, password string, client ClientInfo) error {
+	user, err := loadUser(db, userID)
+	if err != nil {
+		return err
+	}
+	if err := confirmAccountOwner(db, user, sessionID, password, client); err != nil {
+		return err
+	}
+	if _, err := controller.SetUserDisabled(db, user.ID, true); err != nil {
+		return err
+	}
+	audit(db, models.AuditDeactivated, user, client.IP, "by the user")
+	return nil
+}
+
+// DeleteAccount deletes the account for good, after checking the password
+// or, for users without one, a fresh login.
+func DeleteAccount(db *gorm.DB, userID uint64, sessionID string, password string, client ClientInfo) error {
+	user, err := loadUser(db, userID)
+	if err != nil {
+		return err
+	}
+	if err := confirmAccountOwner(db, user, sessionID, password, client); err != nil {
+		return err
+	}
+
+	policy := DeletedMessagesPolicy()
+	if err := controller.DeleteUser(db, user.ID, policy == DeletedMessagesAnonymise); err != nil {
+		return err
+	}
+	controller.CreateAuditEntry(db, &models.AuditEntry{
+		Action:  models.AuditAccountDeleted,
+		Subject: "user:" + models.DeletedUsername,
+		IP:      client.IP,
+		Details: fmt.Sprintf("user ID=%d, messages: %s", user.ID, policy),
+	})
+
+	if user.Email != nil {
+		sendMail(MailMessage{
+			To:      *user.Email,
+			Subject: "Your account was deleted",
+			Body:    "Your account " + user.Username + " and the data stored with it have been deleted.\n",
+		})
+	}
+	return nil
+}
+
+// --- Data Export ---
+
+// RequestDataExport starts building an archive of the user's data in the
+// background. Only one export is kept per user.
+func RequestDataExport(db *gorm.DB, user *models.User, client ClientInfo) (*models.DataExport, error) {
+	latest, err := controller.GetDataExport(db, user.ID)
+	if err != nil && !errors.Is(err, controller.ErrExportNotFound) {
+		return nil, err
+	}
+	if latest != nil {
+		age := time.Since(latest.CreatedAt)
+		if latest.State == models.ExportPending && age < exportStaleAfter {
+			return nil, ErrExportPending
+		}
+		if latest.State == models.ExportReady && age < exportCooldown {
+			return nil, ErrExportTooSoon
+		}
+	}
+
+	export, err := controller.CreateDataExport(db, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	audit(db, models.AuditDataExport, user, client.IP, "")
+	go buildDataExport(db, export.ID, user.ID)
+	return export, nil
+}
+
+// DataExportStatus returns the user's latest export. Lost and expired
+// exports are cleaned up on the way.
+func DataExportStatus(db *gorm.DB, userID uint64) (*models.DataExport, error) {
+	export, err := controller.GetDataExport(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if export.State == models.ExportPending && now.Sub(export.CreatedAt) >= exportStaleAfter {
+		export.State = models.ExportFailed
+	}
+	if export.ExpiresAt != nil && !now.Before(*export.ExpiresAt) {
+		controller.DeleteDataExport(db, export.ID)
+		return nil, controller.ErrExportNotFound
+	}
+	return export, nil
+}
+
+// DataExportArchive returns the finished export with its archive.
+func DataExportArchive(db *gorm.DB, userID uint64) (*models.DataExport, error) {
+	export, err := DataExportStatus(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	if export.State != models.ExportReady {
+		return nil, ErrExportNotReady
+	}
+	return controller.GetDataExportArchive(db, userID, export.ID)
+}
+
+func buildDataExport(db *gorm.DB, exportID uint64, userID uint64) {
+	data, err := writeDataExport(db, userID)
+	if err != nil {
+		log.Printf("[ERROR] Failed to build data export ID=%d for userID=%d: %v", exportID, userID, err)
+		data = nil
+	}
+	ttl := envDuration("DATA_EXPORT_TTL", defaultDataExportTTL)
+	if err := controller.FinishDataExport(db, exportID, data, time.Now().Add(ttl)); err != nil || data == nil {
+		return
+	}
+
+	user, err := loadUser(db, userID)
+	if err == nil && user.Email != nil {
+		sendMail(MailMessage{
+			To:      *user.Email,
+			Subject: "Your data export is ready",
+			Body: "The archive of your account " + user.Username + " you asked for is ready to download.\n\n" +
+				fmt.Sprintf("It is deleted in %s.\n", ttl),
+		})
+	}
+}
+
+func writeDataExport(db *gorm.DB, userID uint64) ([]byte, error) {
+	user, err := loadUser(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	writeJSON := func(name string, v any) error {
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	w, err := zw.Create("README.txt")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, exportReadme); err != nil {
+		return nil, err
+	}
+
+	profile := user.Profile(time.Now())
+	profile["email"] = user.Email
+	profile["email_verified_at"] = user.EmailVerifiedAt
+	profile["disabled_at"] = user.DisabledAt
+	profile["updated_at"] = user.UpdatedAt.Format(time.RFC3339)
+	profile["two_factor_enabled"] = user.TwoFactorEnabled()
+	if err := writeJSON("profile.json", profile); err != nil {
+		return nil, err
+	}
+
+	avatar, err := controller.GetAvatar(db, userID, AvatarSizes[len(AvatarSizes)-1])
+	if err == nil {
+		w, err := zw.Create("avatar.png")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(avatar.Data); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, controller.ErrAvatarNotFound) {
+		return nil, err
+	}
+
+	memberships, err := controller.GetUserChannels(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	channels := make([]map[string]any, len(memberships))
+	for i, m := range memberships {
+		channels[i] = map[string]any{"channel_id": m.ChannelID, "name": m.Channel.Name, "joined_at": m.JoinedAt}
+	}
+	if err := writeJSON("channels.json", channels); err != nil {
+		return nil, err
+	}
+
+	if err := writeMessages(db, zw, userID); err != nil {
+		return nil, err
+	}
+
+	blocks, err := controller.GetBlocks(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	blocked := make([]map[string]any, len(blocks))
+	for i, b := range blocks {
+		blocked[i] = map[string]any{"user_id": b.BlockedID, "username": b.Blocked.Username, "blocked_at": b.CreatedAt}
+	}
+	if err := writeJSON("blocks.json", blocked); err != nil {
+		return nil, err
+	}
+
+	sessions, err := controller.GetUserSessions(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := controller.GetUserPersonalAccessTokens(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	identities, err := controller.GetUserIdentities(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := controller.GetUserAuditEntries(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	for name, v := range map[string]any{
+		"sessions.json":      sessions,
+		"access_tokens.json": tokens,
+		"identities.json":    identities,
+		"audit_log.json":     entries,
+	} {
+		if err := writeJSON(name, v); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeMessages streams the messages into the archive, since there may be
+// too many to hold at once.
+func writeMessages(db *gorm.DB, zw *zip.Writer, userID uint64) error {
+	w, err := zw.Create("messages.json")
+	if err != nil {
+		return err
+	}
+	sep := "\n  "
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	err = controller.EachUserMessage(db, userID, func(batch []models.Message) error {
+		for _, m := range batch {
+			entry := map[string]any{
+				"id":         m.ID,
+				"channel_id": m.ChannelID,
+				"channel":    m.Channel.Name,
+				"content":    m.Content,
+				"created_at": m.CreatedAt,
+			}
+			if m.System {
+				entry["system"] = true
+			}
+			line, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			if _, err := io.WriteString(w, sep+string(line)); err != nil {
+				return err
+			}
+			sep = ",\n  "
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n]\n")
+	return err
+}
@@ -0,0 +1,45 @@
+package internals
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+)
+
+func TestDeactivateAccountWithoutPassword(t *testing.T) {
+	db := newTestDB(t)
+	erin := createTestUser(t, db, "erin", "")
+	if err := db.Model(erin).Update("password_hash", "").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.CreateSession(db, &models.Session{ID: "stale", UserID: erin.ID, CreatedAt: time.Now().Add(-time.Hour), ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.CreateSession(db, &models.Session{ID: "fresh", UserID: erin.ID, ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// an old login, or an access token, isn't enough, and trying doesn't
+	// count against the user
+	for range userFreeAttempts + 2 {
+		for _, sessionID := range []string{"stale", ""} {
+			if err := DeactivateAccount(db, erin.ID, sessionID, "", testClient); !errors.Is(err, ErrReauthRequired) {
+				t.Fatalf("session %q: err = %v, want ErrReauthRequired", sessionID, err)
+			}
+		}
+	}
+	if err := CheckLoginAllowed(erin.Username, testClient.IP); err != nil {
+		t.Fatalf("refused re-auth attempts were counted as failed logins: %v", err)
+	}
+
+	if err := DeactivateAccount(db, erin.ID, "fresh", "", testClient); err != nil {
+		t.Fatalf("after a fresh login: %v", err)
+	}
+	user, err := loadUser(db, erin.ID)
+	if err != nil || user.DisabledAt == nil {
+		t.Errorf("account not deactivated: %+v, %v", user, err)
+	}
+}
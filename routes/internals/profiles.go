@@ -0,0 +1,137 @@
+package internals
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // timezones are checked against the IANA database
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+const (
+	maxBio         = 256
+	maxPronouns    = 32
+	maxStatusText  = 128
+	maxStatusEmoji = 32
+	maxStatusLife  = 30 * 24 * time.Hour
+)
+
+// ProfileUpdate holds the fields to change; nil ones are left alone.
+type ProfileUpdate struct {
+	DisplayName *string
+	Bio         *string
+	Pronouns    *string
+	Timezone    *string
+	Status      *StatusUpdate
+}
+
+// StatusUpdate replaces the custom status. Empty text and emoji clear it;
+// ExpiresIn of zero keeps it until it is changed.
+type StatusUpdate struct {
+	Text      string
+	Emoji     string
+	ExpiresIn time.Duration
+}
+
+// cleanText trims s and checks its length. Newlines are only allowed where
+// multiline is set.
+func cleanText(s string, limit int, multiline bool) (string, error) {
+	s = strings.TrimSpace(s)
+	if !utf8.ValidString(s) {
+		return "", fmt.Errorf("must be valid UTF-8")
+	}
+	if utf8.RuneCountInString(s) > limit {
+		return "", fmt.Errorf("must be at most %d characters", limit)
+	}
+	control := strings.IndexFunc(s, func(r rune) bool {
+		return unicode.IsControl(r) && !(multiline && r == '\n')
+	})
+	if control >= 0 {
+		return "", fmt.Errorf("must not contain control characters")
+	}
+	return s, nil
+}
+
+func validateTimezone(name string) error {
+	if name == "" {
+		return nil
+	}
+	if name == "Local" {
+		return fmt.Errorf("unknown timezone")
+	}
+	if _, err := time.LoadLocation(name); err != nil {
+		return fmt.Errorf("unknown timezone")
+	}
+	return nil
+}
+
+// UpdateProfile checks every field, reporting all problems at once like
+// registration does, and saves the valid result.
+func UpdateProfile(db *gorm.DB, user *models.User, update ProfileUpdate) (*models.User, error) {
+	fields := map[string]string{}
+	updates := map[string]any{}
+
+	if update.DisplayName != nil {
+		displayName, err := NormalizeDisplayName(*update.DisplayName, user.Username)
+		if err != nil {
+			fields["display_name"] = err.Error()
+		}
+		updates["display_name"] = displayName
+	}
+	if update.Bio != nil {
+		bio, err := cleanText(strings.ReplaceAll(*update.Bio, "\r\n", "\n"), maxBio, true)
+		if err != nil {
+			fields["bio"] = "bio " + err.Error()
+		}
+		updates["bio"] = bio
+	}
+	if update.Pronouns != nil {
+		pronouns, err := cleanText(*update.Pronouns, maxPronouns, false)
+		if err != nil {
+			fields["pronouns"] = "pronouns " + err.Error()
+		}
+		updates["pronouns"] = pronouns
+	}
+	if update.Timezone != nil {
+		timezone := strings.TrimSpace(*update.Timezone)
+		if err := validateTimezone(timezone); err != nil {
+			fields["timezone"] = err.Error()
+		}
+		updates["timezone"] = timezone
+	}
+	if status := update.Status; status != nil {
+		text, err := cleanText(status.Text, maxStatusText, false)
+		if err != nil {
+			fields["status.text"] = "status " + err.Error()
+		}
+		emoji, err := cleanText(status.Emoji, maxStatusEmoji, false)
+		if err != nil {
+			fields["status.emoji"] = "emoji " + err.Error()
+		}
+		if status.ExpiresIn < 0 || status.ExpiresIn > maxStatusLife {
+			fields["status.expires_in"] = fmt.Sprintf("status can last at most %d days", int(maxStatusLife.Hours()/24))
+		}
+
+		var expiresAt *time.Time
+		if status.ExpiresIn > 0 && (text != "" || emoji != "") {
+			at := time.Now().Add(status.ExpiresIn)
+			expiresAt = &at
+		}
+		updates["status_text"] = text
+		updates["status_emoji"] = emoji
+		updates["status_expires_at"] = expiresAt
+	}
+
+	if len(fields) > 0 {
+		return nil, &ValidationError{Fields: fields}
+	}
+	if len(updates) == 0 {
+		return loadUser(db, user.ID)
+	}
+	return controller.UpdateUserProfile(db, user.ID, updates)
+}
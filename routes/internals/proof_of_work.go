@@ -0,0 +1,240 @@
+package internals
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"math/bits"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rtk-rnjn/ping/controller"
+)
+
+// A challenge looks like 1.<purpose>.<difficulty>.<issued>.<salt>.<mac>. It
+// is solved by finding a nonce for which SHA-256("<challenge>:<nonce>")
+// starts with <difficulty> zero bits. The MAC lets any node check a
+// challenge without having stored it.
+const (
+	PurposeRegister = "register"
+	PurposeLogin    = "login"
+
+	proofOfWorkVersion      = "1"
+	proofOfWorkAlgorithm    = "sha256"
+	defaultPoWDifficulty    = 18
+	defaultPoWMaxDifficulty = 24
+	defaultPoWTargetRate    = 30
+	defaultPoWTTL           = 5 * time.Minute
+	maxProofOfWorkNonce     = 64
+)
+
+var (
+	ErrProofOfWorkRequired = errors.New("proof of work required")
+	ErrProofOfWorkInvalid  = errors.New("invalid or expired proof of work")
+	ErrProofOfWorkUsed     = errors.New("proof of work was already used")
+	ErrUnknownPurpose      = errors.New("unknown proof-of-work purpose")
+)
+
+// ProofOfWork is a client's solution to a challenge.
+type ProofOfWork struct {
+	Challenge string `json:"challenge"`
+	Nonce     string `json:"nonce"`
+}
+
+type ProofOfWorkChallenge struct {
+	Challenge  string `json:"challenge"`
+	Algorithm  string `json:"algorithm"`
+	Difficulty int    `json:"difficulty"`
+	ExpiresIn  int64  `json:"expires_in"`
+}
+
+var (
+	powSecretMu sync.Mutex
+	powSecret   []byte
+)
+
+// --- Settings ---
+
+// ProofOfWorkRequired reports whether POW_ROUTES names the purpose.
+func ProofOfWorkRequired(purpose string) bool {
+	routes := os.Getenv("POW_ROUTES")
+	if routes == "" {
+		routes = PurposeRegister
+	}
+	for _, route := range strings.Split(routes, ",") {
+		if strings.EqualFold(strings.TrimSpace(route), purpose) {
+			return true
+		}
+	}
+	return false
+}
+
+// proofOfWorkSecret prefers POW_SECRET and otherwise shares a generated
+// secret between nodes through Redis.
+func proofOfWorkSecret() ([]byte, error) {
+	powSecretMu.Lock()
+	defer powSecretMu.Unlock()
+	if powSecret != nil {
+		return powSecret, nil
+	}
+	if secret := os.Getenv("POW_SECRET"); secret != "" {
+		powSecret = []byte(secret)
+		return powSecret, nil
+	}
+	secret, err := controller.SharedProofOfWorkSecret()
+	if err != nil {
+		return nil, err
+	}
+	powSecret = secret
+	return powSecret, nil
+}
+
+// currentDifficulty adds a bit, doubling the expected work, for every
+// doubling of solved challenges above POW_TARGET_RATE per minute.
+func currentDifficulty(purpose string) int {
+	base := int(envUint("POW_DIFFICULTY", defaultPoWDifficulty, 1, 32))
+	highest := int(envUint("POW_MAX_DIFFICULTY", defaultPoWMaxDifficulty, 1, 32))
+	target := int64(envUint("POW_TARGET_RATE", defaultPoWTargetRate, 1, 1<<20))
+
+	rate, err := controller.ProofOfWorkRate(purpose)
+	if err != nil {
+		return max(base, highest)
+	}
+	difficulty := base
+	for rate /= 2; rate >= target && difficulty < highest; rate /= 2 {
+		difficulty++
+	}
+	return difficulty
+}
+
+// --- Challenges ---
+
+func signChallenge(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func NewProofOfWorkChallenge(purpose string) (*ProofOfWorkChallenge, error) {
+	if purpose != PurposeRegister && purpose != PurposeLogin {
+		return nil, ErrUnknownPurpose
+	}
+	secret, err := proofOfWorkSecret()
+	if err != nil {
+		return nil, err
+	}
+	salt, err := randomToken(12)
+	if err != nil {
+		return nil, err
+	}
+
+	difficulty := currentDifficulty(purpose)
+	ttl := envDuration("POW_TTL", defaultPoWTTL)
+	payload := strings.Join([]string{
+		proofOfWorkVersion, purpose, strconv.Itoa(difficulty),
+		strconv.FormatInt(time.Now().Unix(), 10), salt,
+	}, ".")
+	return &ProofOfWorkChallenge{
+		Challenge:  payload + "." + signChallenge(secret, payload),
+		Algorithm:  proofOfWorkAlgorithm,
+		Difficulty: difficulty,
+		ExpiresIn:  int64(ttl.Seconds()),
+	}, nil
+}
+
+func leadingZeroBits(sum []byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// VerifyProofOfWork checks that the challenge is for the purpose, unexpired
+// and solved, without using it up. The difficulty is the one the challenge
+// was issued with.
+func VerifyProofOfWork(purpose string, proof *ProofOfWork) error {
+	_, err := verifyProofOfWork(purpose, proof)
+	return err
+}
+
+// CheckProofOfWork accepts a solved, unexpired challenge for the purpose,
+// once. Requests that can still fail for other reasons verify the solution
+// up front and check it last, so that it isn't used up by a failed attempt.
+func CheckProofOfWork(purpose string, proof *ProofOfWork) error {
+	if !ProofOfWorkRequired(purpose) {
+		return nil
+	}
+	remaining, err := verifyProofOfWork(purpose, proof)
+	if err != nil {
+		return err
+	}
+
+	fresh, err := controller.ClaimProofOfWork(hashToken(proof.Challenge), remaining)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrProofOfWorkUsed
+	}
+	controller.RecordProofOfWork(purpose)
+	return nil
+}
+
+// verifyProofOfWork returns how long the challenge has left.
+func verifyProofOfWork(purpose string, proof *ProofOfWork) (time.Duration, error) {
+	if !ProofOfWorkRequired(purpose) {
+		return 0, nil
+	}
+	if proof == nil || proof.Challenge == "" || proof.Nonce == "" {
+		return 0, ErrProofOfWorkRequired
+	}
+	if len(proof.Nonce) > maxProofOfWorkNonce {
+		return 0, ErrProofOfWorkInvalid
+	}
+
+	parts := strings.Split(proof.Challenge, ".")
+	if len(parts) != 6 || parts[0] != proofOfWorkVersion || parts[1] != purpose {
+		return 0, ErrProofOfWorkInvalid
+	}
+	secret, err := proofOfWorkSecret()
+	if err != nil {
+		return 0, err
+	}
+	payload := strings.Join(parts[:5], ".")
+	if !hmac.Equal([]byte(parts[5]), []byte(signChallenge(secret, payload))) {
+		return 0, ErrProofOfWorkInvalid
+	}
+
+	difficulty, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return 0, ErrProofOfWorkInvalid
+	}
+	issued, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return 0, ErrProofOfWorkInvalid
+	}
+	remaining := time.Until(time.Unix(issued, 0).Add(envDuration("POW_TTL", defaultPoWTTL)))
+	if remaining <= 0 {
+		return 0, ErrProofOfWorkInvalid
+	}
+
+	sum := sha256.Sum256([]byte(proof.Challenge + ":" + proof.Nonce))
+	if leadingZeroBits(sum[:]) < difficulty {
+		return 0, ErrProofOfWorkInvalid
+	}
+	return remaining, nil
+}
+
+func IsProofOfWorkRejection(err error) bool {
+	return errors.Is(err, ErrProofOfWorkRequired) ||
+		errors.Is(err, ErrProofOfWorkInvalid) ||
+		errors.Is(err, ErrProofOfWorkUsed)
+}
@@ -0,0 +1,347 @@
+package internals
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rtk-rnjn/ping/config"
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+// DefaultInviteLife is how long an invite works unless told otherwise.
+const DefaultInviteLife = 7 * 24 * time.Hour
+
+const (
+	RegistrationOpen   = "open"
+	RegistrationInvite = "invite"
+	RegistrationClosed = "closed"
+)
+
+const (
+	minUsernameLength  = 3
+	maxPasswordLength  = 256
+	maxDisplayName     = 64
+	inviteCodeBytes    = 12
+	invitePrefix       = 6
+	maxInviteLife      = 365 * 24 * time.Hour
+	maxInviteUses      = 1000
+	maxInviteNote      = 128
+	minUsernameInPass  = 3
+	inviteCodeField    = "invite_code"
+	validationErrorMsg = "invalid input"
+)
+
+var (
+	ErrRegistrationClosed = errors.New("registration is closed")
+	ErrInviteRequired     = errors.New("registration requires an invite code")
+	ErrUsernameTaken      = errors.New("username is already taken")
+
+	ErrUsernameLength      = fmt.Errorf("username must be %d-%d characters", minUsernameLength, maxUsernameLength)
+	ErrUsernameCharacters  = errors.New("username may only contain letters, digits, '.', '_' and '-', and must start with a letter or digit")
+	ErrPasswordTooLong     = fmt.Errorf("password must be at most %d characters", maxPasswordLength)
+	ErrPasswordTooCommon   = errors.New("password is too common")
+	ErrPasswordHasUsername = errors.New("password must not contain the username")
+	ErrDisplayNameLength   = fmt.Errorf("display name must be at most %d characters", maxDisplayName)
+	ErrDisplayNameInvalid  = errors.New("display name must not contain control characters")
+
+	ErrInviteUses   = fmt.Errorf("max_uses must be 1-%d", maxInviteUses)
+	ErrInviteExpiry = fmt.Errorf("expiry must be at most %d days away", int(maxInviteLife.Hours()/24))
+	ErrInviteNote   = fmt.Errorf("note must be at most %d characters", maxInviteNote)
+)
+
+var validUsername = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// commonPasswords are rejected outright; most pass the length rule.
+var commonPasswords = []string{
+	"11111111", "12341234", "12345678", "123456789", "1234567890", "1q2w3e4r",
+	"87654321", "abc12345", "admin123", "asdfghjk", "baseball", "changeme",
+	"football", "iloveyou", "letmein1", "password", "password1", "password123",
+	"p@ssw0rd", "passw0rd", "princess", "qwerty123", "qwertyui", "qwertyuiop",
+	"starwars", "sunshine", "superman", "trustno1", "welcome1", "whatever",
+	"zaq12wsx",
+}
+
+// ValidationError carries one message per invalid field.
+type ValidationError struct {
+	Fields map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return validationErrorMsg + ": " + strings.Join(names, ", ")
+}
+
+// Registration is what a client sends to sign up.
+type Registration struct {
+	Username    string
+	Password    string
+	DisplayName string
+	Email       string
+	InviteCode  string
+	ProofOfWork *ProofOfWork
+}
+
+// --- Registration Settings ---
+
+func RegistrationMode() string {
+	switch mode := strings.ToLower(os.Getenv("REGISTRATION_MODE")); mode {
+	case "":
+		return RegistrationOpen
+	case RegistrationOpen, RegistrationInvite, RegistrationClosed:
+		return mode
+	default:
+		log.Printf("[WARN] Invalid REGISTRATION_MODE %q, using %s", mode, RegistrationClosed)
+		return RegistrationClosed
+	}
+}
+
+// autoCreateAllowed reports whether a first login through single sign-on or
+// LDAP may create an account. Unless registration is open that takes an
+// explicit name=true, so a closed instance doesn't grow through the back door.
+func autoCreateAllowed(name string, fallback bool) bool {
+	if os.Getenv(name) != "" {
+		return envBool(name, false)
+	}
+	return fallback && RegistrationMode() == RegistrationOpen
+}
+
+// --- Validation ---
+
+func ValidateUsername(username string) error {
+	if n := len(username); n < minUsernameLength || n > maxUsernameLength {
+		return ErrUsernameLength
+	}
+	if !validUsername.MatchString(username) {
+		return ErrUsernameCharacters
+	}
+	return nil
+}
+
+// ValidatePassword applies the password rules. username may be empty when
+// it isn't known yet.
+func ValidatePassword(password string, username string) error {
+	n := utf8.RuneCountInString(password)
+	if n < minPasswordLength {
+		return ErrPasswordTooShort
+	}
+	if n > maxPasswordLength {
+		return ErrPasswordTooLong
+	}
+
+	lower := strings.ToLower(password)
+	if len(username) >= minUsernameInPass && strings.Contains(lower, strings.ToLower(username)) {
+		return ErrPasswordHasUsername
+	}
+	first, _ := utf8.DecodeRuneInString(password)
+	if slices.Contains(commonPasswords, lower) || strings.Trim(password, string(first)) == "" {
+		return ErrPasswordTooCommon
+	}
+	return nil
+}
+
+// NormalizeDisplayName trims the name and falls back to the username.
+func NormalizeDisplayName(displayName string, username string) (string, error) {
+	displayName = strings.TrimSpace(displayName)
+	if displayName == "" {
+		return username, nil
+	}
+	if utf8.RuneCountInString(displayName) > maxDisplayName {
+		return "", ErrDisplayNameLength
+	}
+	if strings.IndexFunc(displayName, unicode.IsControl) >= 0 || !utf8.ValidString(displayName) {
+		return "", ErrDisplayNameInvalid
+	}
+	return displayName, nil
+}
+
+// validateRegistration checks every field and reports all the problems at
+// once, so a form can mark each one.
+func validateRegistration(reg *Registration, verification string) error {
+	fields := map[string]string{}
+
+	if err := ValidateUsername(reg.Username); err != nil {
+		fields["username"] = err.Error()
+	}
+	if err := ValidatePassword(reg.Password, reg.Username); err != nil {
+		fields["password"] = err.Error()
+	}
+
+	displayName, err := NormalizeDisplayName(reg.DisplayName, reg.Username)
+	if err != nil {
+		fields["display_name"] = err.Error()
+	}
+	reg.DisplayName = displayName
+
+	if reg.Email != "" {
+		email, err := NormalizeEmail(reg.Email)
+		if err != nil {
+			fields["email"] = err.Error()
+		}
+		reg.Email = email
+	} else if verification == EmailVerificationRequired {
+		fields["email"] = ErrEmailRequired.Error()
+	}
+
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+// --- Registration ---
+
+// RegisterUser creates the account and logs it in. When email verification
+// is required no tokens are returned; the user logs in once verified.
+func RegisterUser(db *gorm.DB, reg Registration, client ClientInfo) (*TokenPair, error) {
+	log.Printf("[INFO] Registering new user: username='%s'", reg.Username)
+
+	mode := RegistrationMode()
+	switch {
+	case mode == RegistrationClosed:
+		return nil, ErrRegistrationClosed
+	case mode == RegistrationInvite && strings.TrimSpace(reg.InviteCode) == "":
+		return nil, ErrInviteRequired
+	}
+
+	verification := EmailVerificationMode()
+	if err := validateRegistration(&reg, verification); err != nil {
+		return nil, err
+	}
+	if err := VerifyProofOfWork(PurposeRegister, reg.ProofOfWork); err != nil {
+		return nil, err
+	}
+
+	taken, err := controller.UsernameTaken(db, reg.Username)
+	if err != nil {
+		return nil, err
+	}
+	if taken {
+		return nil, ErrUsernameTaken
+	}
+	var address *string
+	if reg.Email != "" {
+		taken, err := controller.EmailInUse(db, reg.Email, 0)
+		if err != nil {
+			return nil, err
+		}
+		if taken {
+			return nil, controller.ErrEmailTaken
+		}
+		address = &reg.Email
+	}
+
+	hashed, err := HashPassword(reg.Password)
+	if err != nil {
+		log.Printf("[ERROR] Failed to hash password for user '%s': %v", reg.Username, err)
+		return nil, err
+	}
+
+	user := models.User{
+		Username:     reg.Username,
+		PasswordHash: hashed,
+		DisplayName:  reg.DisplayName,
+		Email:        address,
+	}
+
+	// the solution is only used up by a registration that gets this far
+	if err := CheckProofOfWork(PurposeRegister, reg.ProofOfWork); err != nil {
+		return nil, err
+	}
+
+	if mode == RegistrationInvite {
+		invite, err := controller.CreateUserWithInvite(db, &user, hashToken(strings.TrimSpace(reg.InviteCode)))
+		if errors.Is(err, controller.ErrInviteInvalid) {
+			return nil, &ValidationError{Fields: map[string]string{inviteCodeField: err.Error()}}
+		}
+		if err != nil {
+			return nil, createUserError(db, reg, err)
+		}
+		audit(db, models.AuditInviteUsed, &user, client.IP, fmt.Sprintf("invite ID=%d (%s...)", invite.ID, invite.Prefix))
+	} else if err := controller.CreateUser(config.DB, &user); err != nil {
+		log.Printf("[ERROR] Failed to create user '%s': %v", reg.Username, err)
+		return nil, createUserError(db, reg, err)
+	}
+
+	log.Printf("[INFO] User '%s' registered successfully with userID=%d", reg.Username, user.ID)
+	if address != nil && verification != EmailVerificationOff {
+		if err := sendVerificationMail(db, &user); err != nil {
+			log.Printf("[WARN] Failed to send verification mail to userID=%d: %v", user.ID, err)
+		}
+	}
+	if verification == EmailVerificationRequired {
+		return nil, nil
+	}
+	return IssueTokens(db, &user, client)
+}
+
+// createUserError explains a failed insert. The username and address were
+// free when checked, so a unique constraint means a concurrent registration
+// took one of them in the meantime.
+func createUserError(db *gorm.DB, reg Registration, err error) error {
+	if !controller.IsDuplicateKey(db, err) {
+		return fmt.Errorf("failed to create user")
+	}
+	if taken, _ := controller.UsernameTaken(db, reg.Username); taken || reg.Email == "" {
+		return ErrUsernameTaken
+	}
+	return controller.ErrEmailTaken
+}
+
+// --- Invites ---
+
+// CreateInvite returns the code, which is never shown again, and its
+// record. expiresIn of zero means it never expires.
+func CreateInvite(db *gorm.DB, creator *models.User, maxUses int, expiresIn time.Duration, note string, client ClientInfo) (string, *models.Invite, error) {
+	if maxUses < 1 || maxUses > maxInviteUses {
+		return "", nil, ErrInviteUses
+	}
+	if expiresIn < 0 || expiresIn > maxInviteLife {
+		return "", nil, ErrInviteExpiry
+	}
+	note = strings.TrimSpace(note)
+	if utf8.RuneCountInString(note) > maxInviteNote {
+		return "", nil, ErrInviteNote
+	}
+
+	code, err := randomToken(inviteCodeBytes)
+	if err != nil {
+		return "", nil, err
+	}
+	invite := &models.Invite{
+		CodeHash:    hashToken(code),
+		Prefix:      code[:invitePrefix],
+		Note:        note,
+		CreatedByID: &creator.ID,
+		MaxUses:     maxUses,
+	}
+	if expiresIn > 0 {
+		expiresAt := time.Now().Add(expiresIn)
+		invite.ExpiresAt = &expiresAt
+	}
+	if err := controller.CreateInvite(db, invite); err != nil {
+		return "", nil, err
+	}
+	audit(db, models.AuditInviteCreated, creator, client.IP, fmt.Sprintf("invite ID=%d for %d uses", invite.ID, maxUses))
+	return code, invite, nil
+}
+
+func IsInviteRequestError(err error) bool {
+	return errors.Is(err, ErrInviteUses) ||
+		errors.Is(err, ErrInviteExpiry) ||
+		errors.Is(err, ErrInviteNote)
+}
@@ -0,0 +1,47 @@
+package internals
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+)
+
+// A registration that loses the race for its username or address gets past
+// the checks and only fails on the insert; that must still say why.
+func TestCreateUserErrorAfterLostRace(t *testing.T) {
+	db := newTestDB(t)
+	createTestUser(t, db, "ann", "ann@example.com")
+
+	tests := []struct {
+		name     string
+		username string
+		email    string
+		want     error
+	}{
+		{"same username", "ann", "", ErrUsernameTaken},
+		{"same username and another address", "ann", "other@example.com", ErrUsernameTaken},
+		{"same address", "annie", "ann@example.com", controller.ErrEmailTaken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := &models.User{Username: tt.username, DisplayName: tt.username, PasswordHash: "x"}
+			if tt.email != "" {
+				user.Email = &tt.email
+			}
+			err := controller.CreateUser(db, user)
+			if !controller.IsDuplicateKey(db, err) {
+				t.Fatalf("insert err = %v, want a duplicate key", err)
+			}
+			reg := Registration{Username: tt.username, Email: tt.email}
+			if got := createUserError(db, reg, err); !errors.Is(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := createUserError(db, Registration{Username: "bob"}, errors.New("disk full")); errors.Is(got, ErrUsernameTaken) || errors.Is(got, controller.ErrEmailTaken) {
+		t.Errorf("other failures reported as %v", got)
+	}
+}
@@ -0,0 +1,83 @@
+package internals
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxDeviceLength    = 64
+	maxUserAgentLength = 256
+)
+
+// ClientInfo describes where a login came from; it is recorded on the
+// session so users can tell their sessions apart.
+type ClientInfo struct {
+	IP         string
+	UserAgent  string
+	DeviceName string
+}
+
+func NewClientInfo(c *gin.Context, deviceName string) ClientInfo {
+	return ClientInfo{
+		IP:         c.ClientIP(),
+		UserAgent:  c.Request.UserAgent(),
+		DeviceName: deviceName,
+	}
+}
+
+func (ci ClientInfo) userAgent() string {
+	return truncate(ci.UserAgent, maxUserAgentLength)
+}
+
+// device prefers the name the client gave itself and otherwise guesses one
+// from the User-Agent, e.g. "Firefox on Linux".
+func (ci ClientInfo) device() string {
+	if name := strings.TrimSpace(ci.DeviceName); name != "" {
+		return truncate(name, maxDeviceLength)
+	}
+
+	ua := ci.UserAgent
+	if ua == "" {
+		return "Unknown device"
+	}
+
+	browser := "Unknown client"
+	for _, candidate := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+		{"Go-http-client", "Go HTTP client"},
+	} {
+		if strings.Contains(ua, candidate.token) {
+			browser = candidate.name
+			break
+		}
+	}
+
+	for _, candidate := range []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, candidate.token) {
+			return browser + " on " + candidate.name
+		}
+	}
+	return browser
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return strings.ToValidUTF8(s[:n], "")
+}
@@ -0,0 +1,343 @@
+package internals
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+const (
+	totpDigits      = 6
+	totpPeriod      = 30 * time.Second
+	totpSkew        = 1
+	totpSecretBytes = 20
+
+	totpEnrolmentTTL     = 10 * time.Minute
+	loginChallengeTTL    = 5 * time.Minute
+	maxChallengeAttempts = 5
+	recoveryCodeCount    = 10
+	recoveryCodeBytes    = 10
+)
+
+var (
+	ErrTwoFactorEnabled     = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled  = errors.New("two-factor authentication is not enabled")
+	ErrEnrolmentExpired     = errors.New("no pending enrolment, start again")
+	ErrInvalidTwoFactorCode = errors.New("invalid two-factor code")
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TwoFactorChallenge is returned instead of tokens when the password was
+// right but a second factor is still needed.
+type TwoFactorChallenge struct {
+	Token     string
+	ExpiresIn time.Duration
+}
+
+// --- TOTP (RFC 6238) ---
+
+func totpIssuer() string {
+	if issuer := os.Getenv("TOTP_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "ping"
+}
+
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP returns the time step the code belongs to, allowing for a step of
+// clock drift either way.
+func matchTOTP(secret string, code string, now time.Time) (int64, bool) {
+	key, err := base32NoPadding.DecodeString(secret)
+	if err != nil {
+		log.Printf("[ERROR] Stored TOTP secret is not valid base32: %v", err)
+		return 0, false
+	}
+
+	current := now.Unix() / int64(totpPeriod.Seconds())
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// checkTOTP accepts each code only once.
+func checkTOTP(userID uint64, secret string, code string) (bool, error) {
+	step, ok := matchTOTP(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return controller.UseTOTPStep(userID, step, (2*totpSkew+1)*totpPeriod)
+}
+
+func normalizeCode(code string) string {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	return strings.NewReplacer(" ", "", "-", "").Replace(code)
+}
+
+func isTOTPCode(code string) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+	for _, r := range code {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// --- Recovery Codes ---
+
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		buf := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+		raw := strings.ToLower(base32NoPadding.EncodeToString(buf))
+		codes = append(codes, raw[0:4]+"-"+raw[4:8]+"-"+raw[8:12]+"-"+raw[12:16])
+		hashes = append(hashes, hashToken(normalizeCode(raw)))
+	}
+	return codes, hashes, nil
+}
+
+// --- Enrolment ---
+
+func loadUser(db *gorm.DB, userID uint64) (*models.User, error) {
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		log.Printf("[ERROR] Failed to load userID=%d: %v", userID, err)
+		return nil, err
+	}
+	return &user, nil
+}
+
+// BeginTOTPEnrolment generates a secret and returns it with the otpauth URI
+// for authenticator apps. Nothing changes until the enrolment is confirmed.
+func BeginTOTPEnrolment(db *gorm.DB, userID uint64) (string, string, error) {
+	user, err := loadUser(db, userID)
+	if err != nil {
+		return "", "", err
+	}
+	if user.TwoFactorEnabled() {
+		return "", "", ErrTwoFactorEnabled
+	}
+
+	buf := make([]byte, totpSecretBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	secret := base32NoPadding.EncodeToString(buf)
+	if err := controller.SetPendingTOTPSecret(user.ID, secret, totpEnrolmentTTL); err != nil {
+		return "", "", err
+	}
+
+	issuer := totpIssuer()
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(int(totpPeriod.Seconds())))
+	uri := (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + user.Username,
+		RawQuery: query.Encode(),
+	}).String()
+
+	log.Printf("[INFO] Started TOTP enrolment for userID=%d", user.ID)
+	return secret, uri, nil
+}
+
+// ConfirmTOTPEnrolment turns 2FA on once the user shows a valid code from
+// the new secret, and returns the recovery codes. They are only ever shown
+// this once.
+func ConfirmTOTPEnrolment(db *gorm.DB, userID uint64, code string) ([]string, error) {
+	user, err := loadUser(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.TwoFactorEnabled() {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	secret, err := controller.GetPendingTOTPSecret(user.ID)
+	if err != nil {
+		return nil, ErrEnrolmentExpired
+	}
+	ok, err := checkTOTP(user.ID, secret, normalizeCode(code))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		log.Printf("[WARN] Wrong code confirming TOTP enrolment for userID=%d", user.ID)
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := controller.EnableTOTP(db, user.ID, secret, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// VerifySecondFactor accepts either a current TOTP code or an unused
+// recovery code.
+func VerifySecondFactor(db *gorm.DB, user *models.User, code string) (bool, error) {
+	if !user.TwoFactorEnabled() {
+		return false, ErrTwoFactorNotEnabled
+	}
+
+	code = normalizeCode(code)
+	if isTOTPCode(code) {
+		return checkTOTP(user.ID, user.TOTPSecret, code)
+	}
+	return controller.UseRecoveryCode(db, user.ID, hashToken(code))
+}
+
+func verifiedUser(db *gorm.DB, userID uint64, code string) (*models.User, error) {
+	user, err := loadUser(db, userID)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := VerifySecondFactor(db, user, code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		log.Printf("[WARN] Wrong second factor from userID=%d", user.ID)
+		return nil, ErrInvalidTwoFactorCode
+	}
+	return user, nil
+}
+
+func DisableTwoFactor(db *gorm.DB, userID uint64, code string) error {
+	user, err := verifiedUser(db, userID, code)
+	if err != nil {
+		return err
+	}
+	return controller.DisableTOTP(db, user.ID)
+}
+
+func RegenerateRecoveryCodes(db *gorm.DB, userID uint64, code string) ([]string, error) {
+	user, err := verifiedUser(db, userID, code)
+	if err != nil {
+		return nil, err
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := controller.ReplaceRecoveryCodes(db, user.ID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// --- Two-Step Login ---
+
+func newLoginChallenge(user *models.User, client ClientInfo) (*TwoFactorChallenge, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	err = controller.CreateLoginChallenge(hashToken(token), controller.LoginChallenge{
+		UserID:     user.ID,
+		DeviceName: client.DeviceName,
+	}, loginChallengeTTL)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[INFO] Password accepted for userID=%d, waiting for second factor", user.ID)
+	return &TwoFactorChallenge{Token: token, ExpiresIn: loginChallengeTTL}, nil
+}
+
+// CompleteTwoFactorLogin exchanges a challenge token and a TOTP or recovery
+// code for real tokens. A challenge survives a few wrong codes, then it is
+// gone and the user has to start over with their password.
+func CompleteTwoFactorLogin(db *gorm.DB, challengeToken string, code string, client ClientInfo) (*TokenPair, error) {
+	hash := hashToken(challengeToken)
+	challenge, err := controller.AttemptLoginChallenge(hash)
+	if err != nil {
+		return nil, err
+	}
+	if challenge.Attempts > maxChallengeAttempts {
+		log.Printf("[WARN] Too many second factor attempts for userID=%d, dropping challenge", challenge.UserID)
+		controller.DeleteLoginChallenge(hash)
+		return nil, controller.ErrChallengeNotFound
+	}
+
+	// wrong codes count against the account like wrong passwords, otherwise
+	// someone holding the password could guess codes through new challenges
+	user, err := loadUser(db, challenge.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckLoginAllowed(user.Username, client.IP); err != nil {
+		return nil, err
+	}
+	ok, err := VerifySecondFactor(db, user, code)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		log.Printf("[WARN] Wrong second factor from userID=%d", user.ID)
+		RecordFailedLogin(db, user.Username, client.IP, user)
+		return nil, ErrInvalidTwoFactorCode
+	}
+	if user.DisabledAt != nil {
+		log.Printf("[WARN] Second factor for disabled userID=%d", user.ID)
+		controller.DeleteLoginChallenge(hash)
+		return nil, controller.ErrChallengeNotFound
+	}
+
+	if err := controller.DeleteLoginChallenge(hash); err != nil {
+		log.Printf("[WARN] Failed to delete used login challenge: %v", err)
+	}
+	if client.DeviceName == "" {
+		client.DeviceName = challenge.DeviceName
+	}
+	log.Printf("[INFO] Second factor accepted for userID=%d", user.ID)
+	ResetLoginFailures(user.Username)
+	return IssueTokens(db, user, client)
+}
+
+func IsTwoFactorRejection(err error) bool {
+	return errors.Is(err, ErrInvalidTwoFactorCode) ||
+		errors.Is(err, ErrTwoFactorNotEnabled) ||
+		errors.Is(err, controller.ErrChallengeNotFound)
+}
@@ -0,0 +1,100 @@
+package internals
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rtk-rnjn/ping/controller"
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultSearchLimit  = 20
+	MaxSearchLimit      = 50
+	maxSearchQuery      = 64
+	maxSearchCandidates = 200
+)
+
+var (
+	ErrSearchQuery  = fmt.Errorf("q must be 1-%d characters", maxSearchQuery)
+	ErrSearchPaging = fmt.Errorf("limit must be 1-%d and offset at least 0", MaxSearchLimit)
+)
+
+type UserSearchResult struct {
+	ID             uint64 `json:"id"`
+	Username       string `json:"username"`
+	DisplayName    string `json:"display_name"`
+	AvatarURL      string `json:"avatar_url"`
+	SharedChannels int64  `json:"shared_channels"`
+}
+
+func escapeLike(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r == '%' || r == '_' || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// fuzzyPattern turns "jdo" into the LIKE pattern %j%d%o%, which matches any
+// name containing those letters in that order.
+func fuzzyPattern(query string) string {
+	var b strings.Builder
+	b.WriteByte('%')
+	for _, r := range query {
+		b.WriteString(escapeLike(string(r)))
+		b.WriteByte('%')
+	}
+	return b.String()
+}
+
+// SearchUsers finds active users by username or display name. Exact and
+// prefix matches come before substring and then fuzzy ones; within each,
+// people who share more channels with the viewer come first.
+func SearchUsers(db *gorm.DB, viewerID uint64, query string, limit int, offset int) ([]UserSearchResult, bool, error) {
+	query = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(query), "@"))
+	if n := utf8.RuneCountInString(query); n < 1 || n > maxSearchQuery {
+		return nil, false, ErrSearchQuery
+	}
+	if limit < 1 || limit > MaxSearchLimit || offset < 0 {
+		return nil, false, ErrSearchPaging
+	}
+
+	escaped := escapeLike(query)
+	matches, err := controller.SearchUsers(db, viewerID, controller.UserSearch{
+		Exact:      query,
+		Prefix:     escaped + "%",
+		WordPrefix: "% " + escaped + "%", // the start of a later word, e.g. a surname
+		Substring:  "%" + escaped + "%",
+		Fuzzy:      fuzzyPattern(query),
+	}, maxSearchCandidates)
+	if err != nil {
+		return nil, false, err
+	}
+
+	results := make([]UserSearchResult, len(matches))
+	for i, match := range matches {
+		results[i] = UserSearchResult{
+			ID:             match.ID,
+			Username:       match.Username,
+			DisplayName:    match.DisplayName,
+			AvatarURL:      match.AvatarURL(),
+			SharedChannels: match.SharedChannels,
+		}
+	}
+
+	if offset >= len(results) {
+		return []UserSearchResult{}, false, nil
+	}
+	end := min(offset+limit, len(results))
+	return results[offset:end], end < len(results), nil
+}
+
+func IsSearchRequestError(err error) bool {
+	return errors.Is(err, ErrSearchQuery) || errors.Is(err, ErrSearchPaging)
+}
@@ -0,0 +1,54 @@
+package internals
+
+import (
+	"fmt"
+	"testing"
+)
+
+func searchUsernames(t *testing.T, results []UserSearchResult) []string {
+	t.Helper()
+	names := make([]string, len(results))
+	for i, result := range results {
+		names[i] = result.Username
+	}
+	return names
+}
+
+func TestSearchUsersRanksBeforeCandidateLimit(t *testing.T) {
+	db := newTestDB(t)
+	viewer := createTestUser(t, db, "viewer", "")
+
+	// more fuzzy matches than are ever considered, created first so they
+	// would win any tie broken by ID
+	for i := range maxSearchCandidates + 20 {
+		createTestUser(t, db, fmt.Sprintf("a%03dxnn", i), "")
+	}
+	createTestUser(t, db, "xannie", "")
+	createTestUser(t, db, "annabel", "")
+	createTestUser(t, db, "ann", "")
+
+	results, more, err := SearchUsers(db, viewer.ID, "@Ann", 3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := searchUsernames(t, results)
+	want := []string{"ann", "annabel", "xannie"}
+	if fmt.Sprint(got) != fmt.Sprint(want) || !more {
+		t.Errorf("got %v (more=%t), want %v (more=true)", got, more, want)
+	}
+}
+
+func TestSearchUsersEscapesPattern(t *testing.T) {
+	db := newTestDB(t)
+	viewer := createTestUser(t, db, "viewer", "")
+	createTestUser(t, db, "a_b", "")
+	createTestUser(t, db, "axb", "")
+
+	results, _, err := SearchUsers(db, viewer.ID, "a_", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := searchUsernames(t, results); fmt.Sprint(got) != "[a_b]" {
+		t.Errorf("got %v, want [a_b]", got)
+	}
+}
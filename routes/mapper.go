@@ -4,12 +4,22 @@ import (
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 
+	"github.com/rtk-rnjn/ping/controller"
 	"github.com/rtk-rnjn/ping/routes/internals"
 )
 
 func MapRoutes(r *gin.Engine, db *gorm.DB) {
+	configureWebSocket()
+	internals.InitSigningKeys(db)
+	internals.InitMailer()
+	internals.InitOIDC()
+	internals.InitAuthenticators()
+	internals.InitAdmins(db)
+	controller.InitCallSweeper(db)
+
 	r.GET("/ping", PingHandler)
 	r.GET("/", RootHandler)
+	r.GET("/.well-known/jwks.json", JWKSHandler)
 
 	healthGroup := r.Group("/health")
 	{
@@ -19,28 +29,104 @@ func MapRoutes(r *gin.Engine, db *gorm.DB) {
 
 	authGroup := r.Group("/auth")
 	{
+		authGroup.GET("/registration", RegistrationInfoHandler)
+		authGroup.GET("/pow", ProofOfWorkHandler)
 		authGroup.POST("/register", RegisterHandler(db))
 		authGroup.POST("/login", LoginHandler(db))
+		authGroup.POST("/2fa", TwoFactorLoginHandler(db))
+		authGroup.POST("/refresh", RefreshHandler(db))
+		authGroup.POST("/logout", LogoutHandler(db))
+		authGroup.POST("/password/forgot", ForgotPasswordHandler(db))
+		authGroup.POST("/password/reset", ResetPasswordHandler(db))
+		authGroup.POST("/email/verify", VerifyEmailHandler(db))
+		authGroup.GET("/oidc/login", SSOLoginHandler)
+		authGroup.GET("/oidc/callback", SSOCallbackHandler(db))
+		authGroup.POST("/oidc/exchange", SSOExchangeHandler(db))
+	}
+
+	meGroup := r.Group("/me")
+	meGroup.Use(internals.MiddlewareJWTAuth(), internals.RequireSession())
+	{
+		meGroup.GET("", GetProfileHandler(db))
+		meGroup.PATCH("", UpdateProfileHandler(db))
+		meGroup.DELETE("", DeleteAccountHandler(db))
+		meGroup.POST("/deactivate", DeactivateAccountHandler(db))
+		meGroup.POST("/export", RequestDataExportHandler(db))
+		meGroup.GET("/export", GetDataExportHandler(db))
+		meGroup.GET("/export/download", DownloadDataExportHandler(db))
+		meGroup.PUT("/avatar", UploadAvatarHandler(db))
+		meGroup.DELETE("/avatar", DeleteAvatarHandler(db))
+		meGroup.GET("/blocks", ListBlocksHandler(db))
+		meGroup.POST("/blocks", BlockUserHandler(db))
+		meGroup.DELETE("/blocks/:id", UnblockUserHandler(db))
+		meGroup.POST("/password", ChangePasswordHandler(db))
+		meGroup.GET("/email", GetEmailHandler(db))
+		meGroup.PUT("/email", SetEmailHandler(db))
+		meGroup.POST("/email/verify", ResendVerificationHandler(db))
+		meGroup.GET("/sessions", ListSessionsHandler(db))
+		meGroup.DELETE("/sessions", RevokeAllSessionsHandler(db))
+		meGroup.DELETE("/sessions/:id", RevokeSessionHandler(db))
+		meGroup.GET("/tokens", ListAccessTokensHandler(db))
+		meGroup.POST("/tokens", CreateAccessTokenHandler(db))
+		meGroup.DELETE("/tokens/:id", RevokeAccessTokenHandler(db))
+		meGroup.GET("/identities", ListIdentitiesHandler(db))
+		meGroup.POST("/identities/oidc", LinkIdentityHandler)
+		meGroup.POST("/identities/oidc/confirm", ConfirmIdentityLinkHandler(db))
+		meGroup.DELETE("/identities/:id", UnlinkIdentityHandler(db))
+		meGroup.GET("/2fa", TwoFactorStatusHandler(db))
+		meGroup.POST("/2fa/totp", EnrolTOTPHandler(db))
+		meGroup.POST("/2fa/totp/confirm", ConfirmTOTPHandler(db))
+		meGroup.POST("/2fa/totp/disable", DisableTOTPHandler(db))
+		meGroup.POST("/2fa/recovery-codes", RegenerateRecoveryCodesHandler(db))
+	}
+
+	r.GET("/users/:id/avatar", GetAvatarHandler(db))
+
+	userGroup := r.Group("/users")
+	userGroup.Use(internals.MiddlewareJWTAuth(), internals.RequireScope(internals.ScopeUsersRead))
+	{
+		userGroup.GET("/search", SearchUsersHandler(db))
+		userGroup.GET("/:id", GetUserHandler(db))
+	}
+
+	adminGroup := r.Group("/admin")
+	adminGroup.Use(internals.MiddlewareJWTAuth(), internals.RequireSession(), internals.RequireAdmin())
+	{
+		adminGroup.GET("/invites", ListInvitesHandler(db))
+		adminGroup.POST("/invites", CreateInviteHandler(db))
+		adminGroup.DELETE("/invites/:id", DeleteInviteHandler(db))
+		adminGroup.GET("/users", AdminListUsersHandler(db))
+		adminGroup.GET("/users/:id", AdminGetUserHandler(db))
+		adminGroup.POST("/users/:id/disable", AdminSetUserDisabledHandler(db, true))
+		adminGroup.POST("/users/:id/enable", AdminSetUserDisabledHandler(db, false))
+		adminGroup.PUT("/users/:id/admin", AdminSetAdminHandler(db))
+		adminGroup.POST("/users/:id/password-reset", AdminResetPasswordHandler(db))
+		adminGroup.DELETE("/channels/:id", AdminDeleteChannelHandler(db))
+		adminGroup.DELETE("/messages/:id", AdminDeleteMessageHandler(db))
+		adminGroup.GET("/stats", AdminStatsHandler(db))
 	}
 
 	channelGroup := r.Group("/channel")
 	channelGroup.Use(internals.MiddlewareJWTAuth())
 	{
-		channelGroup.POST("/join", JoinChannelHandler(db))
-		channelGroup.POST("/leave", LeaveChannelHandler(db))
-		channelGroup.POST("/users", GetChannelUsersHandler(db))
-		channelGroup.POST("/create", CreateChannelHandler(db))
+		channelGroup.POST("/join", internals.RequireScope(internals.ScopeChannelsWrite), JoinChannelHandler(db))
+		channelGroup.POST("/leave", internals.RequireScope(internals.ScopeChannelsWrite), LeaveChannelHandler(db))
+		channelGroup.POST("/users", internals.RequireScope(internals.ScopeChannelsRead), GetChannelUsersHandler(db))
+		channelGroup.POST("/create", internals.RequireScope(internals.ScopeChannelsWrite), CreateChannelHandler(db))
+		channelGroup.POST("/update", internals.RequireScope(internals.ScopeChannelsWrite), UpdateChannelHandler(db))
+		channelGroup.GET("/:channelID/events", internals.RequireScope(internals.ScopeMessagesRead), ChannelEventStreamHandler(db))
+		channelGroup.GET("/:channelID/poll", internals.RequireScope(internals.ScopeMessagesRead), ChannelEventPollHandler(db))
 	}
 
 	messageGroup := r.Group("/message")
 	messageGroup.Use(internals.MiddlewareJWTAuth())
 	{
-		messageGroup.POST("/create", CreateMessageHandler(db))
+		messageGroup.POST("/create", internals.RequireScope(internals.ScopeMessagesWrite), CreateMessageHandler(db))
 	}
 
 	socketGroup := r.Group("/messages")
 	socketGroup.Use(internals.MiddlewareJWTAuth())
 	{
-		socketGroup.GET("/:channelID", WebSocketChannelMessageHandler)
+		socketGroup.GET("/:channelID", internals.RequireScope(internals.ScopeMessagesRead), WebSocketChannelMessageHandler)
 	}
 }
@@ -0,0 +1,81 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"gorm.io/gorm"
+)
+
+func ListSessionsHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+		current := c.GetString("session_id")
+
+		sessions, err := controller.GetUserSessions(db, user.ID)
+		if err != nil {
+			log.Printf("[ERROR] Failed to list sessions for userID=%d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list sessions"})
+			return
+		}
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == current
+		}
+
+		c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+	}
+}
+
+func RevokeSessionHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+		sessionID := c.Param("id")
+
+		session, err := controller.GetSessionByID(db, sessionID)
+		if err != nil || session.UserID != user.ID {
+			if err != nil && !errors.Is(err, controller.ErrSessionNotFound) {
+				log.Printf("[ERROR] Failed to look up session %s: %v", sessionID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+				return
+			}
+			log.Printf("[WARN] UserID=%d tried to revoke unknown session %s", user.ID, sessionID)
+			c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+			return
+		}
+
+		if err := controller.RevokeSession(db, sessionID); err != nil {
+			log.Printf("[ERROR] Failed to revoke session %s: %v", sessionID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+			return
+		}
+
+		log.Printf("[INFO] UserID=%d revoked session %s", user.ID, sessionID)
+		c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+	}
+}
+
+// RevokeAllSessionsHandler logs the user out everywhere. With
+// ?keep_current=true the session making the request survives.
+func RevokeAllSessionsHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		keep := ""
+		if c.Query("keep_current") == "true" {
+			keep = c.GetString("session_id")
+		}
+
+		if err := controller.RevokeUserSessions(db, user.ID, keep); err != nil {
+			log.Printf("[ERROR] Failed to revoke sessions for userID=%d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+			return
+		}
+
+		log.Printf("[INFO] UserID=%d logged out everywhere (kept=%q)", user.ID, keep)
+		c.JSON(http.StatusOK, gin.H{"message": "Logged out of all sessions"})
+	}
+}
@@ -1,24 +1,29 @@
 package routes
 
 import (
-	"context"
 	"errors"
-	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
-	"github.com/redis/go-redis/v9"
 	"github.com/rtk-rnjn/ping/config"
 	"github.com/rtk-rnjn/ping/controller"
 	"github.com/rtk-rnjn/ping/models"
+	"github.com/rtk-rnjn/ping/routes/internals"
 	"gorm.io/gorm"
 )
 
 var upgrader = websocket.Upgrader{}
 
+const replyBufferSize = 16
+
+// wsCloseRevoked is sent when the user loses access to the channel while
+// connected (left or removed from it, or account disabled).
+const wsCloseRevoked = 4403
+
 type CreateMessageRequest struct {
 	ChannelID uint64 `json:"channel_id"`
 	Content   string `json:"content"`
@@ -93,11 +98,11 @@ func verifyUserMembership(c *gin.Context, channelIDUint uint64) bool {
 }
 
 func handleWebSocket(c *gin.Context, channelIDUint uint64) {
-	cacheKey := fmt.Sprintf("channel:%d:messages", channelIDUint)
-	pubSub := controller.Rdb.Subscribe(context.Background(), cacheKey)
-	defer closePubSub(pubSub, channelIDUint)
-
-	ch := pubSub.Channel()
+	sub, err := subscribeChannel(c, channelIDUint)
+	if err != nil {
+		return
+	}
+	defer closeSubscription(sub, channelIDUint)
 
 	conn, err := upgradeWebSocket(c, channelIDUint)
 	if err != nil {
@@ -110,51 +115,103 @@ func handleWebSocket(c *gin.Context, channelIDUint uint64) {
 		return nil
 	})
 
-	go listenToClient(conn, channelIDUint)
+	enc := negotiatedEncoding(conn)
+	session := newCallSession(config.DB, c.MustGet("user").(*models.User), channelIDUint, internals.HasScope(c, internals.ScopeCalls))
 
-	for msg := range ch {
-		messageIntUint, err := strconv.ParseUint(msg.Payload, 10, 64)
-		if err != nil {
-			log.Printf("[ERROR] Invalid message format received on channel %s: %v", cacheKey, err)
-			continue
-		}
+	done := make(chan struct{})
+	replies := make(chan *models.Event, replyBufferSize)
+	go listenToClient(conn, enc, session, replies, done)
 
-		message, err := controller.GetMessageByID(config.DB, messageIntUint)
-		if err != nil {
-			log.Printf("[ERROR] Failed to get message by ID %d: %v", messageIntUint, err)
-			continue
-		}
-		if message == nil {
-			log.Printf("[WARN] Message with ID %d not found in database", messageIntUint)
-			continue
-		}
-		if message.ChannelID != channelIDUint {
-			log.Printf("[WARN] Message with ID %d does not belong to channel %d", messageIntUint, channelIDUint)
-			continue
-		}
-		log.Printf("[DEBUG] Received message from Redis PubSub (channelID=%d): %s", channelIDUint, msg.Payload)
+	for {
+		select {
+		case <-done:
+			return
 
-		jsonStringMsg, err := message.ToJSONStringPayload()
-		if err != nil {
-			log.Printf("[ERROR] Failed to convert message to JSON string (channelID=%d): %v", channelIDUint, err)
-			continue
+		case reply := <-replies:
+			payload, err := enc.encode(reply)
+			if err != nil {
+				log.Printf("[ERROR] Failed to encode %s reply as %s (channelID=%d): %v", reply.Type, enc.subprotocol, channelIDUint, err)
+				continue
+			}
+			if err := enc.write(conn, payload); err != nil {
+				log.Printf("[ERROR] Failed to send reply to WebSocket (channelID=%d): %v", channelIDUint, err)
+				return
+			}
+
+		case event, ok := <-sub.Events():
+			if !ok {
+				closeCode, closeText := websocket.CloseTryAgainLater, "too slow to keep up"
+				if reason := sub.Revoked(); reason != "" {
+					closeCode, closeText = wsCloseRevoked, reason
+				}
+				log.Printf("[INFO] Closing WebSocket for channelID=%d: %s", channelIDUint, closeText)
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(closeCode, closeText), time.Now().Add(time.Second))
+				return
+			}
+
+			payload, err := enc.encode(event)
+			if err != nil {
+				log.Printf("[ERROR] Failed to encode %s event as %s (channelID=%d): %v", event.Type, enc.subprotocol, channelIDUint, err)
+				continue
+			}
+
+			if err := enc.write(conn, payload); err != nil {
+				log.Printf("[ERROR] Failed to send event to WebSocket (channelID=%d): %v", channelIDUint, err)
+				return
+			}
+			log.Printf("[DEBUG] Sent %s event to client (channelID=%d): seq=%d", event.Type, channelIDUint, event.Seq)
 		}
+	}
+}
 
-		if err := conn.WriteMessage(websocket.TextMessage, []byte(jsonStringMsg)); err != nil {
-			log.Printf("[ERROR] Failed to send message to WebSocket (channelID=%d): %v", channelIDUint, err)
-			break
-		}
-		log.Printf("[DEBUG] Sent message to client (channelID=%d): %s", channelIDUint, jsonStringMsg)
+func subscribeChannel(c *gin.Context, channelID uint64) (*controller.Subscription, error) {
+	user := c.MustGet("user").(*models.User)
+	blocked, err := controller.GetBlockedUserIDs(config.DB, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to subscribe to channel"})
+		return nil, err
+	}
+
+	sub, err := controller.SubscribeChannel(channelID, user.ID, blocked)
+	if err != nil {
+		log.Printf("[ERROR] Failed to subscribe to channelID=%d: %v", channelID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to subscribe to channel"})
+		return nil, err
 	}
+	return sub, nil
 }
 
-func listenToClient(conn *websocket.Conn, channelIDUint uint64) {
+func listenToClient(conn *websocket.Conn, enc wireEncoding, session *callSession, replies chan<- *models.Event, done chan<- struct{}) {
+	defer close(done)
+	defer session.leaveAll()
+
+	channelIDUint := session.channelID
 	for {
-		_, _, err := conn.ReadMessage()
+		_, data, err := conn.ReadMessage()
 		if err != nil {
 			log.Printf("[ERROR] Read error from client (channelID=%d): %v", channelIDUint, err)
 			break
 		}
+
+		var frame ClientFrame
+		if err := enc.decode(data, &frame); err != nil {
+			log.Printf("[WARN] Malformed frame from client (channelID=%d): %v", channelIDUint, err)
+			sendReply(replies, models.NewErrorEvent(channelIDUint, "", "malformed frame"))
+			continue
+		}
+
+		if err := session.handle(&frame); err != nil {
+			log.Printf("[WARN] %s from user %d failed (channelID=%d): %v", frame.Type, session.user.ID, channelIDUint, err)
+			sendReply(replies, models.NewErrorEvent(channelIDUint, frame.Type, frameError(err)))
+		}
+	}
+}
+
+// replies are dropped rather than blocking the reader once the writer is gone
+func sendReply(replies chan<- *models.Event, event *models.Event) {
+	select {
+	case replies <- event:
+	default:
 	}
 }
 
@@ -183,7 +240,7 @@ func upgradeWebSocket(c *gin.Context, channelID uint64) (*websocket.Conn, error)
 		return nil, err
 	}
 
-	log.Printf("[INFO] WebSocket connection established for channelID=%d", channelID)
+	log.Printf("[INFO] WebSocket connection established for channelID=%d (subprotocol=%q)", channelID, conn.Subprotocol())
 	return conn, nil
 }
 
@@ -192,7 +249,7 @@ func closeWebSocket(conn *websocket.Conn, channelID uint64) {
 	conn.Close()
 }
 
-func closePubSub(pubSub *redis.PubSub, channelID uint64) {
-	log.Printf("[INFO] Closing Redis PubSub for channelID=%d", channelID)
-	pubSub.Close()
+func closeSubscription(sub *controller.Subscription, channelID uint64) {
+	log.Printf("[INFO] Closing channel subscription for channelID=%d", channelID)
+	sub.Close()
 }
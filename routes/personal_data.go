@@ -0,0 +1,111 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rtk-rnjn/ping/models"
+	"github.com/rtk-rnjn/ping/routes/internals"
+	"gorm.io/gorm"
+)
+
+// ConfirmPasswordRequest may be left out by users without a password; they
+// confirm by having logged in moments before.
+type ConfirmPasswordRequest struct {
+	Password string `json:"password"`
+}
+
+// --- Deactivation and Deletion ---
+
+func DeactivateAccountHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		var req ConfirmPasswordRequest
+		if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+			log.Printf("[ERROR] DeactivateAccountHandler: Invalid JSON: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := internals.DeactivateAccount(db, user.ID, c.GetString("session_id"), req.Password, internals.NewClientInfo(c, "")); err != nil {
+			accountError(c, err, "deactivate account")
+			return
+		}
+
+		log.Printf("[INFO] UserID=%d deactivated their account", user.ID)
+		c.JSON(http.StatusOK, gin.H{"message": "Account deactivated, you have been signed out"})
+	}
+}
+
+func DeleteAccountHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		var req ConfirmPasswordRequest
+		if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+			log.Printf("[ERROR] DeleteAccountHandler: Invalid JSON: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := internals.DeleteAccount(db, user.ID, c.GetString("session_id"), req.Password, internals.NewClientInfo(c, "")); err != nil {
+			accountError(c, err, "delete account")
+			return
+		}
+
+		log.Printf("[INFO] UserID=%d deleted their account", user.ID)
+		c.JSON(http.StatusOK, gin.H{"message": "Account deleted", "messages": internals.DeletedMessagesPolicy()})
+	}
+}
+
+// --- Data Export ---
+
+func RequestDataExportHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		export, err := internals.RequestDataExport(db, user, internals.NewClientInfo(c, ""))
+		if err != nil {
+			accountError(c, err, "start data export")
+			return
+		}
+
+		c.JSON(http.StatusAccepted, export)
+	}
+}
+
+func GetDataExportHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		export, err := internals.DataExportStatus(db, user.ID)
+		if err != nil {
+			accountError(c, err, "get data export")
+			return
+		}
+
+		c.JSON(http.StatusOK, export)
+	}
+}
+
+func DownloadDataExportHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		export, err := internals.DataExportArchive(db, user.ID)
+		if err != nil {
+			accountError(c, err, "download data export")
+			return
+		}
+
+		name := fmt.Sprintf("ping-%s-%s.zip", user.Username, export.CreatedAt.Format("2006-01-02"))
+		c.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+		c.Header("Cache-Control", "no-store")
+		c.Data(http.StatusOK, "application/zip", export.Data)
+	}
+}
@@ -0,0 +1,256 @@
+package routes
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"github.com/rtk-rnjn/ping/routes/internals"
+	"gorm.io/gorm"
+)
+
+type ProfileRequest struct {
+	DisplayName *string        `json:"display_name"`
+	Bio         *string        `json:"bio"`
+	Pronouns    *string        `json:"pronouns"`
+	Timezone    *string        `json:"timezone"`
+	Status      *StatusRequest `json:"status"`
+}
+
+type StatusRequest struct {
+	Text      string `json:"text"`
+	Emoji     string `json:"emoji"`
+	ExpiresIn int64  `json:"expires_in"`
+}
+
+func userIDParam(c *gin.Context) (uint64, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return 0, false
+	}
+	return id, true
+}
+
+// --- Profiles ---
+
+func GetUserHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := userIDParam(c)
+		if !ok {
+			return
+		}
+
+		user, err := controller.GetUserProfile(db, id)
+		if errors.Is(err, controller.ErrUserNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+			return
+		}
+
+		c.JSON(http.StatusOK, user.Profile(time.Now()))
+	}
+}
+
+func GetProfileHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		profile, err := controller.GetUserProfile(db, user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get profile"})
+			return
+		}
+
+		c.JSON(http.StatusOK, profile.Profile(time.Now()))
+	}
+}
+
+func UpdateProfileHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		var req ProfileRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Printf("[ERROR] UpdateProfileHandler: Invalid JSON: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		update := internals.ProfileUpdate{
+			DisplayName: req.DisplayName,
+			Bio:         req.Bio,
+			Pronouns:    req.Pronouns,
+			Timezone:    req.Timezone,
+		}
+		if req.Status != nil {
+			update.Status = &internals.StatusUpdate{
+				Text:      req.Status.Text,
+				Emoji:     req.Status.Emoji,
+				ExpiresIn: time.Duration(req.Status.ExpiresIn) * time.Second,
+			}
+		}
+
+		profile, err := internals.UpdateProfile(db, user, update)
+		var invalid *internals.ValidationError
+		if errors.As(err, &invalid) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid profile", "fields": invalid.Fields})
+			return
+		}
+		if err != nil {
+			log.Printf("[ERROR] Failed to update profile of userID=%d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+			return
+		}
+
+		c.JSON(http.StatusOK, profile.Profile(time.Now()))
+	}
+}
+
+// --- Search ---
+
+// SearchUsersHandler serves GET /users/search?q=ali&limit=20&offset=0.
+func SearchUsersHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(internals.DefaultSearchLimit)))
+		if err != nil {
+			limit = -1
+		}
+		offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if err != nil {
+			offset = -1
+		}
+
+		results, more, err := internals.SearchUsers(db, user.ID, c.Query("q"), limit, offset)
+		if internals.IsSearchRequestError(err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search users"})
+			return
+		}
+
+		response := gin.H{"users": results, "next_offset": nil}
+		if more {
+			response["next_offset"] = offset + len(results)
+		}
+		c.JSON(http.StatusOK, response)
+	}
+}
+
+// --- Avatars ---
+
+// readAvatarUpload takes the image from the "avatar" field of a multipart
+// form, or else the raw request body.
+func readAvatarUpload(c *gin.Context) ([]byte, error) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, internals.MaxAvatarBytes+1<<20)
+	if !strings.HasPrefix(c.ContentType(), "multipart/") {
+		return io.ReadAll(c.Request.Body)
+	}
+
+	header, err := c.FormFile("avatar")
+	if err != nil {
+		return nil, err
+	}
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(io.LimitReader(file, internals.MaxAvatarBytes+1))
+}
+
+func UploadAvatarHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		data, err := readAvatarUpload(c)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) || len(data) > internals.MaxAvatarBytes {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Avatar must be at most 8 MiB"})
+			return
+		}
+		if err != nil || len(data) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Send the image as the request body or in an 'avatar' form field"})
+			return
+		}
+
+		profile, err := internals.SetAvatar(db, user, data)
+		if internals.IsAvatarRequestError(err) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			log.Printf("[ERROR] Failed to set avatar of userID=%d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save avatar"})
+			return
+		}
+
+		c.JSON(http.StatusOK, profile.Profile(time.Now()))
+	}
+}
+
+func DeleteAvatarHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		err := controller.DeleteAvatar(db, user.ID)
+		if errors.Is(err, controller.ErrAvatarNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "No avatar set"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete avatar"})
+			return
+		}
+
+		log.Printf("[INFO] UserID=%d removed their avatar", user.ID)
+		c.JSON(http.StatusOK, gin.H{"message": "Avatar removed"})
+	}
+}
+
+// GetAvatarHandler serves avatars without authentication so they can be
+// used in <img> tags. Versioned URLs never change and are cached for good.
+func GetAvatarHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := userIDParam(c)
+		if !ok {
+			return
+		}
+		wanted, err := strconv.Atoi(c.DefaultQuery("size", strconv.Itoa(internals.DefaultAvatarSize)))
+		if err != nil || wanted < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid size"})
+			return
+		}
+
+		avatar, err := controller.GetAvatar(db, id, internals.AvatarSize(wanted))
+		if errors.Is(err, controller.ErrAvatarNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Avatar not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get avatar"})
+			return
+		}
+
+		if c.Query("v") != "" {
+			c.Header("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			c.Header("Cache-Control", "public, max-age=300")
+		}
+		c.Data(http.StatusOK, "image/png", avatar.Data)
+	}
+}
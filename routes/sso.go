@@ -0,0 +1,248 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"github.com/rtk-rnjn/ping/routes/internals"
+	"gorm.io/gorm"
+)
+
+type SSOExchangeRequest struct {
+	Code       string `json:"code" binding:"required"`
+	DeviceName string `json:"device_name,omitempty"`
+}
+
+type ConfirmIdentityLinkRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// ssoStateCookie ties a login to the browser that started it, so a callback
+// URL handed to someone else doesn't log them in.
+const ssoStateCookie = "ping_sso_state"
+
+func ssoError(c *gin.Context, err error, action string) {
+	switch {
+	case errors.Is(err, internals.ErrSSODisabled):
+		c.JSON(http.StatusNotFound, gin.H{"error": "SSO is not configured"})
+	case errors.Is(err, internals.ErrSSOFailed),
+		errors.Is(err, internals.ErrSSOWrongBrowser),
+		errors.Is(err, internals.ErrSSOHandoffInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, internals.ErrSSONoAccount),
+		errors.Is(err, internals.ErrSSOAccountDisabled):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, controller.ErrIdentityLinked),
+		errors.Is(err, internals.ErrLastLoginMethod):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Printf("[ERROR] Failed to %s: %v", action, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to " + action})
+	}
+}
+
+func respondLogin(c *gin.Context, tokens *internals.TokenPair, challenge *internals.TwoFactorChallenge) {
+	if challenge != nil {
+		c.JSON(http.StatusOK, ChallengeResponse{
+			TwoFactorRequired: true,
+			ChallengeToken:    challenge.Token,
+			ExpiresIn:         int64(challenge.ExpiresIn.Seconds()),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, newTokenResponse(tokens))
+}
+
+// appRedirect sends the browser back to the web app with the outcome in the
+// query string. It returns false when APP_URL isn't set.
+func appRedirect(c *gin.Context, query url.Values) bool {
+	base := strings.TrimRight(os.Getenv("APP_URL"), "/")
+	if base == "" {
+		return false
+	}
+	c.Redirect(http.StatusFound, base+"/sso/callback?"+query.Encode())
+	return true
+}
+
+// setSSOStateCookie scopes the cookie to the callback's path, and marks it
+// Secure when the callback is served over https.
+func setSSOStateCookie(c *gin.Context, value string, maxAge int) {
+	path, secure := "/", false
+	if callback, err := url.Parse(os.Getenv("OIDC_REDIRECT_URL")); err == nil {
+		if dir := callback.Path[:strings.LastIndex(callback.Path, "/")+1]; dir != "" {
+			path = dir
+		}
+		secure = callback.Scheme == "https"
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(ssoStateCookie, value, maxAge, path, "", secure, true)
+}
+
+// --- Login ---
+
+func SSOLoginHandler(c *gin.Context) {
+	authURL, binding, err := internals.BeginSSO(c.Query("device_name"), 0)
+	if err != nil {
+		ssoError(c, err, "start single sign-on")
+		return
+	}
+	setSSOStateCookie(c, binding, int(internals.SSOStateTTL.Seconds()))
+	c.Redirect(http.StatusFound, authURL)
+}
+
+// SSOCallbackHandler is where the provider sends the browser back to. With
+// APP_URL set the browser goes on to the web app carrying a one-time code;
+// otherwise the login result is the response. A link comes back as a
+// link_code for the signed-in app to confirm.
+func SSOCallbackHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		binding, _ := c.Cookie(ssoStateCookie)
+		if binding != "" {
+			setSSOStateCookie(c, "", -1)
+		}
+
+		if reason := c.Query("error"); reason != "" {
+			log.Printf("[WARN] Identity provider returned error=%s: %s", reason, c.Query("error_description"))
+			if !appRedirect(c, url.Values{"error": {reason}}) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Identity provider refused: " + reason})
+			}
+			return
+		}
+
+		login, err := internals.CompleteSSO(db, c.Query("state"), binding, c.Query("code"), internals.NewClientInfo(c, ""))
+		if err != nil {
+			if errors.Is(err, internals.ErrSSODisabled) || !appRedirect(c, url.Values{"error": {err.Error()}}) {
+				ssoError(c, err, "complete single sign-on")
+			}
+			return
+		}
+
+		if login.LinkCode != "" {
+			if !appRedirect(c, url.Values{"link_code": {login.LinkCode}}) {
+				c.JSON(http.StatusOK, gin.H{"link_code": login.LinkCode})
+			}
+			return
+		}
+
+		if os.Getenv("APP_URL") != "" {
+			code, err := internals.CreateSSOHandoff(login)
+			if err != nil {
+				ssoError(c, err, "complete single sign-on")
+				return
+			}
+			appRedirect(c, url.Values{"code": {code}})
+			return
+		}
+
+		tokens, challenge, err := internals.FinishSSOLogin(db, login, internals.NewClientInfo(c, ""))
+		if err != nil {
+			ssoError(c, err, "complete single sign-on")
+			return
+		}
+		log.Printf("[INFO] User logged in through SSO: userID=%d", login.User.ID)
+		respondLogin(c, tokens, challenge)
+	}
+}
+
+// SSOExchangeHandler trades the code the web app got from the callback
+// redirect for tokens, or for a 2FA challenge.
+func SSOExchangeHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req SSOExchangeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Printf("[ERROR] SSOExchangeHandler: Invalid JSON: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		tokens, challenge, err := internals.ExchangeSSOHandoff(db, req.Code, internals.NewClientInfo(c, req.DeviceName))
+		if err != nil {
+			ssoError(c, err, "complete single sign-on")
+			return
+		}
+		respondLogin(c, tokens, challenge)
+	}
+}
+
+// --- Linked Identities ---
+
+func ListIdentitiesHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		identities, err := controller.GetUserIdentities(db, user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list identities"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"identities": identities, "sso_enabled": internals.SSOEnabled()})
+	}
+}
+
+// LinkIdentityHandler returns the provider URL rather than redirecting, since
+// the request carries a bearer token the browser navigation wouldn't.
+func LinkIdentityHandler(c *gin.Context) {
+	user := c.MustGet("user").(*models.User)
+
+	authURL, _, err := internals.BeginSSO("", user.ID)
+	if err != nil {
+		ssoError(c, err, "start linking")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"authorization_url": authURL})
+}
+
+// ConfirmIdentityLinkHandler links the identity the callback parked, as long
+// as the caller is the user who started linking it.
+func ConfirmIdentityLinkHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		var req ConfirmIdentityLinkRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Printf("[ERROR] ConfirmIdentityLinkHandler: Invalid JSON: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := internals.ConfirmIdentityLink(db, user, req.Code, internals.NewClientInfo(c, "")); err != nil {
+			ssoError(c, err, "link identity")
+			return
+		}
+
+		log.Printf("[INFO] Identity linked: userID=%d", user.ID)
+		c.JSON(http.StatusOK, gin.H{"message": "Identity linked"})
+	}
+}
+
+func UnlinkIdentityHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Identity not found"})
+			return
+		}
+
+		if err := internals.UnlinkIdentity(db, user.ID, id); err != nil {
+			if errors.Is(err, controller.ErrIdentityNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": "Identity not found"})
+				return
+			}
+			ssoError(c, err, "unlink identity")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Identity unlinked"})
+	}
+}
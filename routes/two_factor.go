@@ -0,0 +1,134 @@
+package routes
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rtk-rnjn/ping/controller"
+	"github.com/rtk-rnjn/ping/models"
+	"github.com/rtk-rnjn/ping/routes/internals"
+	"gorm.io/gorm"
+)
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+func twoFactorError(c *gin.Context, err error, action string) {
+	switch {
+	case errors.Is(err, internals.ErrInvalidTwoFactorCode):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+	case errors.Is(err, internals.ErrTwoFactorEnabled),
+		errors.Is(err, internals.ErrTwoFactorNotEnabled),
+		errors.Is(err, internals.ErrEnrolmentExpired):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Printf("[ERROR] Failed to %s: %v", action, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to " + action})
+	}
+}
+
+func TwoFactorStatusHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		var current models.User
+		if err := db.First(&current, user.ID).Error; err != nil {
+			log.Printf("[ERROR] Failed to load userID=%d: %v", user.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load two-factor status"})
+			return
+		}
+
+		remaining, err := controller.CountUnusedRecoveryCodes(db, user.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load two-factor status"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"enabled":                  current.TwoFactorEnabled(),
+			"enabled_at":               current.TOTPEnabledAt,
+			"recovery_codes_remaining": remaining,
+		})
+	}
+}
+
+func EnrolTOTPHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		secret, uri, err := internals.BeginTOTPEnrolment(db, user.ID)
+		if err != nil {
+			twoFactorError(c, err, "start enrolment")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"secret": secret, "otpauth_uri": uri})
+	}
+}
+
+func ConfirmTOTPHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		var req TwoFactorCodeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Printf("[ERROR] ConfirmTOTPHandler: Invalid JSON: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		codes, err := internals.ConfirmTOTPEnrolment(db, user.ID, req.Code)
+		if err != nil {
+			twoFactorError(c, err, "enable two-factor authentication")
+			return
+		}
+
+		log.Printf("[INFO] UserID=%d enabled two-factor authentication", user.ID)
+		c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+	}
+}
+
+func DisableTOTPHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		var req TwoFactorCodeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Printf("[ERROR] DisableTOTPHandler: Invalid JSON: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := internals.DisableTwoFactor(db, user.ID, req.Code); err != nil {
+			twoFactorError(c, err, "disable two-factor authentication")
+			return
+		}
+
+		log.Printf("[INFO] UserID=%d disabled two-factor authentication", user.ID)
+		c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+	}
+}
+
+func RegenerateRecoveryCodesHandler(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user := c.MustGet("user").(*models.User)
+
+		var req TwoFactorCodeRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			log.Printf("[ERROR] RegenerateRecoveryCodesHandler: Invalid JSON: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		codes, err := internals.RegenerateRecoveryCodes(db, user.ID, req.Code)
+		if err != nil {
+			twoFactorError(c, err, "regenerate recovery codes")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+	}
+}
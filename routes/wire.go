@@ -0,0 +1,116 @@
+package routes
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+	"github.com/ugorji/go/codec"
+)
+
+const defaultWSCompressionThreshold = 512
+
+// wsCompressionThreshold is the smallest frame (in bytes) worth running
+// through permessage-deflate; smaller frames tend to grow when compressed.
+var wsCompressionThreshold = defaultWSCompressionThreshold
+
+// --- Wire Encodings ---
+
+// wireEncoding is negotiated through the Sec-WebSocket-Protocol header.
+// Clients that don't ask for a subprotocol get JSON text frames.
+type wireEncoding struct {
+	subprotocol string
+	messageType int
+	encode      func(v any) ([]byte, error)
+	decode      func(data []byte, v any) error
+}
+
+var (
+	msgpackHandle = &codec.MsgpackHandle{WriteExt: true}
+	cborHandle    = &codec.CborHandle{}
+)
+
+func init() {
+	// relayed payloads (SDP, ICE candidates) are re-published as JSON, which
+	// cannot represent the map[any]any the codecs decode maps into by default
+	mapType := reflect.TypeOf(map[string]any(nil))
+	msgpackHandle.RawToString = true
+	msgpackHandle.MapType = mapType
+	cborHandle.MapType = mapType
+}
+
+var jsonEncoding = wireEncoding{
+	subprotocol: "ping.json",
+	messageType: websocket.TextMessage,
+	encode:      json.Marshal,
+	decode:      json.Unmarshal,
+}
+
+var wireEncodings = []wireEncoding{
+	jsonEncoding,
+	{
+		subprotocol: "ping.msgpack",
+		messageType: websocket.BinaryMessage,
+		encode:      codecEncoder(msgpackHandle),
+		decode:      codecDecoder(msgpackHandle),
+	},
+	{
+		subprotocol: "ping.cbor",
+		messageType: websocket.BinaryMessage,
+		encode:      codecEncoder(cborHandle),
+		decode:      codecDecoder(cborHandle),
+	},
+}
+
+func codecEncoder(h codec.Handle) func(v any) ([]byte, error) {
+	return func(v any) ([]byte, error) {
+		var out []byte
+		err := codec.NewEncoderBytes(&out, h).Encode(v)
+		return out, err
+	}
+}
+
+func codecDecoder(h codec.Handle) func(data []byte, v any) error {
+	return func(data []byte, v any) error {
+		return codec.NewDecoderBytes(data, h).Decode(v)
+	}
+}
+
+func wireSubprotocols() []string {
+	protocols := make([]string, 0, len(wireEncodings))
+	for _, enc := range wireEncodings {
+		protocols = append(protocols, enc.subprotocol)
+	}
+	return protocols
+}
+
+func negotiatedEncoding(conn *websocket.Conn) wireEncoding {
+	for _, enc := range wireEncodings {
+		if enc.subprotocol == conn.Subprotocol() {
+			return enc
+		}
+	}
+	return jsonEncoding
+}
+
+func (enc wireEncoding) write(conn *websocket.Conn, payload []byte) error {
+	conn.EnableWriteCompression(len(payload) >= wsCompressionThreshold)
+	return conn.WriteMessage(enc.messageType, payload)
+}
+
+func configureWebSocket() {
+	upgrader.Subprotocols = wireSubprotocols()
+	upgrader.EnableCompression = true
+
+	if value := os.Getenv("WS_COMPRESSION_THRESHOLD"); value != "" {
+		threshold, err := strconv.Atoi(value)
+		if err != nil || threshold < 0 {
+			log.Fatalf("[FATAL] Invalid WS_COMPRESSION_THRESHOLD %q", value)
+		}
+		wsCompressionThreshold = threshold
+	}
+	log.Printf("[INFO] WebSocket encodings: %v (compression above %d bytes)", upgrader.Subprotocols, wsCompressionThreshold)
+}
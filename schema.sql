@@ -4,7 +4,20 @@ CREATE TABLE IF NOT EXISTS users (
     password_hash VARCHAR(128) NOT NULL,
     display_name VARCHAR(64) NOT NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    disabled_at TIMESTAMP,
+    admin BOOLEAN NOT NULL DEFAULT 0,
+    totp_secret VARCHAR(64),
+    totp_enabled_at TIMESTAMP,
+    email VARCHAR(254) UNIQUE,
+    email_verified_at TIMESTAMP,
+    bio VARCHAR(256) NOT NULL DEFAULT '',
+    pronouns VARCHAR(32) NOT NULL DEFAULT '',
+    timezone VARCHAR(64) NOT NULL DEFAULT '',
+    status_text VARCHAR(128) NOT NULL DEFAULT '',
+    status_emoji VARCHAR(32) NOT NULL DEFAULT '',
+    status_expires_at TIMESTAMP,
+    avatar_updated_at TIMESTAMP
 );
 
 CREATE TABLE IF NOT EXISTS channels (
@@ -21,10 +34,11 @@ CREATE TABLE IF NOT EXISTS messages (
     user_id INT NOT NULL,
     content VARCHAR(256) NOT NULL,
     reply_to INT,
+    system BOOLEAN NOT NULL DEFAULT 0,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
     FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE,
-    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE RESTRICT,
     FOREIGN KEY (reply_to) REFERENCES messages(id) ON DELETE SET NULL
 );
 
@@ -37,3 +51,160 @@ CREATE TABLE IF NOT EXISTS user_channels (
     FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE,
     UNIQUE (user_id, channel_id)
 );
+
+CREATE TABLE IF NOT EXISTS sessions (
+    id VARCHAR(32) PRIMARY KEY NOT NULL,
+    user_id INT NOT NULL,
+    device VARCHAR(64),
+    ip VARCHAR(45),
+    user_agent VARCHAR(256),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    user_id INT NOT NULL,
+    family_id VARCHAR(32) NOT NULL, -- the session the token belongs to
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+
+CREATE TABLE IF NOT EXISTS signing_keys (
+    id VARCHAR(32) PRIMARY KEY NOT NULL,
+    algorithm VARCHAR(16) NOT NULL,
+    private_key TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    activates_at TIMESTAMP, -- NULL: signs from created_at
+    retired_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    user_id INT NOT NULL,
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user_id ON recovery_codes(user_id);
+
+CREATE TABLE IF NOT EXISTS user_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    user_id INT NOT NULL,
+    purpose VARCHAR(32) NOT NULL, -- password_reset or email_verification
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    email VARCHAR(254),
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_tokens_user_id ON user_tokens(user_id);
+
+CREATE TABLE IF NOT EXISTS personal_access_tokens (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    user_id INT NOT NULL,
+    name VARCHAR(64) NOT NULL,
+    prefix VARCHAR(32) NOT NULL, -- ping_pat_ and 8 characters of the token
+    token_hash VARCHAR(64) NOT NULL UNIQUE,
+    scopes VARCHAR(255) NOT NULL, -- space-separated
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    last_used_ip VARCHAR(45),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_personal_access_tokens_user_id ON personal_access_tokens(user_id);
+
+CREATE TABLE IF NOT EXISTS external_identities (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    user_id INT NOT NULL,
+    provider VARCHAR(255) NOT NULL, -- OIDC issuer URL, or 'ldap'
+    subject VARCHAR(255) NOT NULL,
+    email VARCHAR(254),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_login_at TIMESTAMP,
+    UNIQUE (provider, subject),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_external_identities_user_id ON external_identities(user_id);
+
+CREATE TABLE IF NOT EXISTS invites (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    code_hash VARCHAR(64) NOT NULL UNIQUE,
+    prefix VARCHAR(16) NOT NULL,
+    note VARCHAR(128),
+    created_by_id INT,
+    max_uses INT NOT NULL DEFAULT 1,
+    uses INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (created_by_id) REFERENCES users(id) ON DELETE SET NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_invites_created_by_id ON invites(created_by_id);
+
+CREATE TABLE IF NOT EXISTS avatars (
+    user_id INT NOT NULL,
+    size INT NOT NULL,
+    data BLOB NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, size),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS blocks (
+    blocker_id INT NOT NULL,
+    blocked_id INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (blocker_id, blocked_id),
+    FOREIGN KEY (blocker_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (blocked_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_blocks_blocked_id ON blocks(blocked_id);
+
+CREATE TABLE IF NOT EXISTS data_exports (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    user_id INT NOT NULL,
+    state VARCHAR(16) NOT NULL,
+    size INT NOT NULL DEFAULT 0,
+    data BLOB,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP,
+    expires_at TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_data_exports_user_id ON data_exports(user_id);
+
+CREATE TABLE IF NOT EXISTS audit_entries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    action VARCHAR(64) NOT NULL,
+    user_id INT,
+    subject VARCHAR(128),
+    ip VARCHAR(45),
+    details TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_entries_action ON audit_entries(action);
+CREATE INDEX IF NOT EXISTS idx_audit_entries_user_id ON audit_entries(user_id);
+CREATE INDEX IF NOT EXISTS idx_audit_entries_created_at ON audit_entries(created_at);